@@ -0,0 +1,209 @@
+package runtime
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// DefaultInstrumentCacheSize is the memory size of the default instrumentation cache
+const DefaultInstrumentCacheSize = 64 * 1024 * 1024
+
+// InstrumentCache keeps the instrumented code of the aspects, so that the
+// instrumentation is done only once for each code. Entries are kept in memory
+// up to maxSize bytes and the least recently used ones are dropped. If a
+// directory is given, entries are also written to it and looked up there on
+// a memory miss, the files are never removed by the cache.
+type InstrumentCache struct {
+	sync.Mutex
+
+	maxSize int64
+	size    int64
+	dir     string
+
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type instrumentCacheEntry struct {
+	key  string
+	code []byte
+}
+
+// NewInstrumentCache creates an instrumentation cache, dir is optional
+func NewInstrumentCache(maxSize int64, dir string) (*InstrumentCache, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("max size of the instrumentation cache must be positive")
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, errors.Wrap(err, "unable to create instrumentation cache dir")
+		}
+	}
+
+	return &InstrumentCache{
+		maxSize: maxSize,
+		dir:     dir,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+var instrumentCache = struct {
+	sync.RWMutex
+	cache *InstrumentCache
+}{}
+
+func init() {
+	instrumentCache.cache, _ = NewInstrumentCache(DefaultInstrumentCacheSize, "")
+}
+
+// SetMaxConcurrentCompilations limits the number of aspects instrumented or
+// compiled at the same time by all the engines, the default is the number of
+// CPUs.
+func SetMaxConcurrentCompilations(n int) {
+	types.SetMaxConcurrentCompilations(n)
+}
+
+// SetInstrumentCache replaces the instrumentation cache used by NewAspectRuntime, nil disables it
+func SetInstrumentCache(cache *InstrumentCache) {
+	instrumentCache.Lock()
+	defer instrumentCache.Unlock()
+
+	instrumentCache.cache = cache
+}
+
+func sharedInstrumentCache() *InstrumentCache {
+	instrumentCache.RLock()
+	defer instrumentCache.RUnlock()
+
+	return instrumentCache.cache
+}
+
+// Len returns the number of entries in memory
+func (c *InstrumentCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
+
+// Get returns the instrumented code of the key
+func (c *InstrumentCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*instrumentCacheEntry).code, true
+	}
+
+	if c.dir == "" {
+		return nil, false
+	}
+	code, err := c.readFile(key)
+	if err != nil {
+		return nil, false
+	}
+	c.add(key, code)
+	return code, true
+}
+
+// Put adds the instrumented code of the key
+func (c *InstrumentCache) Put(key string, code []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return nil
+	}
+	c.add(key, code)
+
+	if c.dir == "" {
+		return nil
+	}
+	return c.writeFile(key, code)
+}
+
+func (c *InstrumentCache) add(key string, code []byte) {
+	if int64(len(code)) > c.maxSize {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&instrumentCacheEntry{key: key, code: code})
+	c.size += int64(len(code))
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*instrumentCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.code))
+	}
+}
+
+// readFile reads a cache file, which is the sha256 of the code followed by the code
+func (c *InstrumentCache) readFile(key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, key+".wasm"))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha256.Size {
+		return nil, errors.New("invalid instrumentation cache file")
+	}
+
+	code := data[sha256.Size:]
+	hash := sha256.Sum256(code)
+	if !bytes.Equal(hash[:], data[:sha256.Size]) {
+		return nil, errors.New("instrumentation cache checksum mismatch")
+	}
+	return code, nil
+}
+
+func (c *InstrumentCache) writeFile(key string, code []byte) error {
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.Sum256(code)
+	if _, err := tmp.Write(append(hash[:], code...)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.dir, key+".wasm"))
+}
+
+// instrumentCacheKey is the hash of the original code and everything else
+// affecting the output of the instrumentation
+func instrumentCacheKey(code []byte, config *types.RuntimeConfig) string {
+	h := sha256.New()
+	var header [10]byte
+	binary.BigEndian.PutUint32(header[:4], instrument.Version)
+	binary.BigEndian.PutUint32(header[4:8], config.MaxStackHeight)
+	header[8] = byte(config.Metering)
+	header[9] = byte(config.Reset)
+	h.Write(header[:])
+	if config.Metering == types.InstrumentedMetering {
+		if config.Instrumentation != nil {
+			h.Write(config.Instrumentation.Hash())
+		} else {
+			h.Write([]byte(builtinInstrumentVersion))
+		}
+	}
+	h.Write(code)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,96 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/artela-network/aspect-runtime/types"
+	"github.com/artela-network/aspect-runtime/wasmtime"
+)
+
+func TestInstrumentCache(t *testing.T) {
+	cache, err := NewInstrumentCache(8, "")
+	require.Equal(t, nil, err)
+
+	require.Equal(t, nil, cache.Put("a", []byte{1, 2, 3, 4}))
+	require.Equal(t, nil, cache.Put("b", []byte{5, 6, 7, 8}))
+	code, ok := cache.Get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte{1, 2, 3, 4}, code)
+
+	// b is the least recently used one
+	require.Equal(t, nil, cache.Put("c", []byte{9}))
+	_, ok = cache.Get("b")
+	require.False(t, ok)
+	require.Equal(t, 2, cache.Len())
+
+	// entries larger than the cache are not kept
+	require.Equal(t, nil, cache.Put("d", make([]byte, 9)))
+	_, ok = cache.Get("d")
+	require.False(t, ok)
+}
+
+func TestInstrumentCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewInstrumentCache(1024, dir)
+	require.Equal(t, nil, err)
+	require.Equal(t, nil, cache.Put("a", []byte{1, 2, 3, 4}))
+	require.Equal(t, nil, cache.Put("b", []byte{5, 6, 7, 8}))
+
+	// a new cache finds the entries of the previous one on disk
+	cache, err = NewInstrumentCache(1024, dir)
+	require.Equal(t, nil, err)
+	code, ok := cache.Get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte{1, 2, 3, 4}, code)
+
+	// corrupted files are ignored
+	file := path.Join(dir, "b.wasm")
+	data, err := os.ReadFile(file)
+	require.Equal(t, nil, err)
+	data[len(data)-1] ^= 0xff
+	require.Equal(t, nil, os.WriteFile(file, data, 0o600))
+	_, ok = cache.Get("b")
+	require.False(t, ok)
+}
+
+// Test Case: runtimes of the same code are instrumented only once
+func TestInstrumentCacheHit(t *testing.T) {
+	cache := isolateCaches(t)
+	raw := newFixture(t).code()
+
+	modes := supportedOptions(nil, nil, []Option{WithFuelMetering()}, []Option{WithFuelMetering()})
+	for _, opts := range modes {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+		res, _, err := rt.Call("testIncrease", types.MaxGas)
+		require.Equal(t, nil, err)
+		require.Equal(t, "10", res)
+		rt.Destroy()
+	}
+
+	// one entry for each metering mode
+	require.Equal(t, len(modes)/2, cache.Len())
+
+	key := instrumentCacheKey(raw, newRuntimeConfig(nil))
+	require.NotEqual(t, key, instrumentCacheKey(raw, newRuntimeConfig([]Option{WithMaxStackHeight(1)})))
+	require.NotEqual(t, key, instrumentCacheKey(raw[:len(raw)-1], newRuntimeConfig(nil)))
+
+	// the code of another build of the built-in instrumentation is not reused
+	if builtinInstrument != nil {
+		require.NotEqual(t, "", builtinInstrumentVersion)
+		version := builtinInstrumentVersion
+		defer func() {
+			builtinInstrumentVersion = version
+		}()
+		builtinInstrumentVersion = "github.com/artela-network/wasmtime-go/v20@v20.0.4"
+		require.NotEqual(t, key, instrumentCacheKey(raw, newRuntimeConfig(nil)))
+	}
+}
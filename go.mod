@@ -5,9 +5,11 @@ go 1.20
 require (
 	github.com/bytecodealliance/wasmtime-go/v20 v20.0.0
 	github.com/ethereum/go-ethereum v1.12.0
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904
 	github.com/google/uuid v1.3.0
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.8.2
+	github.com/tetratelabs/wazero v1.7.3
 )
 
 require (
@@ -0,0 +1,190 @@
+package instrument
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the pricing of the gas instrumentation, all costs are in WASM gas
+type Config struct {
+	// DefaultCost is charged for every instruction without an entry in OpcodeCosts
+	DefaultCost int64
+
+	// OpcodeCosts overrides the cost of single opcodes, all the 0xfc prefixed
+	// instructions are priced with the entry of 0xfc.
+	OpcodeCosts map[byte]int64
+
+	// MemoryPageCost is charged for each page requested by memory.grow
+	MemoryPageCost int64
+
+	// CallCost is charged on top of the opcode cost for call and call_indirect
+	CallCost int64
+}
+
+// MaxCost is the upper bound of each cost in Config, it keeps the charges
+// computed at runtime from overflowing: memory.grow of 2^32-1 pages at MaxCost
+// per page still fits in an i64.
+const MaxCost = math.MaxInt32
+
+// Validate checks that all costs are within [0, MaxCost]
+func (c *Config) Validate() error {
+	valid := func(cost int64) bool {
+		return cost >= 0 && cost <= MaxCost
+	}
+
+	if !valid(c.DefaultCost) || !valid(c.MemoryPageCost) || !valid(c.CallCost) {
+		return errors.New("instrumentation cost out of range")
+	}
+	for op, cost := range c.OpcodeCosts {
+		if !valid(cost) {
+			return errors.Errorf("cost of opcode 0x%x out of range", op)
+		}
+	}
+	return nil
+}
+
+// Hash returns a digest of the config, runtimes instrumented with configs of
+// the same hash charge the same code equally.
+func (c *Config) Hash() []byte {
+	ops := make([]int, 0, len(c.OpcodeCosts))
+	for op := range c.OpcodeCosts {
+		ops = append(ops, int(op))
+	}
+	sort.Ints(ops)
+
+	buf := make([]byte, 0, 24+9*len(ops))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.DefaultCost))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.MemoryPageCost))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.CallCost))
+	for _, op := range ops {
+		buf = append(buf, byte(op))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(c.OpcodeCosts[byte(op)]))
+	}
+
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
+
+func (c *Config) cost(instr instruction) int64 {
+	cost, ok := c.OpcodeCosts[instr.op]
+	if !ok {
+		cost = c.DefaultCost
+	}
+	if instr.op == opCall || instr.op == opCallIndirect {
+		cost += c.CallCost
+	}
+	return cost
+}
+
+// Instrument injects gas metering into the code with the given pricing. Like
+// the built-in instrumentation of the engine, the remaining gas is kept in an
+// i64 global exported as "__gas_counter__", and the cost of each straight-line
+// block of code is charged at the block entry. When the counter cannot cover
+// the cost, it is set to -1 and the execution traps.
+func Instrument(code []byte, config *Config) ([]byte, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	m, err := DecodeModule(code)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := m.ExportedGlobal(GasCounterExport); ok {
+		return nil, errors.New("module is already instrumented")
+	}
+
+	counter := m.AddGlobal(Global{Type: ValueI64, Mutable: true, Init: []byte{opI64Const, 0, opEnd}})
+	m.Exports = append(m.Exports, Export{Name: GasCounterExport, Kind: ExternGlobal, Index: counter})
+
+	defined := len(m.Functions)
+	gasFunc := m.AddFunction(m.AddType(FuncType{Params: []byte{ValueI64}}), chargeFunc(counter))
+	growFunc := m.AddFunction(m.AddType(FuncType{Params: []byte{ValueI32}, Results: []byte{ValueI32}}),
+		growChargeFunc(gasFunc, config.MemoryPageCost))
+
+	for i := 0; i < defined; i++ {
+		expr, err := meter(m.Codes[i].Expr, config, gasFunc, growFunc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "instrument function %d", m.ImportedFuncs()+uint32(i))
+		}
+		m.Codes[i].Expr = expr
+	}
+
+	return m.Encode(), nil
+}
+
+// meter inserts the gas charges into a function body
+func meter(expr []byte, config *Config, gasFunc, growFunc uint32) ([]byte, error) {
+	instrs, err := decodeInstructions(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// charges maps the offset in the original body to the cost charged there
+	charges := make(map[int]int64)
+	blockStart, blockCost := 0, int64(0)
+	for _, instr := range instrs {
+		cost := config.cost(instr)
+		if blockCost > math.MaxInt64-cost {
+			return nil, errors.New("block cost overflow")
+		}
+		blockCost += cost
+
+		switch instr.op {
+		case opBlock, opLoop, opIf, opElse, opEnd, opBr, opBrIf, opBrTable, opReturn, opUnreachable:
+			// the control flow may leave the straight-line code here, so the
+			// code behind is metered as a new block
+			charges[blockStart] += blockCost
+			blockStart, blockCost = instr.end, 0
+		}
+	}
+
+	out := make([]byte, 0, len(expr)+len(charges)*8)
+	for _, instr := range instrs {
+		if cost := charges[instr.start]; cost > 0 {
+			out = append(out, opI64Const)
+			out = appendSLEB(out, cost)
+			out = append(out, opCall)
+			out = appendU32(out, gasFunc)
+		}
+		if instr.op == opMemoryGrow && config.MemoryPageCost > 0 {
+			out = append(out, opCall)
+			out = appendU32(out, growFunc)
+		}
+		out = append(out, expr[instr.start:instr.end]...)
+	}
+	return out, nil
+}
+
+// chargeFunc builds the gas function (param $cost i64):
+//
+//	if (counter >= cost) counter -= cost else { counter = -1; unreachable }
+func chargeFunc(counter uint32) Code {
+	var e []byte
+	e = append(e, opGlobalGet)
+	e = appendU32(e, counter)
+	e = append(e, opLocalGet, 0, opI64GeS, opIf, blockTypeEmpty, opGlobalGet)
+	e = appendU32(e, counter)
+	e = append(e, opLocalGet, 0, opI64Sub, opGlobalSet)
+	e = appendU32(e, counter)
+	e = append(e, opElse, opI64Const, 0x7f, opGlobalSet)
+	e = appendU32(e, counter)
+	e = append(e, opUnreachable, opEnd, opEnd)
+	return Code{Expr: e}
+}
+
+// growChargeFunc builds the function charging memory.grow (param $pages i32) (result i32),
+// it returns the pages untouched so it can be called right before memory.grow.
+func growChargeFunc(gasFunc uint32, pageCost int64) Code {
+	var e []byte
+	e = append(e, opLocalGet, 0, opI64ExtendI32U, opI64Const)
+	e = appendSLEB(e, pageCost)
+	e = append(e, opI64Mul, opCall)
+	e = appendU32(e, gasFunc)
+	e = append(e, opLocalGet, 0, opEnd)
+	return Code{Expr: e}
+}
@@ -0,0 +1,68 @@
+package instrument
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentConfig(t *testing.T) {
+	raw, err := os.ReadFile("../wasmtime/testdata/runtime_test.wasm")
+	require.Equal(t, nil, err)
+
+	config := &Config{DefaultCost: 1, OpcodeCosts: map[byte]int64{opCall: 10}, MemoryPageCost: 1000, CallCost: 5}
+	instrumented, err := Instrument(raw, config)
+	require.Equal(t, nil, err)
+
+	_, err = wasmtime.NewModule(wasmtime.NewEngine(), instrumented)
+	require.Equal(t, nil, err)
+
+	m, err := DecodeModule(instrumented)
+	require.Equal(t, nil, err)
+	_, ok := m.ExportedGlobal(GasCounterExport)
+	require.True(t, ok)
+
+	_, err = Instrument(instrumented, config)
+	require.NotNil(t, err)
+
+	// the hash does not depend on the map order, but on every cost
+	same := &Config{DefaultCost: 1, OpcodeCosts: map[byte]int64{opCall: 10}, MemoryPageCost: 1000, CallCost: 5}
+	require.Equal(t, config.Hash(), same.Hash())
+	same.OpcodeCosts[opCall] = 11
+	require.NotEqual(t, config.Hash(), same.Hash())
+
+	require.NotNil(t, (&Config{DefaultCost: -1}).Validate())
+	require.NotNil(t, (&Config{OpcodeCosts: map[byte]int64{opCall: MaxCost + 1}}).Validate())
+	require.NotNil(t, (&Config{MemoryPageCost: math.MaxUint32}).Validate())
+}
+
+func TestInstrumentHugeMemoryGrow(t *testing.T) {
+	// (module (memory 1) (func (export "grow") (result i32) (memory.grow (i32.const -1))))
+	raw := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x05, 0x01, 0x60, 0x00, 0x01, 0x7f,
+		0x03, 0x02, 0x01, 0x00,
+		0x05, 0x03, 0x01, 0x00, 0x01,
+		0x07, 0x08, 0x01, 0x04, 'g', 'r', 'o', 'w', 0x00, 0x00,
+		0x0a, 0x08, 0x01, 0x06, 0x00, 0x41, 0x7f, 0x40, 0x00, 0x0b,
+	}
+
+	instrumented, err := Instrument(raw, &Config{MemoryPageCost: MaxCost})
+	require.Equal(t, nil, err)
+
+	store := wasmtime.NewStore(wasmtime.NewEngine())
+	module, err := wasmtime.NewModule(store.Engine, instrumented)
+	require.Equal(t, nil, err)
+	instance, err := wasmtime.NewInstance(store, module, nil)
+	require.Equal(t, nil, err)
+
+	// the charge of 2^32-1 pages at the highest price must not wrap into a refund
+	counter := instance.GetExport(store, GasCounterExport).Global()
+	require.Equal(t, nil, counter.Set(store, wasmtime.ValI64(math.MaxInt64/2)))
+	_, err = instance.GetFunc(store, "grow").Call(store)
+	require.NotNil(t, err)
+	require.Equal(t, int64(-1), counter.Get(store).I64())
+}
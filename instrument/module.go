@@ -0,0 +1,805 @@
+package instrument
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the version of the instrumentation passes, it must be bumped
+// whenever a pass changes its output for the same input.
+const Version = 1
+
+// section ids defined by the wasm binary format
+const (
+	SectionCustom    byte = 0
+	SectionType      byte = 1
+	SectionImport    byte = 2
+	SectionFunction  byte = 3
+	SectionTable     byte = 4
+	SectionMemory    byte = 5
+	SectionGlobal    byte = 6
+	SectionExport    byte = 7
+	SectionStart     byte = 8
+	SectionElement   byte = 9
+	SectionCode      byte = 10
+	SectionData      byte = 11
+	SectionDataCount byte = 12
+)
+
+// external kinds used in import and export entries
+const (
+	ExternFunc   byte = 0
+	ExternTable  byte = 1
+	ExternMemory byte = 2
+	ExternGlobal byte = 3
+)
+
+// value types
+const (
+	ValueI32 byte = 0x7f
+	ValueI64 byte = 0x7e
+	ValueF32 byte = 0x7d
+	ValueF64 byte = 0x7c
+)
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+// sectionOrder is the order in which known sections must appear in a module,
+// custom sections can appear anywhere and are not listed here.
+var sectionOrder = map[byte]int{
+	SectionType:      1,
+	SectionImport:    2,
+	SectionFunction:  3,
+	SectionTable:     4,
+	SectionMemory:    5,
+	SectionGlobal:    6,
+	SectionExport:    7,
+	SectionStart:     8,
+	SectionElement:   9,
+	SectionDataCount: 10,
+	SectionCode:      11,
+	SectionData:      12,
+}
+
+// Section is a raw section of a wasm module
+type Section struct {
+	ID      byte
+	Payload []byte
+}
+
+// FuncType is a function signature
+type FuncType struct {
+	Params  []byte
+	Results []byte
+}
+
+// Import is an entry of the import section, the import section is never
+// rewritten so only the function signature is kept from the descriptors.
+type Import struct {
+	Module string
+	Name   string
+	Kind   byte
+
+	// TypeIndex is the signature index of a function import
+	TypeIndex uint32
+}
+
+// Table is an entry of the table section
+type Table struct {
+	ElemType byte
+	Min      uint32
+
+	// Max is the max size of the table if HasMax is set
+	Max    uint32
+	HasMax bool
+}
+
+// Global is an entry of the global section
+type Global struct {
+	Type    byte
+	Mutable bool
+	Init    []byte // constant expression including the trailing end opcode
+}
+
+// Export is an entry of the export section
+type Export struct {
+	Name  string
+	Kind  byte
+	Index uint32
+}
+
+// Code is a function body, Locals are the compressed local declarations and
+// Expr is the instruction sequence including the trailing end opcode.
+type Code struct {
+	Locals []Local
+	Expr   []byte
+
+	// Offset is the offset of Expr in the decoded module, it is not
+	// maintained for the rewritten or added functions.
+	Offset int
+}
+
+// Local is a run of locals with the same value type
+type Local struct {
+	Count uint32
+	Type  byte
+}
+
+// Module is a decoded wasm module. Sections which are needed by the
+// instrumentation passes are decoded into their own fields, all other
+// sections are kept as is and written back untouched.
+type Module struct {
+	Sections []*Section
+
+	Types     []FuncType
+	Imports   []Import
+	Functions []uint32
+	Tables    []Table
+	Globals   []Global
+	Exports   []Export
+	Codes     []Code
+
+	// FunctionNames are the names from the name custom section, keyed by function index
+	FunctionNames map[uint32]string
+}
+
+// DecodeModule decodes a wasm binary
+func DecodeModule(code []byte) (*Module, error) {
+	if len(code) < len(wasmHeader) || !bytes.Equal(code[:len(wasmHeader)], wasmHeader) {
+		return nil, errors.New("invalid wasm header")
+	}
+
+	m := &Module{FunctionNames: make(map[uint32]string)}
+	r := newReader(code[len(wasmHeader):])
+	for !r.eof() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		offset := len(wasmHeader) + r.pos
+		payload, err := r.bytes(int(size))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read section %d", id)
+		}
+		m.Sections = append(m.Sections, &Section{ID: id, Payload: payload})
+
+		if err := m.decodeSection(id, payload, offset); err != nil {
+			return nil, errors.Wrapf(err, "decode section %d", id)
+		}
+	}
+
+	if len(m.Functions) != len(m.Codes) {
+		return nil, errors.New("function and code section size mismatch")
+	}
+
+	return m, nil
+}
+
+// decodeSection decodes a section, offset is the offset of the payload in the module
+func (m *Module) decodeSection(id byte, payload []byte, offset int) error {
+	r := newReader(payload)
+	switch id {
+	case SectionType:
+		return r.vec(func() error {
+			form, err := r.byte()
+			if err != nil {
+				return err
+			}
+			if form != 0x60 {
+				return errors.Errorf("invalid func type form 0x%x", form)
+			}
+			params, err := r.name()
+			if err != nil {
+				return err
+			}
+			results, err := r.name()
+			if err != nil {
+				return err
+			}
+			m.Types = append(m.Types, FuncType{Params: []byte(params), Results: []byte(results)})
+			return nil
+		})
+	case SectionImport:
+		return r.vec(func() error {
+			imp, err := r.importEntry()
+			if err != nil {
+				return err
+			}
+			m.Imports = append(m.Imports, imp)
+			return nil
+		})
+	case SectionFunction:
+		return r.vec(func() error {
+			typeIndex, err := r.u32()
+			m.Functions = append(m.Functions, typeIndex)
+			return err
+		})
+	case SectionTable:
+		return r.vec(func() error {
+			elemType, err := r.byte()
+			if err != nil {
+				return err
+			}
+			min, max, hasMax, err := r.limits()
+			m.Tables = append(m.Tables, Table{ElemType: elemType, Min: min, Max: max, HasMax: hasMax})
+			return err
+		})
+	case SectionGlobal:
+		return r.vec(func() error {
+			valType, err := r.byte()
+			if err != nil {
+				return err
+			}
+			mut, err := r.byte()
+			if err != nil {
+				return err
+			}
+			init, err := r.constExpr()
+			if err != nil {
+				return err
+			}
+			m.Globals = append(m.Globals, Global{Type: valType, Mutable: mut == 1, Init: init})
+			return nil
+		})
+	case SectionExport:
+		return r.vec(func() error {
+			name, err := r.name()
+			if err != nil {
+				return err
+			}
+			kind, err := r.byte()
+			if err != nil {
+				return err
+			}
+			index, err := r.u32()
+			m.Exports = append(m.Exports, Export{Name: name, Kind: kind, Index: index})
+			return err
+		})
+	case SectionCode:
+		return r.vec(func() error {
+			size, err := r.u32()
+			if err != nil {
+				return err
+			}
+			start := r.pos
+			body, err := r.bytes(int(size))
+			if err != nil {
+				return err
+			}
+			code, err := decodeCode(body)
+			code.Offset += offset + start
+			m.Codes = append(m.Codes, code)
+			return err
+		})
+	case SectionCustom:
+		name, err := r.name()
+		if err != nil {
+			return err
+		}
+		if name == "name" {
+			// a malformed name section must not fail the module
+			m.decodeNames(r)
+		}
+	}
+	return nil
+}
+
+func (m *Module) decodeNames(r *reader) {
+	for !r.eof() {
+		subID, err := r.byte()
+		if err != nil {
+			return
+		}
+		size, err := r.u32()
+		if err != nil {
+			return
+		}
+		sub, err := r.bytes(int(size))
+		if err != nil {
+			return
+		}
+		if subID != 1 {
+			continue
+		}
+
+		sr := newReader(sub)
+		_ = sr.vec(func() error {
+			index, err := sr.u32()
+			if err != nil {
+				return err
+			}
+			name, err := sr.name()
+			if err != nil {
+				return err
+			}
+			m.FunctionNames[index] = name
+			return nil
+		})
+	}
+}
+
+func decodeCode(body []byte) (Code, error) {
+	r := newReader(body)
+	code := Code{}
+	err := r.vec(func() error {
+		count, err := r.u32()
+		if err != nil {
+			return err
+		}
+		valType, err := r.byte()
+		code.Locals = append(code.Locals, Local{Count: count, Type: valType})
+		return err
+	})
+	if err != nil {
+		return code, err
+	}
+	code.Expr = body[r.pos:]
+	code.Offset = r.pos
+	return code, nil
+}
+
+// ImportedFuncs returns the number of imported functions, which is also the
+// index of the first function defined in the module.
+func (m *Module) ImportedFuncs() uint32 {
+	return m.countImports(ExternFunc)
+}
+
+// ImportedGlobals returns the number of imported globals, which is also the
+// index of the first global defined in the module.
+func (m *Module) ImportedGlobals() uint32 {
+	return m.countImports(ExternGlobal)
+}
+
+// ImportedTables returns the number of imported tables, which is also the
+// index of the first table defined in the module.
+func (m *Module) ImportedTables() uint32 {
+	return m.countImports(ExternTable)
+}
+
+func (m *Module) countImports(kind byte) uint32 {
+	count := uint32(0)
+	for _, imp := range m.Imports {
+		if imp.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+// FuncType returns the signature of the function at the given index
+func (m *Module) FuncType(index uint32) (FuncType, error) {
+	var typeIndex uint32
+	imported := m.ImportedFuncs()
+	if index < imported {
+		n := uint32(0)
+		for _, imp := range m.Imports {
+			if imp.Kind != ExternFunc {
+				continue
+			}
+			if n == index {
+				typeIndex = imp.TypeIndex
+				break
+			}
+			n++
+		}
+	} else {
+		if int(index-imported) >= len(m.Functions) {
+			return FuncType{}, errors.Errorf("function %d out of range", index)
+		}
+		typeIndex = m.Functions[index-imported]
+	}
+
+	if int(typeIndex) >= len(m.Types) {
+		return FuncType{}, errors.Errorf("type %d out of range", typeIndex)
+	}
+	return m.Types[typeIndex], nil
+}
+
+// ExportedGlobal returns the index of a global exported with the given name
+func (m *Module) ExportedGlobal(name string) (uint32, bool) {
+	for _, export := range m.Exports {
+		if export.Kind == ExternGlobal && export.Name == name {
+			return export.Index, true
+		}
+	}
+	return 0, false
+}
+
+// FunctionName returns the name of function from the name section,
+// or a generated one if the module carries no name for it.
+func (m *Module) FunctionName(index uint32) string {
+	if name, ok := m.FunctionNames[index]; ok {
+		return name
+	}
+	for _, export := range m.Exports {
+		if export.Kind == ExternFunc && export.Index == index {
+			return export.Name
+		}
+	}
+	return "func[" + strconv.FormatUint(uint64(index), 10) + "]"
+}
+
+// AddType appends a signature or returns the index of an existing identical one
+func (m *Module) AddType(t FuncType) uint32 {
+	for i, existing := range m.Types {
+		if bytes.Equal(existing.Params, t.Params) && bytes.Equal(existing.Results, t.Results) {
+			return uint32(i)
+		}
+	}
+	m.Types = append(m.Types, t)
+	return uint32(len(m.Types) - 1)
+}
+
+// AddGlobal appends a global and returns its index
+func (m *Module) AddGlobal(g Global) uint32 {
+	m.Globals = append(m.Globals, g)
+	return m.ImportedGlobals() + uint32(len(m.Globals)-1)
+}
+
+// AddFunction appends a function and returns its index
+func (m *Module) AddFunction(typeIndex uint32, code Code) uint32 {
+	m.Functions = append(m.Functions, typeIndex)
+	m.Codes = append(m.Codes, code)
+	return m.ImportedFuncs() + uint32(len(m.Functions)-1)
+}
+
+// Encode writes the module back to wasm binary, decoded sections are
+// re-encoded from their fields, other sections are copied as is.
+func (m *Module) Encode() []byte {
+	payloads := map[byte][]byte{
+		SectionType:     m.encodeTypes(),
+		SectionFunction: m.encodeFunctions(),
+		SectionTable:    m.encodeTables(),
+		SectionGlobal:   m.encodeGlobals(),
+		SectionExport:   m.encodeExports(),
+		SectionCode:     m.encodeCodes(),
+	}
+
+	// make sure all the decoded sections with content are present
+	for id, payload := range payloads {
+		if payload != nil && m.section(id) == nil {
+			m.insertSection(&Section{ID: id})
+		}
+	}
+
+	out := append([]byte{}, wasmHeader...)
+	for _, section := range m.Sections {
+		payload := section.Payload
+		if encoded, ok := payloads[section.ID]; ok && section.ID != SectionCustom {
+			payload = encoded
+		}
+		out = append(out, section.ID)
+		out = appendU32(out, uint32(len(payload)))
+		out = append(out, payload...)
+	}
+	return out
+}
+
+func (m *Module) section(id byte) *Section {
+	for _, section := range m.Sections {
+		if section.ID == id {
+			return section
+		}
+	}
+	return nil
+}
+
+func (m *Module) insertSection(section *Section) {
+	order := sectionOrder[section.ID]
+	for i, existing := range m.Sections {
+		if existing.ID != SectionCustom && sectionOrder[existing.ID] > order {
+			m.Sections = append(m.Sections[:i], append([]*Section{section}, m.Sections[i:]...)...)
+			return
+		}
+	}
+	m.Sections = append(m.Sections, section)
+}
+
+func (m *Module) encodeTypes() []byte {
+	if len(m.Types) == 0 {
+		return nil
+	}
+	out := appendU32(nil, uint32(len(m.Types)))
+	for _, t := range m.Types {
+		out = append(out, 0x60)
+		out = appendU32(out, uint32(len(t.Params)))
+		out = append(out, t.Params...)
+		out = appendU32(out, uint32(len(t.Results)))
+		out = append(out, t.Results...)
+	}
+	return out
+}
+
+func (m *Module) encodeFunctions() []byte {
+	if len(m.Functions) == 0 {
+		return nil
+	}
+	out := appendU32(nil, uint32(len(m.Functions)))
+	for _, typeIndex := range m.Functions {
+		out = appendU32(out, typeIndex)
+	}
+	return out
+}
+
+func (m *Module) encodeTables() []byte {
+	if len(m.Tables) == 0 {
+		return nil
+	}
+	out := appendU32(nil, uint32(len(m.Tables)))
+	for _, t := range m.Tables {
+		out = append(out, t.ElemType)
+		if t.HasMax {
+			out = append(out, 0x01)
+			out = appendU32(out, t.Min)
+			out = appendU32(out, t.Max)
+		} else {
+			out = append(out, 0x00)
+			out = appendU32(out, t.Min)
+		}
+	}
+	return out
+}
+
+func (m *Module) encodeGlobals() []byte {
+	if len(m.Globals) == 0 {
+		return nil
+	}
+	out := appendU32(nil, uint32(len(m.Globals)))
+	for _, g := range m.Globals {
+		mut := byte(0)
+		if g.Mutable {
+			mut = 1
+		}
+		out = append(out, g.Type, mut)
+		out = append(out, g.Init...)
+	}
+	return out
+}
+
+func (m *Module) encodeExports() []byte {
+	if len(m.Exports) == 0 {
+		return nil
+	}
+	out := appendU32(nil, uint32(len(m.Exports)))
+	for _, export := range m.Exports {
+		out = appendName(out, export.Name)
+		out = append(out, export.Kind)
+		out = appendU32(out, export.Index)
+	}
+	return out
+}
+
+func (m *Module) encodeCodes() []byte {
+	if len(m.Codes) == 0 {
+		return nil
+	}
+	out := appendU32(nil, uint32(len(m.Codes)))
+	for _, code := range m.Codes {
+		body := appendU32(nil, uint32(len(code.Locals)))
+		for _, local := range code.Locals {
+			body = appendU32(body, local.Count)
+			body = append(body, local.Type)
+		}
+		body = append(body, code.Expr...)
+
+		out = appendU32(out, uint32(len(body)))
+		out = append(out, body...)
+	}
+	return out
+}
+
+// reader decodes the primitive encodings of the wasm binary format
+type reader struct {
+	buf []byte
+	pos int
+}
+
+func newReader(buf []byte) *reader {
+	return &reader{buf: buf}
+}
+
+func (r *reader) eof() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.eof() {
+		return 0, errors.New("unexpected end of input")
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.buf) {
+		return nil, errors.New("unexpected end of input")
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) u32() (uint32, error) {
+	v, err := r.uleb(32)
+	return uint32(v), err
+}
+
+func (r *reader) uleb(bits uint) (uint64, error) {
+	var result uint64
+	var shift uint
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		result |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return result, nil
+		}
+		shift += 7
+		if shift >= bits+7 {
+			return 0, errors.New("integer representation too long")
+		}
+	}
+}
+
+func (r *reader) sleb(bits uint) (int64, error) {
+	var result int64
+	var shift uint
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		result |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				result |= -1 << shift
+			}
+			return result, nil
+		}
+		if shift >= bits+7 {
+			return 0, errors.New("integer representation too long")
+		}
+	}
+}
+
+func (r *reader) name() (string, error) {
+	size, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.bytes(int(size))
+	return string(b), err
+}
+
+func (r *reader) vec(item func() error) error {
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		if err := item(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limits reads the limits of a table or a memory, max is only read if hasMax is set
+func (r *reader) limits() (min, max uint32, hasMax bool, err error) {
+	flag, err := r.byte()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if min, err = r.u32(); err != nil {
+		return 0, 0, false, err
+	}
+	if flag&0x01 != 0 {
+		max, err = r.u32()
+		hasMax = true
+	}
+	return min, max, hasMax, err
+}
+
+func (r *reader) importEntry() (Import, error) {
+	imp := Import{}
+	var err error
+	if imp.Module, err = r.name(); err != nil {
+		return imp, err
+	}
+	if imp.Name, err = r.name(); err != nil {
+		return imp, err
+	}
+	if imp.Kind, err = r.byte(); err != nil {
+		return imp, err
+	}
+
+	switch imp.Kind {
+	case ExternFunc:
+		imp.TypeIndex, err = r.u32()
+	case ExternTable:
+		if _, err = r.byte(); err == nil {
+			_, _, _, err = r.limits()
+		}
+	case ExternMemory:
+		_, _, _, err = r.limits()
+	case ExternGlobal:
+		_, err = r.bytes(2)
+	default:
+		err = errors.Errorf("invalid import kind 0x%x", imp.Kind)
+	}
+	return imp, err
+}
+
+// constExpr reads a constant expression including its end opcode
+func (r *reader) constExpr() ([]byte, error) {
+	start := r.pos
+	for {
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opEnd:
+			return r.buf[start:r.pos], nil
+		case opI32Const:
+			_, err = r.sleb(32)
+		case opI64Const:
+			_, err = r.sleb(64)
+		case opF32Const:
+			_, err = r.bytes(4)
+		case opF64Const:
+			_, err = r.bytes(8)
+		case opGlobalGet, opRefFunc:
+			_, err = r.u32()
+		case opRefNull:
+			_, err = r.byte()
+		default:
+			return nil, errors.Errorf("unsupported opcode 0x%x in constant expression", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func appendU32(out []byte, v uint32) []byte {
+	return appendULEB(out, uint64(v))
+}
+
+func appendULEB(out []byte, v uint64) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		return append(out, b)
+	}
+}
+
+func appendSLEB(out []byte, v int64) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func appendName(out []byte, name string) []byte {
+	out = appendU32(out, uint32(len(name)))
+	return append(out, name...)
+}
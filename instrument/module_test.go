@@ -0,0 +1,52 @@
+package instrument
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleRoundTrip(t *testing.T) {
+	raw, err := os.ReadFile("../wasmtime/testdata/runtime_test.wasm")
+	require.Equal(t, nil, err)
+
+	m, err := DecodeModule(raw)
+	require.Equal(t, nil, err)
+	require.Equal(t, raw, m.Encode())
+
+	require.Equal(t, uint32(4), m.ImportedFuncs())
+	require.Equal(t, "runtime_test/greet", m.FunctionName(14))
+	require.Equal(t, "func[100]", m.FunctionName(100))
+
+	for _, code := range m.Codes {
+		_, err := decodeInstructions(code.Expr)
+		require.Equal(t, nil, err)
+	}
+}
+
+func TestDecodeUnsupportedOpcodes(t *testing.T) {
+	// try, throw, return_call, call_ref, the gap after the sign extension ops,
+	// ref.as_non_null and the simd prefix
+	for _, op := range []byte{0x06, 0x08, 0x0a, 0x12, 0x13, 0x14, 0x27, 0xc5, 0xd3, 0xfd} {
+		_, err := decodeInstructions([]byte{op, 0x00, opEnd})
+		require.ErrorContains(t, err, "unsupported opcode", "0x%x", op)
+	}
+
+	// the ops without immediates are still accepted
+	instrs, err := decodeInstructions([]byte{opNop, opI32Const, 0x01, opDrop, opI32Const, 0x00, opI32Eqz, opDrop, opEnd})
+	require.Equal(t, nil, err)
+	require.Len(t, instrs, 7)
+}
+
+func TestModuleTables(t *testing.T) {
+	m := &Module{}
+	m.Tables = append(m.Tables, Table{ElemType: 0x70, Min: 1}, Table{ElemType: 0x70, Min: 2, Max: 300, HasMax: true})
+	code := m.Encode()
+
+	decoded, err := DecodeModule(code)
+	require.Equal(t, nil, err)
+	require.Equal(t, m.Tables, decoded.Tables)
+	require.Equal(t, uint32(0), decoded.ImportedTables())
+	require.Equal(t, code, decoded.Encode())
+}
@@ -0,0 +1,195 @@
+package instrument
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// OffsetMap maps the offsets of the instructions in an instrumented module
+// back to the offsets in the original module, e.g. to resolve the offsets of
+// a trap with the source map of the original module. The instrumentation
+// inserts known patterns into the function bodies and appends new functions,
+// so the original instructions of a body are found in the same order in the
+// instrumented body once the patterns are skipped. The bodies are aligned on
+// the first lookup of each function.
+type OffsetMap struct {
+	original     *Module
+	instrumented *Module
+
+	mu    sync.Mutex
+	funcs map[uint32][]alignedInstr
+}
+
+// alignedInstr is an instruction of an instrumented body, original is the
+// module offset of the same instruction in the original body, or -1 if the
+// instruction is inserted by the instrumentation.
+type alignedInstr struct {
+	start    int
+	end      int
+	original int
+}
+
+// NewOffsetMap creates the offset map of the original and the instrumented code
+func NewOffsetMap(original, instrumented []byte) (*OffsetMap, error) {
+	origModule, err := DecodeModule(original)
+	if err != nil {
+		return nil, err
+	}
+	instrModule, err := DecodeModule(instrumented)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OffsetMap{
+		original:     origModule,
+		instrumented: instrModule,
+		funcs:        make(map[uint32][]alignedInstr),
+	}, nil
+}
+
+// Original returns the offset in the original module of the instruction at the
+// offset of the given function in the instrumented module. The inserted
+// instructions are mapped to the next original instruction of the body, which
+// is the instruction they are inserted for.
+func (m *OffsetMap) Original(funcIndex uint32, offset uint) (uint, bool) {
+	instrs := m.align(funcIndex)
+
+	i := sort.Search(len(instrs), func(i int) bool {
+		return instrs[i].end > int(offset)
+	})
+	if i == len(instrs) || instrs[i].start > int(offset) {
+		return 0, false
+	}
+
+	for ; i < len(instrs); i++ {
+		if instrs[i].original >= 0 {
+			return uint(instrs[i].original), true
+		}
+	}
+	return 0, false
+}
+
+// align matches the instructions of the instrumented body of a function with
+// the instructions of the original body
+func (m *OffsetMap) align(funcIndex uint32) []alignedInstr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if instrs, ok := m.funcs[funcIndex]; ok {
+		return instrs
+	}
+
+	instrs := m.alignBodies(funcIndex)
+	m.funcs[funcIndex] = instrs
+	return instrs
+}
+
+func (m *OffsetMap) alignBodies(funcIndex uint32) []alignedInstr {
+	imported := m.original.ImportedFuncs()
+	if funcIndex < imported || m.instrumented.ImportedFuncs() != imported {
+		return nil
+	}
+	defined := int(funcIndex - imported)
+	if defined >= len(m.original.Codes) || defined >= len(m.instrumented.Codes) {
+		// the function is added by the instrumentation
+		return nil
+	}
+
+	origCode, instrCode := m.original.Codes[defined], m.instrumented.Codes[defined]
+	origInstrs, err := decodeInstructions(origCode.Expr)
+	if err != nil {
+		return nil
+	}
+	instrInstrs, err := decodeInstructions(instrCode.Expr)
+	if err != nil {
+		return nil
+	}
+
+	aligned := make([]alignedInstr, len(instrInstrs))
+	for i, instr := range instrInstrs {
+		aligned[i] = alignedInstr{
+			start:    instrCode.Offset + instr.start,
+			end:      instrCode.Offset + instr.end,
+			original: -1,
+		}
+	}
+
+	next := 0
+	for i := 0; i < len(instrInstrs) && next < len(origInstrs); {
+		orig := origInstrs[next]
+		if n := m.inserted(instrInstrs[i:]); n > 0 {
+			// the built-in instrumentation replaces memory.grow with the call
+			// of its charging function instead of inserting the call before
+			if n == 1 && orig.op == opMemoryGrow && (i+1 == len(instrInstrs) || instrInstrs[i+1].op != opMemoryGrow) {
+				aligned[i].original = origCode.Offset + orig.start
+				next++
+			}
+			i += n
+			continue
+		}
+
+		if bytes.Equal(instrCode.Expr[instrInstrs[i].start:instrInstrs[i].end], origCode.Expr[orig.start:orig.end]) {
+			aligned[i].original = origCode.Offset + orig.start
+			next++
+		}
+		i++
+	}
+	return aligned
+}
+
+// patternOp is an instruction of an inserted pattern, added instructions use
+// a function or a global added by the instrumentation
+type patternOp struct {
+	op    byte
+	added bool
+}
+
+// insertedPatterns are the instruction sequences inserted into the bodies by
+// the passes and by the built-in instrumentation, longer patterns go first.
+// Each pattern uses an added function or global, so it can not be an original
+// instruction sequence even if some of its instructions are.
+var insertedPatterns = [][]patternOp{
+	// the stack height check of LimitStack and the block of the body
+	{
+		{opGlobalGet, true}, {op: opI32Const}, {op: opI32Add}, {opGlobalSet, true},
+		{opGlobalGet, true}, {op: opI32Const}, {op: opI32GtU},
+		{op: opIf}, {op: opUnreachable}, {op: opEnd}, {op: opBlock},
+	},
+	// the stack height release of LimitStack
+	{{opGlobalGet, true}, {op: opI32Const}, {op: opI32Sub}, {opGlobalSet, true}},
+	// the gas charge of a block
+	{{op: opI64Const}, {opCall, true}},
+	// the gas charge of memory.grow
+	{{opCall, true}},
+}
+
+// inserted returns the number of instructions of the inserted pattern at the
+// start of instrs, or 0 if they do not start with a pattern
+func (m *OffsetMap) inserted(instrs []instruction) int {
+	funcs := m.original.ImportedFuncs() + uint32(len(m.original.Functions))
+	globals := m.original.ImportedGlobals() + uint32(len(m.original.Globals))
+
+	for _, pattern := range insertedPatterns {
+		if len(instrs) < len(pattern) {
+			continue
+		}
+
+		matched := true
+		for i, p := range pattern {
+			instr := instrs[i]
+			if instr.op != p.op {
+				matched = false
+				break
+			}
+			if p.added && (instr.op == opCall && instr.index < funcs || instr.op != opCall && instr.index < globals) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return len(pattern)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+package instrument
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetMap(t *testing.T) {
+	original := recursiveModule()
+	code, err := Instrument(original, &Config{DefaultCost: 1})
+	require.Equal(t, nil, err)
+	code, err = LimitStack(code, 100)
+	require.Equal(t, nil, err)
+
+	offsets, err := NewOffsetMap(original, code)
+	require.Equal(t, nil, err)
+
+	origModule, err := DecodeModule(original)
+	require.Equal(t, nil, err)
+	instrModule, err := DecodeModule(code)
+	require.Equal(t, nil, err)
+
+	// offsets of the instruction with the opcode in the body of the function
+	find := func(c Code, op byte) []int {
+		instrs, err := decodeInstructions(c.Expr)
+		require.Equal(t, nil, err)
+		var found []int
+		for _, instr := range instrs {
+			if instr.op == op {
+				found = append(found, c.Offset+instr.start)
+			}
+		}
+		return found
+	}
+
+	origCode, instrCode := origModule.Codes[0], instrModule.Codes[0]
+	for _, op := range []byte{opCall, opReturn} {
+		origOffsets, instrOffsets := find(origCode, op), find(instrCode, op)
+		require.Equal(t, 1, len(origOffsets))
+
+		// the gas charges are calls inserted before the original call
+		offset, ok := offsets.Original(0, uint(instrOffsets[len(instrOffsets)-1]))
+		require.True(t, ok)
+		require.Equal(t, uint(origOffsets[0]), offset)
+	}
+
+	// the inserted prologue is mapped to the first instruction of the body
+	offset, ok := offsets.Original(0, uint(instrCode.Offset))
+	require.True(t, ok)
+	require.Equal(t, uint(origCode.Offset), offset)
+
+	// the functions added by the instrumentation are not mapped
+	_, ok = offsets.Original(1, uint(instrModule.Codes[1].Offset))
+	require.False(t, ok)
+}
+
+func TestOffsetMapInsertedDuplicates(t *testing.T) {
+	// the body starts with the block opened by the stack limit, and the
+	// constant has the bytes of the gas charged in front of it
+	m := &Module{}
+	typeIndex := m.AddType(FuncType{})
+	body := []byte{opBlock, blockTypeEmpty, opI64Const, 3, 0x1a /* drop */, opEnd, opEnd}
+	m.AddFunction(typeIndex, Code{Expr: body})
+	original := m.Encode()
+
+	code, err := Instrument(original, &Config{DefaultCost: 1})
+	require.Equal(t, nil, err)
+	code, err = LimitStack(code, 100)
+	require.Equal(t, nil, err)
+
+	offsets, err := NewOffsetMap(original, code)
+	require.Equal(t, nil, err)
+	origModule, err := DecodeModule(original)
+	require.Equal(t, nil, err)
+	instrModule, err := DecodeModule(code)
+	require.Equal(t, nil, err)
+
+	origCode, instrCode := origModule.Codes[0], instrModule.Codes[0]
+	origInstrs, err := decodeInstructions(origCode.Expr)
+	require.Equal(t, nil, err)
+	instrInstrs, err := decodeInstructions(instrCode.Expr)
+	require.Equal(t, nil, err)
+
+	// offsets of the instructions with the bytes of the original instruction
+	matching := func(orig instruction) []int {
+		var found []int
+		for _, instr := range instrInstrs {
+			if bytes.Equal(instrCode.Expr[instr.start:instr.end], origCode.Expr[orig.start:orig.end]) {
+				found = append(found, instrCode.Offset+instr.start)
+			}
+		}
+		return found
+	}
+
+	// the block of the stack limit and the gas charge go before the originals
+	for _, orig := range origInstrs[:2] {
+		found := matching(orig)
+		require.Equal(t, 2, len(found))
+		offset, ok := offsets.Original(0, uint(found[1]))
+		require.True(t, ok)
+		require.Equal(t, uint(origCode.Offset+orig.start), offset)
+	}
+}
+
+func TestOffsetMapBuiltinMemoryGrow(t *testing.T) {
+	// (module (memory 1) (func (export "grow") (result i32) (memory.grow (i32.const 1))))
+	original := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x05, 0x01, 0x60, 0x00, 0x01, 0x7f,
+		0x03, 0x02, 0x01, 0x00,
+		0x05, 0x03, 0x01, 0x00, 0x01,
+		0x07, 0x08, 0x01, 0x04, 'g', 'r', 'o', 'w', 0x00, 0x00,
+		0x0a, 0x08, 0x01, 0x06, 0x00, 0x41, 0x01, 0x40, 0x00, 0x0b,
+	}
+	code, err := wasmtime.Instrument(original)
+	require.Equal(t, nil, err)
+
+	offsets, err := NewOffsetMap(original, code)
+	require.Equal(t, nil, err)
+	instrModule, err := DecodeModule(code)
+	require.Equal(t, nil, err)
+
+	// memory.grow is replaced by the call of the charging function
+	instrCode := instrModule.Codes[0]
+	instrs, err := decodeInstructions(instrCode.Expr)
+	require.Equal(t, nil, err)
+	grow := -1
+	for _, instr := range instrs {
+		require.NotEqual(t, opMemoryGrow, instr.op)
+		if instr.op == opCall {
+			grow = instrCode.Offset + instr.start
+		}
+	}
+
+	offset, ok := offsets.Original(0, uint(grow))
+	require.True(t, ok)
+	require.Equal(t, uint(len(original)-3), offset)
+}
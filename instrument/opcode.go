@@ -0,0 +1,173 @@
+package instrument
+
+import (
+	"github.com/pkg/errors"
+)
+
+// opcodes used by the instrumentation passes
+const (
+	opUnreachable   byte = 0x00
+	opNop           byte = 0x01
+	opBlock         byte = 0x02
+	opLoop          byte = 0x03
+	opIf            byte = 0x04
+	opElse          byte = 0x05
+	opEnd           byte = 0x0b
+	opBr            byte = 0x0c
+	opBrIf          byte = 0x0d
+	opBrTable       byte = 0x0e
+	opReturn        byte = 0x0f
+	opCall          byte = 0x10
+	opCallIndirect  byte = 0x11
+	opDrop          byte = 0x1a
+	opSelect        byte = 0x1b
+	opSelectT       byte = 0x1c
+	opLocalGet      byte = 0x20
+	opLocalSet      byte = 0x21
+	opLocalTee      byte = 0x22
+	opGlobalGet     byte = 0x23
+	opGlobalSet     byte = 0x24
+	opTableGet      byte = 0x25
+	opTableSet      byte = 0x26
+	opI32Load       byte = 0x28
+	opI64Store32    byte = 0x3e
+	opMemorySize    byte = 0x3f
+	opMemoryGrow    byte = 0x40
+	opI32Const      byte = 0x41
+	opI64Const      byte = 0x42
+	opF32Const      byte = 0x43
+	opF64Const      byte = 0x44
+	opI32Eqz        byte = 0x45
+	opI32GtU        byte = 0x4b
+	opI64GeS        byte = 0x59
+	opI32Add        byte = 0x6a
+	opI32Sub        byte = 0x6b
+	opI64Add        byte = 0x7c
+	opI64Sub        byte = 0x7d
+	opI64Mul        byte = 0x7e
+	opI64ExtendI32U byte = 0xad
+	opI64Extend32S  byte = 0xc4
+	opRefNull       byte = 0xd0
+	opRefIsNull     byte = 0xd1
+	opRefFunc       byte = 0xd2
+	opPrefixFC      byte = 0xfc
+
+	blockTypeEmpty byte = 0x40
+)
+
+// instruction is a decoded instruction of a function body
+type instruction struct {
+	op  byte
+	sub uint32 // sub opcode of the 0xfc prefixed instructions
+
+	// start and end are the offsets of the instruction in the function body
+	start int
+	end   int
+
+	// index is the first index immediate, e.g. the function index of a call,
+	// the global index of global.get or the label depth of br
+	index uint32
+
+	// blockType is the block type of block, loop and if, negative values are
+	// the empty type or a single value type, the others are type indices
+	blockType int64
+}
+
+// decodeInstructions decodes all the instructions in a function body
+func decodeInstructions(expr []byte) ([]instruction, error) {
+	r := newReader(expr)
+	var instrs []instruction
+	for !r.eof() {
+		instr := instruction{start: r.pos}
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		instr.op = op
+
+		if err := r.immediates(&instr); err != nil {
+			return nil, errors.Wrapf(err, "decode instruction 0x%x at %d", op, instr.start)
+		}
+		instr.end = r.pos
+		instrs = append(instrs, instr)
+	}
+	return instrs, nil
+}
+
+func (r *reader) immediates(instr *instruction) (err error) {
+	op := instr.op
+	switch {
+	case op == opBlock || op == opLoop || op == opIf:
+		instr.blockType, err = r.sleb(33)
+	case op == opBr || op == opBrIf || op == opCall || op == opRefFunc ||
+		op == opTableGet || op == opTableSet || (op >= opLocalGet && op <= opGlobalSet):
+		instr.index, err = r.u32()
+	case op == opBrTable:
+		err = r.vec(func() error {
+			_, err := r.u32()
+			return err
+		})
+		if err == nil {
+			instr.index, err = r.u32()
+		}
+	case op == opCallIndirect:
+		if instr.index, err = r.u32(); err == nil {
+			_, err = r.u32()
+		}
+	case op == opSelectT:
+		err = r.vec(func() error {
+			_, err := r.byte()
+			return err
+		})
+	case op >= opI32Load && op <= opI64Store32:
+		if _, err = r.u32(); err == nil {
+			_, err = r.u32()
+		}
+	case op == opMemorySize || op == opMemoryGrow || op == opRefNull:
+		_, err = r.byte()
+	case op == opI32Const:
+		_, err = r.sleb(32)
+	case op == opI64Const:
+		_, err = r.sleb(64)
+	case op == opF32Const:
+		_, err = r.bytes(4)
+	case op == opF64Const:
+		_, err = r.bytes(8)
+	case op == opPrefixFC:
+		if instr.sub, err = r.u32(); err != nil {
+			return err
+		}
+		err = r.prefixedImmediates(instr)
+	case op == opUnreachable || op == opNop || op == opElse || op == opEnd || op == opReturn ||
+		op == opDrop || op == opSelect || op == opRefIsNull || (op >= opI32Eqz && op <= opI64Extend32S):
+		// no immediates
+	default:
+		// the proposals which are not enabled, e.g. exceptions, tail calls and
+		// simd, the immediates cannot be skipped
+		err = errors.New("unsupported opcode")
+	}
+	return err
+}
+
+func (r *reader) prefixedImmediates(instr *instruction) (err error) {
+	switch instr.sub {
+	case 0, 1, 2, 3, 4, 5, 6, 7: // saturating truncation
+	case 8: // memory.init
+		if instr.index, err = r.u32(); err == nil {
+			_, err = r.byte()
+		}
+	case 9, 13, 15, 16, 17: // data.drop, elem.drop, table.grow, table.size, table.fill
+		instr.index, err = r.u32()
+	case 10: // memory.copy
+		_, err = r.bytes(2)
+	case 11: // memory.fill
+		_, err = r.byte()
+	case 12, 14: // table.init, table.copy
+		if instr.index, err = r.u32(); err == nil {
+			_, err = r.u32()
+		}
+	default:
+		err = errors.New("unsupported opcode")
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package instrument
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// GasCounterExport is the name of the gas counter global exported by the gas instrumentation
+	GasCounterExport = "__gas_counter__"
+
+	// ProfileChildExport is the name of the global accumulating the gas used by
+	// the callees of the current frame, host apis add their own cost to it so
+	// that it is not attributed to the calling wasm function.
+	ProfileChildExport = "__profile_child__"
+)
+
+// ProfiledFunction describes the counters injected for a function by InjectProfiler,
+// the counters are i64 globals exported with the given names.
+type ProfiledFunction struct {
+	Index uint32
+	Name  string
+
+	SelfExport  string
+	TotalExport string
+	CallsExport string
+}
+
+// InjectProfiler rewrites a gas instrumented module so that each function
+// records the gas it consumed. The body of every function is moved to a new
+// function and replaced with a wrapper which samples the gas counter before and
+// after calling it, so call sites, exports and tables keep pointing to the
+// same index. The injected code itself is not metered, so profiling does not
+// change the gas usage of the module.
+func InjectProfiler(code []byte) ([]byte, []ProfiledFunction, error) {
+	m, err := DecodeModule(code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gasCounter, ok := m.ExportedGlobal(GasCounterExport)
+	if !ok {
+		return nil, nil, errors.New("gas counter not exported, module is not instrumented")
+	}
+
+	newCounter := func() uint32 {
+		return m.AddGlobal(Global{Type: ValueI64, Mutable: true, Init: []byte{opI64Const, 0, opEnd}})
+	}
+	child := newCounter()
+	m.Exports = append(m.Exports, Export{Name: ProfileChildExport, Kind: ExternGlobal, Index: child})
+
+	imported := m.ImportedFuncs()
+	defined := len(m.Functions)
+	functions := make([]ProfiledFunction, 0, defined)
+	for i := 0; i < defined; i++ {
+		index := imported + uint32(i)
+		charger, err := isGasCharger(m.Codes[i], gasCounter)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "decode function %d", index)
+		}
+		if charger {
+			// the cost charged by the gas function belongs to its callers
+			continue
+		}
+
+		fn := ProfiledFunction{
+			Index:       index,
+			Name:        m.FunctionName(index),
+			SelfExport:  fmt.Sprintf("__profile_self_%d__", index),
+			TotalExport: fmt.Sprintf("__profile_total_%d__", index),
+			CallsExport: fmt.Sprintf("__profile_calls_%d__", index),
+		}
+		self, total, calls := newCounter(), newCounter(), newCounter()
+		m.Exports = append(m.Exports,
+			Export{Name: fn.SelfExport, Kind: ExternGlobal, Index: self},
+			Export{Name: fn.TotalExport, Kind: ExternGlobal, Index: total},
+			Export{Name: fn.CallsExport, Kind: ExternGlobal, Index: calls},
+		)
+
+		typeIndex := m.Functions[i]
+		body := m.AddFunction(typeIndex, m.Codes[i])
+		params := uint32(len(m.Types[typeIndex].Params))
+		m.Codes[i] = profileWrapper(params, body, gasCounter, child, self, total, calls)
+
+		functions = append(functions, fn)
+	}
+
+	return m.Encode(), functions, nil
+}
+
+// isGasCharger checks whether a function is the gas charging function
+// injected by the gas instrumentation, which is the only one writing the counter.
+func isGasCharger(code Code, gasCounter uint32) (bool, error) {
+	instrs, err := decodeInstructions(code.Expr)
+	if err != nil {
+		return false, err
+	}
+	for _, instr := range instrs {
+		if instr.op == opGlobalSet && instr.index == gasCounter {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// profileWrapper builds the body replacing a profiled function:
+//
+//	saved = child; child = 0; start = gas
+//	call body with all params
+//	total = start - gas
+//	self += total - child; total_counter += total; calls += 1
+//	child = saved + total
+func profileWrapper(params, body, gas, child, self, total, calls uint32) Code {
+	savedLocal, startLocal, totalLocal := params, params+1, params+2
+
+	var e []byte
+	e = append(e, opGlobalGet)
+	e = appendU32(e, child)
+	e = append(e, opLocalSet)
+	e = appendU32(e, savedLocal)
+	e = append(e, opI64Const, 0, opGlobalSet)
+	e = appendU32(e, child)
+	e = append(e, opGlobalGet)
+	e = appendU32(e, gas)
+	e = append(e, opLocalSet)
+	e = appendU32(e, startLocal)
+
+	for i := uint32(0); i < params; i++ {
+		e = append(e, opLocalGet)
+		e = appendU32(e, i)
+	}
+	e = append(e, opCall)
+	e = appendU32(e, body)
+
+	// results of the call stay on the stack below the bookkeeping
+	e = append(e, opLocalGet)
+	e = appendU32(e, startLocal)
+	e = append(e, opGlobalGet)
+	e = appendU32(e, gas)
+	e = append(e, opI64Sub, opLocalSet)
+	e = appendU32(e, totalLocal)
+
+	e = append(e, opGlobalGet)
+	e = appendU32(e, self)
+	e = append(e, opLocalGet)
+	e = appendU32(e, totalLocal)
+	e = append(e, opGlobalGet)
+	e = appendU32(e, child)
+	e = append(e, opI64Sub, opI64Add, opGlobalSet)
+	e = appendU32(e, self)
+
+	e = append(e, opGlobalGet)
+	e = appendU32(e, total)
+	e = append(e, opLocalGet)
+	e = appendU32(e, totalLocal)
+	e = append(e, opI64Add, opGlobalSet)
+	e = appendU32(e, total)
+
+	e = append(e, opGlobalGet)
+	e = appendU32(e, calls)
+	e = append(e, opI64Const, 1, opI64Add, opGlobalSet)
+	e = appendU32(e, calls)
+
+	e = append(e, opLocalGet)
+	e = appendU32(e, savedLocal)
+	e = append(e, opLocalGet)
+	e = appendU32(e, totalLocal)
+	e = append(e, opI64Add, opGlobalSet)
+	e = appendU32(e, child)
+
+	e = append(e, opEnd)
+
+	return Code{
+		Locals: []Local{{Count: 3, Type: ValueI64}},
+		Expr:   e,
+	}
+}
@@ -0,0 +1,41 @@
+package instrument
+
+import (
+	"fmt"
+)
+
+// GlobalExportPrefix prefixes the names of the globals exported by ExportGlobals
+const GlobalExportPrefix = "__global_"
+
+// ExportGlobals exports all the mutable globals defined in the code which are
+// not exported yet, so that the whole state of an instance can be saved and
+// restored from the host. The globals are exported as "__global_N__", where N
+// is the global index.
+func ExportGlobals(code []byte) ([]byte, error) {
+	m, err := DecodeModule(code)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make(map[uint32]bool)
+	for _, export := range m.Exports {
+		if export.Kind == ExternGlobal {
+			exported[export.Index] = true
+		}
+	}
+
+	imported := m.ImportedGlobals()
+	for i, global := range m.Globals {
+		index := imported + uint32(i)
+		if !global.Mutable || exported[index] {
+			continue
+		}
+		m.Exports = append(m.Exports, Export{
+			Name:  fmt.Sprintf("%s%d__", GlobalExportPrefix, index),
+			Kind:  ExternGlobal,
+			Index: index,
+		})
+	}
+
+	return m.Encode(), nil
+}
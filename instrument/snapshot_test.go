@@ -0,0 +1,31 @@
+package instrument
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportGlobals(t *testing.T) {
+	raw, err := os.ReadFile("../wasmtime/testdata/runtime_test.wasm")
+	require.Equal(t, nil, err)
+
+	code, err := ExportGlobals(raw)
+	require.Equal(t, nil, err)
+
+	m, err := DecodeModule(code)
+	require.Equal(t, nil, err)
+
+	exported := make(map[uint32]bool)
+	for _, export := range m.Exports {
+		if export.Kind == ExternGlobal {
+			exported[export.Index] = true
+		}
+	}
+	for i, global := range m.Globals {
+		if global.Mutable {
+			require.True(t, exported[m.ImportedGlobals()+uint32(i)])
+		}
+	}
+}
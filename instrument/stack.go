@@ -0,0 +1,287 @@
+package instrument
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// StackHeightExport is the name of the stack height global exported by LimitStack
+	StackHeightExport = "__stack_height__"
+
+	// DefaultMaxStackHeight is a limit of the stack height which fits the
+	// default max wasm stack of the runtimes, see types.StackBytesPerHeight.
+	// The runtimes only limit the stack height if it is set.
+	DefaultMaxStackHeight = 4 * 1024
+)
+
+// LimitStack injects a deterministic stack height limit into the code. Each
+// function adds the height of its frame, which is one plus the number of its
+// params and locals and the max height of its operand stack, to an i32 global
+// exported as "__stack_height__" on entry, and subtracts it on exit. When the height exceeds maxHeight, the execution
+// traps and the counter is left above the limit, so the trap can be told apart
+// from the others. The counter must be reset to 0 before each call.
+//
+// The gas charging function of the gas instrumentation is left untouched, it
+// is a leaf function called on every block.
+func LimitStack(code []byte, maxHeight uint32) ([]byte, error) {
+	if maxHeight == 0 || maxHeight > math.MaxInt32 {
+		return nil, errors.Errorf("invalid max stack height %d", maxHeight)
+	}
+
+	m, err := DecodeModule(code)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := m.ExportedGlobal(StackHeightExport); ok {
+		return nil, errors.New("module is already stack limited")
+	}
+	gasCounter, metered := m.ExportedGlobal(GasCounterExport)
+
+	height := m.AddGlobal(Global{Type: ValueI32, Mutable: true, Init: []byte{opI32Const, 0, opEnd}})
+	m.Exports = append(m.Exports, Export{Name: StackHeightExport, Kind: ExternGlobal, Index: height})
+
+	imported := m.ImportedFuncs()
+	for i := range m.Codes {
+		if metered {
+			charger, err := isGasCharger(m.Codes[i], gasCounter)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode function %d", imported+uint32(i))
+			}
+			if charger {
+				continue
+			}
+		}
+
+		fnType := m.Types[m.Functions[i]]
+		depth, err := operandDepth(m, m.Codes[i].Expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode function %d", imported+uint32(i))
+		}
+		frame := 1 + uint64(len(fnType.Params)) + uint64(depth)
+		for _, local := range m.Codes[i].Locals {
+			frame += uint64(local.Count)
+		}
+		if frame > uint64(maxHeight) {
+			// the function can never be called, make sure it still traps
+			frame = uint64(maxHeight) + 1
+		}
+
+		var blockType []byte
+		switch len(fnType.Results) {
+		case 0:
+			blockType = []byte{blockTypeEmpty}
+		case 1:
+			blockType = []byte{fnType.Results[0]}
+		default:
+			blockType = appendSLEB(nil, int64(m.AddType(FuncType{Results: fnType.Results})))
+		}
+
+		expr, err := limitFrame(m.Codes[i].Expr, height, uint32(frame), maxHeight, blockType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "instrument function %d", imported+uint32(i))
+		}
+		m.Codes[i].Expr = expr
+	}
+
+	return m.Encode(), nil
+}
+
+// limitFrame wraps a function body with the stack height accounting:
+//
+//	height += frame; if (height > max) unreachable
+//	block (result ...) body end
+//	height -= frame
+//
+// The block catches all the branches to the function label, and returns from
+// inside the body are preceded by the epilogue.
+func limitFrame(expr []byte, height, frame, maxHeight uint32, blockType []byte) ([]byte, error) {
+	instrs, err := decodeInstructions(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(instrs) == 0 || instrs[len(instrs)-1].op != opEnd {
+		return nil, errors.New("function body does not end properly")
+	}
+
+	epilogue := append([]byte{opGlobalGet}, appendU32(nil, height)...)
+	epilogue = append(epilogue, opI32Const)
+	epilogue = appendSLEB(epilogue, int64(frame))
+	epilogue = append(epilogue, opI32Sub, opGlobalSet)
+	epilogue = appendU32(epilogue, height)
+
+	out := make([]byte, 0, len(expr)+64)
+	out = append(out, opGlobalGet)
+	out = appendU32(out, height)
+	out = append(out, opI32Const)
+	out = appendSLEB(out, int64(frame))
+	out = append(out, opI32Add, opGlobalSet)
+	out = appendU32(out, height)
+	out = append(out, opGlobalGet)
+	out = appendU32(out, height)
+	out = append(out, opI32Const)
+	out = appendSLEB(out, int64(maxHeight))
+	out = append(out, opI32GtU, opIf, blockTypeEmpty, opUnreachable, opEnd)
+
+	out = append(out, opBlock)
+	out = append(out, blockType...)
+	for _, instr := range instrs[:len(instrs)-1] {
+		if instr.op == opReturn {
+			out = append(out, epilogue...)
+		}
+		out = append(out, expr[instr.start:instr.end]...)
+	}
+	out = append(out, opEnd)
+	out = append(out, epilogue...)
+	out = append(out, opEnd)
+	return out, nil
+}
+
+// operandDepth returns the max height of the operand stack of a function body.
+// The stack is unknown after an unconditional branch, it is reset to the height
+// of the enclosing block, which can only overestimate the code behind.
+func operandDepth(m *Module, expr []byte) (uint32, error) {
+	instrs, err := decodeInstructions(expr)
+	if err != nil {
+		return 0, err
+	}
+
+	type label struct {
+		base            int64
+		params, results int64
+	}
+	labels := []label{{}}
+	height, depth := int64(0), int64(0)
+	pop := func(n int64) {
+		height -= n
+		if base := labels[len(labels)-1].base; height < base {
+			// values popped in unreachable code
+			height = base
+		}
+	}
+	push := func(n int64) {
+		height += n
+		if height > depth {
+			depth = height
+		}
+	}
+
+	for _, instr := range instrs {
+		if len(labels) == 0 {
+			return 0, errors.New("instructions after the end of the function")
+		}
+		top := labels[len(labels)-1]
+
+		switch op := instr.op; op {
+		case opBlock, opLoop, opIf:
+			if op == opIf {
+				pop(1)
+			}
+			params, results, err := m.blockArity(instr.blockType)
+			if err != nil {
+				return 0, err
+			}
+			pop(params)
+			labels = append(labels, label{base: height, params: params, results: results})
+			push(params)
+		case opElse:
+			height = top.base
+			push(top.params)
+		case opEnd:
+			labels = labels[:len(labels)-1]
+			height = top.base
+			push(top.results)
+		case opUnreachable, opBr, opBrTable, opReturn:
+			height = top.base
+		case opCall, opCallIndirect:
+			var fnType FuncType
+			if op == opCall {
+				if fnType, err = m.FuncType(instr.index); err != nil {
+					return 0, err
+				}
+			} else {
+				if int(instr.index) >= len(m.Types) {
+					return 0, errors.Errorf("type %d out of range", instr.index)
+				}
+				fnType = m.Types[instr.index]
+				pop(1)
+			}
+			pop(int64(len(fnType.Params)))
+			push(int64(len(fnType.Results)))
+		default:
+			pops, pushes, ok := stackEffect(instr)
+			if !ok {
+				return 0, errors.Errorf("unsupported opcode 0x%x at %d", op, instr.start)
+			}
+			pop(pops)
+			push(pushes)
+		}
+	}
+	if len(labels) != 0 {
+		return 0, errors.New("function body does not end properly")
+	}
+	if depth > math.MaxUint32 {
+		return 0, errors.New("operand stack too deep")
+	}
+	return uint32(depth), nil
+}
+
+// blockArity returns the number of params and results of a block type
+func (m *Module) blockArity(blockType int64) (int64, int64, error) {
+	switch {
+	case blockType == -0x40:
+		return 0, 0, nil
+	case blockType < 0:
+		return 0, 1, nil
+	case blockType >= int64(len(m.Types)):
+		return 0, 0, errors.Errorf("type %d out of range", blockType)
+	}
+	fnType := m.Types[blockType]
+	return int64(len(fnType.Params)), int64(len(fnType.Results)), nil
+}
+
+// stackEffect returns the number of operands popped and pushed by the
+// instructions which do not depend on the module or the control flow
+func stackEffect(instr instruction) (int64, int64, bool) {
+	op := instr.op
+	switch {
+	case op == 0x01: // nop
+		return 0, 0, true
+	case op == opBrIf, op == 0x1a /* drop */, op == opLocalSet, op == opGlobalSet:
+		return 1, 0, true
+	case op == 0x1b /* select */, op == opSelectT:
+		return 3, 1, true
+	case op == opLocalGet, op == opGlobalGet, op == opMemorySize,
+		op >= opI32Const && op <= opF64Const, op == opRefNull, op == opRefFunc:
+		return 0, 1, true
+	case op == opLocalTee, op == opTableGet, op == opMemoryGrow,
+		op >= opI32Load && op <= 0x35 /* i64.load32_u */, op == 0xd1 /* ref.is_null */ :
+		return 1, 1, true
+	case op == opTableSet, op >= 0x36 /* i32.store */ && op <= opI64Store32:
+		return 2, 0, true
+	case op == 0x45 /* i32.eqz */, op == 0x50 /* i64.eqz */, op >= 0x67 && op <= 0x69,
+		op >= 0x79 && op <= 0x7b, op >= 0x8b && op <= 0x91, op >= 0x99 && op <= 0x9f,
+		op >= 0xa7 && op <= 0xc4:
+		// unary operators and conversions
+		return 1, 1, true
+	case op >= 0x46 && op <= 0x4f, op >= 0x51 && op <= 0x66, op >= 0x6a && op <= 0x78,
+		op >= 0x7c && op <= 0x8a, op >= 0x92 && op <= 0x98, op >= 0xa0 && op <= 0xa6:
+		// comparisons and binary operators
+		return 2, 1, true
+	case op == opPrefixFC:
+		switch instr.sub {
+		case 0, 1, 2, 3, 4, 5, 6, 7: // saturating truncation
+			return 1, 1, true
+		case 9, 13: // data.drop, elem.drop
+			return 0, 0, true
+		case 8, 10, 11, 12, 14, 17: // memory.init, memory.copy, memory.fill, table.init, table.copy, table.fill
+			return 3, 0, true
+		case 15: // table.grow
+			return 2, 1, true
+		case 16: // table.size
+			return 0, 1, true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,83 @@
+package instrument
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/stretchr/testify/require"
+)
+
+// recursiveModule builds a module exporting
+//
+//	(func $depth (param $n i32) (result i32)
+//	  (if (i32.eqz (local.get $n)) (then (return (i32.const 0))))
+//	  (i32.add (call $depth (i32.sub (local.get $n) (i32.const 1))) (i32.const 1)))
+func recursiveModule() []byte {
+	m := &Module{}
+	typeIndex := m.AddType(FuncType{Params: []byte{ValueI32}, Results: []byte{ValueI32}})
+	body := []byte{
+		opLocalGet, 0, 0x45 /* i32.eqz */, opIf, blockTypeEmpty, opI32Const, 0, opReturn, opEnd,
+		opLocalGet, 0, opI32Const, 1, opI32Sub, opCall, 0, opI32Const, 1, opI32Add, opEnd,
+	}
+	depth := m.AddFunction(typeIndex, Code{Expr: body})
+	m.Exports = append(m.Exports, Export{Name: "depth", Kind: ExternFunc, Index: depth})
+	return m.Encode()
+}
+
+func TestLimitStack(t *testing.T) {
+	code, err := LimitStack(recursiveModule(), 100)
+	require.Equal(t, nil, err)
+
+	_, err = LimitStack(code, 100)
+	require.NotNil(t, err)
+
+	store := wasmtime.NewStore(wasmtime.NewEngine())
+	module, err := wasmtime.NewModule(store.Engine, code)
+	require.Equal(t, nil, err)
+	instance, err := wasmtime.NewInstance(store, module, nil)
+	require.Equal(t, nil, err)
+
+	depth := instance.GetFunc(store, "depth")
+	height := instance.GetExport(store, StackHeightExport).Global()
+
+	// each frame of depth takes 4 (1 + 1 param + 2 operands), 25 frames are allowed
+	res, err := depth.Call(store, 24)
+	require.Equal(t, nil, err)
+	require.Equal(t, int32(24), res)
+	require.Equal(t, int32(0), height.Get(store).I32())
+
+	_, err = depth.Call(store, 25)
+	require.NotNil(t, err)
+	require.Greater(t, height.Get(store).I32(), int32(100))
+}
+
+func TestOperandDepth(t *testing.T) {
+	m := &Module{}
+	pair := m.AddType(FuncType{Params: []byte{ValueI32}, Results: []byte{ValueI32, ValueI32}})
+	callee := m.AddFunction(pair, Code{Expr: []byte{opLocalGet, 0, opLocalGet, 0, opEnd}})
+
+	for _, c := range []struct {
+		expr  []byte
+		depth uint32
+	}{
+		{[]byte{opEnd}, 0},
+		{[]byte{opI32Const, 1, opI32Const, 2, opI32Add, 0x1a, opEnd}, 2},
+		// the results of a call are pushed on the remaining operands
+		{[]byte{opI32Const, 1, opI32Const, 2, opCall, byte(callee), opI32Add, opI32Add, 0x1a, opEnd}, 3},
+		// block params stay on the stack, else restarts from the params
+		{[]byte{
+			opI32Const, 1, opBlock, byte(pair), opI32Const, 2, opI32Add, opI32Const, 3, opEnd,
+			opI32Const, 0, opIf, blockTypeEmpty, opI32Const, 1, 0x1a, opElse, opI32Const, 1, 0x1a, opEnd,
+			0x1a, 0x1a, opEnd,
+		}, 3},
+		// the code after a branch starts from the height of the block
+		{[]byte{opBlock, blockTypeEmpty, opI32Const, 1, opBr, 0, opI32Const, 1, opI32Const, 1, 0x1a, 0x1a, opEnd, opEnd}, 2},
+	} {
+		depth, err := operandDepth(m, c.expr)
+		require.Equal(t, nil, err)
+		require.Equal(t, c.depth, depth, "%x", c.expr)
+	}
+
+	_, err := operandDepth(m, []byte{0xc5, opEnd})
+	require.NotNil(t, err)
+}
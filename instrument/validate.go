@@ -0,0 +1,166 @@
+package instrument
+
+import (
+	"github.com/pkg/errors"
+)
+
+// funcRef is the element type of the tables without reference types
+const funcRef byte = 0x70
+
+// ValidateAspect checks the rules of the aspects which are not part of the wasm
+// validation, so that all the engines accept the same aspects:
+//   - the imports are functions, the host only provides functions
+//   - entrypoint is an exported function, and there is no start section
+//   - there is at most one memory, which is neither shared nor 64-bit, and at
+//     most one table of funcref
+//   - the floating-point types and instructions are rejected, along with the
+//     instructions of bulk memory, reference types and the proposals which
+//     are not decoded, e.g. simd and tail calls
+func ValidateAspect(code []byte, entrypoint string) error {
+	m, err := DecodeModule(code)
+	if err != nil {
+		return err
+	}
+
+	for _, imp := range m.Imports {
+		if imp.Kind != ExternFunc {
+			return errors.Errorf("import %s.%s is not a function", imp.Module, imp.Name)
+		}
+	}
+
+	exported := false
+	for _, export := range m.Exports {
+		if export.Name == entrypoint && export.Kind == ExternFunc {
+			exported = true
+			break
+		}
+	}
+	if !exported {
+		return errors.Errorf("aspect entrypoint %s not exported", entrypoint)
+	}
+	if m.section(SectionStart) != nil {
+		return errors.New("start section not allowed")
+	}
+
+	if err := m.validateMemories(); err != nil {
+		return err
+	}
+	if len(m.Tables) > 1 {
+		return errors.New("multiple tables")
+	}
+	for _, table := range m.Tables {
+		if table.ElemType != funcRef {
+			return errors.Errorf("table element type 0x%x not supported", table.ElemType)
+		}
+	}
+
+	for i, t := range m.Types {
+		if floatType(t.Params...) || floatType(t.Results...) {
+			return errors.Errorf("floating-point type in signature %d", i)
+		}
+	}
+	for i, global := range m.Globals {
+		if floatType(global.Type) {
+			return errors.Errorf("floating-point type of global %d", m.ImportedGlobals()+uint32(i))
+		}
+	}
+	for i, code := range m.Codes {
+		index := m.ImportedFuncs() + uint32(i)
+		if err := validateCode(code); err != nil {
+			return errors.WithMessagef(err, "function %d", index)
+		}
+	}
+	return nil
+}
+
+// validateMemories checks the memory section, the memories are not decoded
+// with the module as the instrumentation never rewrites them
+func (m *Module) validateMemories() error {
+	section := m.section(SectionMemory)
+	if section == nil {
+		return nil
+	}
+
+	r := newReader(section.Payload)
+	memories := 0
+	err := r.vec(func() error {
+		memories++
+		flag, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if flag&^0x01 != 0 {
+			return errors.New("shared and 64-bit memories not supported")
+		}
+		if _, err := r.u32(); err != nil {
+			return err
+		}
+		if flag&0x01 != 0 {
+			_, err = r.u32()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if memories > 1 {
+		return errors.New("multiple memories")
+	}
+	return nil
+}
+
+// validateCode rejects the floating-point locals and the instructions of the
+// features which are not enabled
+func validateCode(code Code) error {
+	for _, local := range code.Locals {
+		if floatType(local.Type) {
+			return errors.New("floating-point local")
+		}
+	}
+
+	instrs, err := decodeInstructions(code.Expr)
+	if err != nil {
+		return err
+	}
+	for _, instr := range instrs {
+		op, offset := instr.op, code.Offset+instr.start
+		switch {
+		case floatOpcode(op) || (op == opPrefixFC && instr.sub < 8):
+			return errors.Errorf("floating-point instruction disallowed at offset %d", offset)
+		case op == opPrefixFC:
+			return errors.Errorf("bulk memory instruction disallowed at offset %d", offset)
+		case op == opSelectT || op == opTableGet || op == opTableSet ||
+			op == opRefNull || op == opRefIsNull || op == opRefFunc:
+			return errors.Errorf("reference types instruction disallowed at offset %d", offset)
+		case (op == opBlock || op == opLoop || op == opIf) &&
+			(instr.blockType == -3 || instr.blockType == -4):
+			// the single value block types of f32 and f64
+			return errors.Errorf("floating-point block type at offset %d", offset)
+		}
+	}
+	return nil
+}
+
+// floatType checks whether any of the value types is f32 or f64
+func floatType(types ...byte) bool {
+	for _, t := range types {
+		if t == ValueF32 || t == ValueF64 {
+			return true
+		}
+	}
+	return false
+}
+
+// floatOpcode checks whether the opcode takes or produces floating-point values
+func floatOpcode(op byte) bool {
+	switch {
+	case op == 0x2a || op == 0x2b || op == 0x38 || op == 0x39: // loads and stores
+	case op == opF32Const || op == opF64Const:
+	case op >= 0x5b && op <= 0x66: // comparisons
+	case op >= 0x8b && op <= 0xa6: // arithmetic
+	case op >= 0xa8 && op <= 0xab, op >= 0xae && op <= 0xbf: // conversions
+	default:
+		return false
+	}
+	return true
+}
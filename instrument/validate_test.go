@@ -0,0 +1,54 @@
+package instrument
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAspect(t *testing.T) {
+	raw, err := os.ReadFile("../wasmtime/testdata/runtime_test.wasm")
+	require.Equal(t, nil, err)
+	require.Equal(t, nil, ValidateAspect(raw, "__aspect_start__"))
+	require.ErrorContains(t, ValidateAspect(raw, "missing"), "not exported")
+
+	// only functions are imported
+	imports := append(append([]byte{}, wasmHeader...), SectionImport, 10, 1, 3, 'e', 'n', 'v', 1, 'm', ExternMemory, 0, 1)
+	require.ErrorContains(t, ValidateAspect(imports, "__aspect_start__"), "is not a function")
+
+	for expected, edit := range map[string]func(m *Module){
+		"start section not allowed": func(m *Module) {
+			m.insertSection(&Section{ID: SectionStart, Payload: []byte{0}})
+		},
+		"multiple memories": func(m *Module) {
+			m.section(SectionMemory).Payload = []byte{2, 0, 1, 0, 1}
+		},
+		"shared and 64-bit memories": func(m *Module) {
+			m.section(SectionMemory).Payload = []byte{1, 0x03, 1, 1}
+		},
+		"multiple tables": func(m *Module) {
+			m.Tables = append(m.Tables, Table{ElemType: funcRef}, Table{ElemType: funcRef})
+		},
+		"floating-point type": func(m *Module) {
+			m.AddType(FuncType{Params: []byte{ValueF32}})
+		},
+		"floating-point instruction": func(m *Module) {
+			m.AddFunction(m.AddType(FuncType{}), Code{Expr: []byte{opF64Const, 0, 0, 0, 0, 0, 0, 0, 0, opDrop, opEnd}})
+		},
+		"bulk memory instruction": func(m *Module) {
+			// memory.copy
+			m.AddFunction(m.AddType(FuncType{}), Code{Expr: []byte{
+				opI32Const, 0, opI32Const, 0, opI32Const, 0, opPrefixFC, 10, 0, 0, opEnd,
+			}})
+		},
+		"reference types instruction": func(m *Module) {
+			m.AddFunction(m.AddType(FuncType{}), Code{Expr: []byte{opRefNull, funcRef, opDrop, opEnd}})
+		},
+	} {
+		m, err := DecodeModule(raw)
+		require.Equal(t, nil, err)
+		edit(m)
+		require.ErrorContains(t, ValidateAspect(m.Encode(), "__aspect_start__"), expected)
+	}
+}
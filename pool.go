@@ -3,6 +3,8 @@ package runtime
 import (
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -138,14 +140,29 @@ type RuntimePool struct {
 
 	cache  *EntryList
 	logger types.Logger
-	ctx    context.Context
+
+	// flights are the runtimes being created, keyed by the hash of the runtime args
+	flights map[Hash]*flight
+
+	// opts are applied to all runtimes of the pool before the options of each call
+	opts []Option
 }
 
-func NewRuntimePool(ctx context.Context, logger types.Logger, capacity int) *RuntimePool {
+// flight is a runtime creation which concurrent misses of the same hash wait for
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// NewRuntimePool creates a runtime pool, opts are the default options of all
+// the runtimes created by the pool, e.g. WithRuntimeOptions. The runtimes are
+// bound to the context passed to Runtime, not to the context of the pool.
+func NewRuntimePool(_ context.Context, logger types.Logger, capacity int, opts ...Option) *RuntimePool {
 	return &RuntimePool{
-		cache:  NewEntryList(capacity),
-		logger: logger,
-		ctx:    ctx,
+		cache:   NewEntryList(capacity),
+		logger:  logger,
+		flights: make(map[Hash]*flight),
+		opts:    opts,
 	}
 }
 
@@ -153,10 +170,11 @@ func (pool *RuntimePool) Len() int {
 	return pool.cache.Len()
 }
 
-func (pool *RuntimePool) Runtime(ctx context.Context, rtType RuntimeType, code []byte, apis *types.HostAPIRegistry) (string, types.AspectRuntime, error) {
+func (pool *RuntimePool) Runtime(ctx context.Context, rtType RuntimeType, code []byte, apis *types.HostAPIRegistry, opts ...Option) (string, types.AspectRuntime, error) {
 	startTime := time.Now()
 
-	hash := hashOfRuntimeArgs(rtType, code)
+	opts = append(append([]Option{}, pool.opts...), opts...)
+	hash := hashOfRuntimeArgs(rtType, newRuntimeConfig(opts), code)
 	key, rt, err := pool.get(hash)
 	if err == nil && rt.ResetStore(ctx, apis) == nil {
 		pool.logger.Debug("runtime pool cache hit", "duration", time.Since(startTime).String(),
@@ -164,8 +182,7 @@ func (pool *RuntimePool) Runtime(ctx context.Context, rtType RuntimeType, code [
 		return string(key), rt, nil
 	}
 
-	rt, err = NewAspectRuntime(pool.ctx, pool.logger, rtType, code, apis)
-
+	rt, err = pool.create(ctx, hash, rtType, code, apis, opts...)
 	if err != nil {
 		return "", nil, err
 	}
@@ -178,6 +195,40 @@ func (pool *RuntimePool) Runtime(ctx context.Context, rtType RuntimeType, code [
 	return keyStr, rt, nil
 }
 
+// create creates a new runtime with the context of the caller, like a pooled
+// runtime is reset with it, so that the WASI seed and the interruption of a
+// call never depend on a hit of the pool. Only one of the concurrent misses of
+// the same hash instruments and compiles the code, the others wait for it and
+// then create their own runtimes from the cached code and module.
+func (pool *RuntimePool) create(ctx context.Context, hash Hash, rtType RuntimeType, code []byte, apis *types.HostAPIRegistry, opts ...Option) (types.AspectRuntime, error) {
+	pool.Lock()
+	if f, ok := pool.flights[hash]; ok {
+		pool.Unlock()
+
+		pool.logger.Debug("waiting for runtime creation", "hash", hash)
+		<-f.done
+		// the context of the leader is not the context of the follower
+		if f.err != nil && !errors.Is(f.err, types.InterruptedError) && !errors.Is(f.err, types.DeadlineExceededError) {
+			return nil, f.err
+		}
+		return NewAspectRuntime(ctx, pool.logger, rtType, code, apis, opts...)
+	}
+
+	f := &flight{done: make(chan struct{})}
+	pool.flights[hash] = f
+	pool.Unlock()
+
+	rt, err := NewAspectRuntime(ctx, pool.logger, rtType, code, apis, opts...)
+
+	pool.Lock()
+	delete(pool.flights, hash)
+	pool.Unlock()
+
+	f.err = err
+	close(f.done)
+	return rt, err
+}
+
 func (pool *RuntimePool) get(hash Hash) (Key, types.AspectRuntime, error) {
 	entry, ok := pool.cache.PopFront(hash)
 	if !ok {
@@ -205,11 +256,39 @@ func (pool *RuntimePool) Return(key string, runtime types.AspectRuntime) {
 	pool.logger.Debug("runtime returned", "key", key)
 }
 
-func hashOfRuntimeArgs(runtimeType RuntimeType, code []byte) Hash {
+func hashOfRuntimeArgs(runtimeType RuntimeType, config *types.RuntimeConfig, code []byte) Hash {
 	h := sha1.New()
-	var rttype [1]byte
+	var rttype [4]byte
 	rttype[0] = byte(runtimeType)
+	if config.Profiling {
+		rttype[1] = 1
+	}
+	rttype[2] = byte(config.Metering)
+	rttype[3] = byte(config.Reset)
 	h.Write(rttype[:])
+	var height [4]byte
+	binary.BigEndian.PutUint32(height[:], config.MaxStackHeight)
+	h.Write(height[:])
+	limits := config.Limits()
+	_ = binary.Write(h, binary.BigEndian, []int64{
+		limits.MaxMemorySize, limits.MaxTables, limits.MaxTableElements, limits.MaxInstances, limits.MaxWasmStack,
+	})
+	if config.Instrumentation != nil {
+		h.Write(config.Instrumentation.Hash())
+	}
+	if config.ABI != nil {
+		h.Write(config.ABI.Hash())
+	}
+	if config.Lifecycle != nil {
+		h.Write(config.Lifecycle.Hash())
+	}
+	if config.WASI != nil {
+		h.Write(config.WASI.Hash())
+	}
+	if config.SourceMap != nil {
+		sourceMapHash := sha256.Sum256(config.SourceMap)
+		h.Write(sourceMapHash[:])
+	}
 	h.Write(code)
 	return Hash(hex.EncodeToString(h.Sum(nil)))
 }
@@ -10,8 +10,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/artela-network/aspect-runtime/instrument"
 	"github.com/artela-network/aspect-runtime/types"
 	"github.com/artela-network/aspect-runtime/wasmtime"
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v20"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,7 +32,7 @@ func TestCallNormalWithPool(t *testing.T) {
 	pool := NewRuntimePool(context.Background(), &mockedLogger{}, 10)
 
 	for i := 0; i < 12; i++ {
-		key, wasmTimeRuntime, err := pool.Runtime(context.Background(), WASM, raw, hostApis)
+		key, wasmTimeRuntime, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis)
 		require.Equal(t, nil, err)
 		res, _, err := wasmTimeRuntime.Call("testIncrease", types.MaxGas)
 		require.Equal(t, nil, err)
@@ -58,7 +60,7 @@ func TestCallNormalWithPool2(t *testing.T) {
 			return
 		}
 
-		key, wasmTimeRuntime, err := pool.Runtime(context.Background(), WASM, raw, hostApis)
+		key, wasmTimeRuntime, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis)
 		require.Equal(t, nil, err)
 		res, _, err := wasmTimeRuntime.Call("testIncrease", types.MaxGas)
 		require.Equal(t, nil, err)
@@ -82,7 +84,7 @@ func TestPoolPerformance(t *testing.T) {
 			return
 		}
 
-		wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+		wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 		require.Equal(t, nil, err)
 		res, _, err := wasmTimeRuntime.Call("testIncrease", types.MaxGas)
 		require.Equal(t, nil, err)
@@ -104,7 +106,7 @@ func TestPoolPerformance(t *testing.T) {
 			return
 		}
 
-		key, wasmTimeRuntime, err := pool.Runtime(context.Background(), WASM, raw, hostApis)
+		key, wasmTimeRuntime, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis)
 		require.Equal(t, nil, err)
 
 		res, _, err := wasmTimeRuntime.Call("testIncrease", types.MaxGas)
@@ -146,7 +148,7 @@ func TestPoolParallelPerformance(t *testing.T) {
 					return
 				}
 
-				wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+				wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 				require.Equal(t, nil, err)
 				res, _, err := wasmTimeRuntime.Call("greet", types.MaxGas, "abc")
 				require.Equal(t, nil, err)
@@ -182,7 +184,7 @@ func TestPoolParallelPerformance(t *testing.T) {
 					return
 				}
 
-				key, wasmTimeRuntime, err := pool.Runtime(context.Background(), WASM, raw, hostApis)
+				key, wasmTimeRuntime, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis)
 				require.Equal(t, nil, err)
 				res, _, err := wasmTimeRuntime.Call("greet", types.MaxGas, "abc")
 				require.Equal(t, nil, err)
@@ -203,3 +205,541 @@ func TestPoolParallelPerformance(t *testing.T) {
 	}
 	fmt.Printf("cost with pool / cost without pool: %.2f%%\n", float32(totalCost2)/float32(totalCost1)*100) // it is 0.2606396 in one test
 }
+
+// Test Case: runtimes of the same code share one compiled module
+func TestSharedModule(t *testing.T) {
+	requireWASMTime(t)
+
+	isolateCaches(t)
+	raw := newFixture(t).isolate().code()
+	cached := wasmtime.CachedModules()
+
+	runtimes := make([]types.AspectRuntime, 0, 3)
+	for i := 0; i < 3; i++ {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+		require.Equal(t, nil, err)
+		require.Equal(t, cached+1, wasmtime.CachedModules())
+
+		res, _, err := rt.Call("testIncrease", types.MaxGas)
+		require.Equal(t, nil, err)
+		require.Equal(t, "10", res)
+		runtimes = append(runtimes, rt)
+	}
+
+	// a different engine config compiles a different module
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	fuel, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithFuelMetering())
+	require.Equal(t, nil, err)
+	require.Equal(t, cached+2, wasmtime.CachedModules())
+	fuel.Destroy()
+	require.Equal(t, cached+1, wasmtime.CachedModules())
+
+	// the module is kept until the last runtime is destroyed
+	for i, rt := range runtimes {
+		rt.Destroy()
+		if i < len(runtimes)-1 {
+			require.Equal(t, cached+1, wasmtime.CachedModules())
+		}
+	}
+	require.Equal(t, cached, wasmtime.CachedModules())
+}
+
+// Test Case: compiled modules are persisted and reloaded from the disk cache
+func TestModuleDiskCache(t *testing.T) {
+	requireWASMTime(t)
+
+	isolateCaches(t)
+	raw := newFixture(t).isolate().code()
+	// a second aspect, which differs from the first one by a function
+	other := newFixture(t).isolate()
+	other.addFunc("noop", instrument.FuncType{}, 0x0b)
+
+	dir := t.TempDir()
+	require.Equal(t, nil, SetModuleCacheDir(dir, 1<<30))
+	defer func() {
+		require.Equal(t, nil, SetModuleCacheDir("", 0))
+	}()
+
+	run := func(code []byte) {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, code, hostApis)
+		require.Equal(t, nil, err)
+		defer rt.Destroy()
+
+		res, _, err := rt.Call("testIncrease", types.MaxGas)
+		require.Equal(t, nil, err)
+		require.Equal(t, "10", res)
+	}
+	cacheFiles := func() []string {
+		var files []string
+		entries, err := os.ReadDir(dir)
+		require.Equal(t, nil, err)
+		for _, entry := range entries {
+			files = append(files, path.Join(dir, entry.Name()))
+		}
+		return files
+	}
+
+	// the compiled module is saved on the first run and loaded on the second
+	run(raw)
+	files := cacheFiles()
+	require.Equal(t, 1, len(files))
+	saved, err := os.ReadFile(files[0])
+	require.Equal(t, nil, err)
+
+	run(raw)
+	require.Equal(t, files, cacheFiles())
+
+	// a corrupted file is dropped and replaced with a recompiled module
+	corrupted := append([]byte{}, saved...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	require.Equal(t, nil, os.WriteFile(files[0], corrupted, 0o600))
+	run(raw)
+	reloaded, err := os.ReadFile(files[0])
+	require.Equal(t, nil, err)
+	require.Equal(t, saved, reloaded)
+
+	// the cache never grows over its max size, which fits only one of the modules
+	require.Equal(t, nil, SetModuleCacheDir(dir, int64(len(saved))*3/2))
+	run(other.code())
+	require.Equal(t, 1, len(cacheFiles()))
+}
+
+// Test Case: the teardown hook runs on the instances of pooled runtimes
+func TestPoolTeardown(t *testing.T) {
+	f := newFixture(t)
+	f.addFunc("__aspect_teardown__", instrument.FuncType{}, 0x0b)
+	raw := f.code()
+	// a second aspect evicting the first one from the pool
+	other := newFixture(t)
+	other.addFunc("noop", instrument.FuncType{}, 0x0b)
+
+	for _, opts := range supportedOptions(nil, []Option{WithSnapshotReset()}) {
+		snapshot := newRuntimeConfig(opts).Reset == types.SnapshotReset
+		logger := &countingLogger{counts: make(map[string]int)}
+		pool := NewRuntimePool(context.Background(), logger, 1)
+
+		run := func(code []byte) {
+			hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+			require.Equal(t, nil, addApis(t, hostApis))
+
+			key, rt, err := pool.Runtime(context.Background(), testRuntime, code, hostApis, opts...)
+			require.Equal(t, nil, err)
+			res, _, err := rt.Call("testIncrease", types.MaxGas)
+			require.Equal(t, nil, err)
+			require.Equal(t, "10", res)
+			pool.Return(key, rt)
+		}
+
+		// the instance is dropped when the runtime is returned, unless the
+		// snapshot keeps it until the runtime is evicted
+		run(raw)
+		if snapshot {
+			require.Equal(t, 0, logger.count("aspect torn down"))
+		} else {
+			require.Equal(t, 1, logger.count("aspect torn down"))
+		}
+		run(raw)
+		run(other.code())
+		require.Eventually(t, func() bool {
+			if snapshot {
+				return logger.count("aspect torn down") == 1
+			}
+			return logger.count("aspect torn down") == 2
+		}, time.Second, 10*time.Millisecond)
+	}
+}
+
+// Test Case: a miss and a hit of the pool see the same WASI seed
+func TestPoolWASISeed(t *testing.T) {
+	requireWASMTime(t)
+
+	raw, err := wasmtimego.Wat2Wasm(wasiTestModule)
+	require.Equal(t, nil, err)
+
+	seed := types.WASISeed{Time: 1700000000000000000, Random: []byte("block hash")}
+	ctx := types.ContextWithWASISeed(context.Background(), seed)
+	pool := NewRuntimePool(context.Background(), &mockedLogger{}, 10, WithWASI(types.DefaultWASIConfig))
+
+	run := func() []interface{} {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		key, rt, err := pool.Runtime(ctx, testRuntime, raw, hostApis)
+		require.Equal(t, nil, err)
+		defer pool.Return(key, rt)
+
+		var out []interface{}
+		for _, method := range []string{"clock", "random"} {
+			res, _, err := rt.Call(method, 1000000)
+			require.Equal(t, nil, err)
+			out = append(out, res)
+		}
+		return out
+	}
+
+	miss := run()
+	require.Equal(t, seed.Time+1, miss[0])
+	require.Equal(t, 1, pool.Len())
+	require.Equal(t, miss, run())
+}
+
+// Test Case: the context of the caller stops the calls of a runtime created by
+// a miss of the pool
+func TestPoolInterrupt(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	run := func(ctx context.Context) error {
+		// a new pool for each context, so that the runtime is created by a miss
+		pool := NewRuntimePool(context.Background(), &mockedLogger{}, 10)
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		key, rt, err := pool.Runtime(ctx, testRuntime, raw, hostApis)
+		require.Equal(t, nil, err)
+		defer pool.Return(key, rt)
+
+		start := time.Now()
+		_, _, err = rt.Call("infiniteLoop", types.MaxGas)
+		require.Less(t, time.Since(start), 5*time.Second)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(t, types.DeadlineExceededError, run(ctx))
+
+	if !interruptsRunningCalls() {
+		return
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	require.Equal(t, types.InterruptedError, run(ctx))
+}
+
+// countingLogger counts the messages logged
+type countingLogger struct {
+	mockedLogger
+
+	sync.Mutex
+	counts map[string]int
+}
+
+func (l *countingLogger) Debug(msg string, keyvals ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.counts[msg]++
+}
+
+func (l *countingLogger) Info(msg string, keyvals ...interface{}) {
+	l.Debug(msg, keyvals...)
+}
+
+func (l *countingLogger) With(keyvals ...interface{}) types.Logger {
+	return l
+}
+
+func (l *countingLogger) count(msg string) int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.counts[msg]
+}
+
+// Test Case: concurrent misses of the same aspect instrument and compile it only once
+func TestConcurrentMisses(t *testing.T) {
+	isolateCaches(t)
+	raw := newFixture(t).isolate().code()
+
+	logger := &countingLogger{counts: make(map[string]int)}
+	pool := NewRuntimePool(context.Background(), logger, 50)
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+			if err := addApis(t, hostApis); err != nil {
+				errs <- err
+				return
+			}
+			key, rt, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer pool.Return(key, rt)
+
+			res, _, err := rt.Call("testIncrease", types.MaxGas)
+			if err == nil && res != "10" {
+				err = fmt.Errorf("unexpected result %v", res)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.Equal(t, nil, err)
+	}
+	require.Equal(t, 1, logger.count("instrumentation done"))
+}
+
+// Test Case: the limit of concurrent compilations also holds back the
+// instrumentation and the compilation of both engines
+func TestMaxConcurrentCompilations(t *testing.T) {
+	isolateCaches(t)
+	raw := newFixture(t).isolate().code()
+
+	SetMaxConcurrentCompilations(1)
+	t.Cleanup(func() {
+		SetMaxConcurrentCompilations(0)
+	})
+
+	release := types.AcquireCompileSlot()
+	created := make(chan error, 1)
+	go func() {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		if err := addApis(t, hostApis); err != nil {
+			created <- err
+			return
+		}
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+		if err == nil {
+			rt.Destroy()
+		}
+		created <- err
+	}()
+
+	select {
+	case err := <-created:
+		t.Fatalf("runtime created while the only slot is taken, err: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release()
+	require.Equal(t, nil, <-created)
+}
+
+// BenchmarkSnapshotRestore measures a call following the reset of a runtime
+// whose memory is grown to 32MiB at start. The restore compares the whole
+// memory with the snapshot, a new store runs the start again instead.
+func BenchmarkSnapshotRestore(b *testing.B) {
+	requireWASMTime(b)
+
+	// grow the memory to 512 pages after the start of the aspect
+	//   (func $grow (call $__aspect_start__) (drop (memory.grow (i32.sub (i32.const 512) (memory.size)))))
+	const memorySize = 32 * 1024 * 1024
+	f := newFixture(b)
+	f.addFunc("grow", instrument.FuncType{},
+		0x10, byte(f.funcIndex("__aspect_start__")), 0x41, 0x80, 0x04, 0x3f, 0, 0x6b, 0x40, 0, 0x1a, 0x0b)
+	raw := f.code()
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	if err := addApis(b, hostApis); err != nil {
+		b.Fatal(err)
+	}
+
+	logger := &countingLogger{counts: make(map[string]int)}
+	abi := types.DefaultABI
+	abi.Start = "grow"
+	opts := []Option{WithGuestABI(abi), WithRuntimeOptions(RuntimeOptions{MaxMemorySize: memorySize})}
+	for name, opts := range map[string][]Option{"store": opts, "snapshot": append(opts, WithSnapshotReset())} {
+		b.Run(name, func(b *testing.B) {
+			rt, err := NewAspectRuntime(context.Background(), logger, testRuntime, raw, hostApis, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer rt.Destroy()
+
+			// the snapshot is taken by the first call
+			call := func() {
+				result, err := rt.CallWithResult("testIncrease", types.MaxGas)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if result.PeakMemory != memorySize {
+					b.Fatalf("memory size %d, expected %d", result.PeakMemory, memorySize)
+				}
+			}
+			call()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rt.Reset()
+				if err := rt.ResetStore(context.Background(), hostApis); err != nil {
+					b.Fatal(err)
+				}
+				call()
+			}
+		})
+	}
+}
+
+func BenchmarkResetStore(b *testing.B) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	if err := addApis(b, hostApis); err != nil {
+		b.Fatal(err)
+	}
+
+	logger := &countingLogger{counts: make(map[string]int)}
+	for name, opts := range map[string][]Option{"store": nil, "snapshot": {WithSnapshotReset()}} {
+		b.Run(name, func(b *testing.B) {
+			rt, err := NewAspectRuntime(context.Background(), logger, testRuntime, raw, hostApis, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer rt.Destroy()
+
+			// the snapshot is taken by the first call
+			if _, _, err := rt.Call("testIncrease", types.MaxGas); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rt.Reset()
+				if err := rt.ResetStore(context.Background(), hostApis); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	// relink is the reset before the linker was kept by the runtime, the host
+	// apis were linked again into a new linker along with each new store
+	b.Run("relink", func(b *testing.B) {
+		requireWASMTime(b)
+
+		code, err := instrumentCode(logger, raw, newRuntimeConfig(nil))
+		if err != nil {
+			b.Fatal(err)
+		}
+		engine := wasmtimego.NewEngine()
+		module, err := wasmtimego.NewModule(engine, code)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer module.Close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			store := wasmtimego.NewStore(engine)
+			linker := wasmtimego.NewLinker(engine)
+			for module, namespaces := range hostApis.WrapperFuncs() {
+				for ns, methods := range namespaces {
+					for method, fn := range methods {
+						if err := linker.Define(store, string(module), fmt.Sprintf("%s.%s", ns, method), wasmtimego.WrapFunc(store, fn)); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+			abort := wasmtimego.WrapFunc(store, func(a, b, c, d int32) {})
+			if err := linker.Define(store, "env", "abort", abort); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := linker.Instantiate(store, module); err != nil {
+				b.Fatal(err)
+			}
+			linker.Close()
+			store.Close()
+		}
+	})
+}
+
+// BenchmarkNewAspectRuntime is the pool miss path with warm caches, for comparison with BenchmarkResetStore
+func BenchmarkNewAspectRuntime(b *testing.B) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	if err := addApis(b, hostApis); err != nil {
+		b.Fatal(err)
+	}
+
+	logger := &countingLogger{counts: make(map[string]int)}
+	warm, err := NewAspectRuntime(context.Background(), logger, testRuntime, raw, hostApis)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer warm.Destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt, err := NewAspectRuntime(context.Background(), logger, testRuntime, raw, hostApis)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rt.Destroy()
+	}
+}
+
+// Test Case: snapshot reset gives the same results and gas as recreating the store
+func TestSnapshotReset(t *testing.T) {
+	requireWASMTime(t)
+
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	type testCall struct {
+		method string
+		args   []interface{}
+		result interface{}
+	}
+	calls := []testCall{
+		{"testIncrease", nil, "10"},
+		{"greet", []interface{}{"abcd"}, "hello-greet-abcd-hello-greet"},
+		{"greet2", []interface{}{"bonjour", "2", "5"}, "bonjour-25-over"},
+		{"testBytes", []interface{}{[]byte{0x1, 0x2, 0x3, 0x4}}, []byte{0x2, 0x3, 0x4, 0x5}},
+		{"testIncrease", nil, "10"},
+	}
+
+	leftovers := make(map[string][]int64)
+	logger := &countingLogger{counts: make(map[string]int)}
+	for _, opts := range [][]Option{nil, {WithSnapshotReset()}} {
+		pool := NewRuntimePool(context.Background(), logger, 10)
+		for i := 0; i < 3; i++ {
+			for _, c := range calls {
+				hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+				require.Equal(t, nil, addApis(t, hostApis))
+
+				key, rt, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis, opts...)
+				require.Equal(t, nil, err)
+
+				res, leftover, err := rt.Call(c.method, 100000, c.args...)
+				require.Equal(t, nil, err)
+				require.Equal(t, c.result, res)
+				leftovers[c.method] = append(leftovers[c.method], leftover)
+
+				pool.Return(key, rt)
+			}
+		}
+	}
+	require.Less(t, 0, logger.count("wasm instance restored from snapshot"))
+
+	for method, gas := range leftovers {
+		for _, leftover := range gas {
+			require.Equal(t, gas[0], leftover, method)
+		}
+	}
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	_, err := NewAspectRuntime(context.Background(), logger, testRuntime, raw, hostApis, WithSnapshotReset(), WithFuelMetering())
+	require.NotNil(t, err)
+}
@@ -6,43 +6,177 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/sourcemap"
 	"github.com/artela-network/aspect-runtime/types"
-	"github.com/artela-network/aspect-runtime/wasmtime"
-	wasm "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/artela-network/aspect-runtime/wazero"
 )
 
 type (
-	engine func(ctx context.Context, logger types.Logger, code []byte, apis *types.HostAPIRegistry) (out types.AspectRuntime, err error)
+	engine func(ctx context.Context, logger types.Logger, code []byte, apis *types.HostAPIRegistry, config *types.RuntimeConfig) (out types.AspectRuntime, err error)
 
 	RuntimeType int
+
+	// Option configures the optional features of an aspect runtime
+	Option func(config *types.RuntimeConfig)
+
+	// RuntimeOptions are the resource limits of an aspect runtime
+	RuntimeOptions = types.RuntimeOptions
 )
 
 const (
 	WASM RuntimeType = iota
+
+	// WAZERO runs the aspects with the wazero engine, which does not need cgo.
+	// It only supports the instrumented gas metering, and the gas profile, the
+	// snapshot reset, WASI and the backtraces of traps are not available.
+	// Without cgo the default schedule is not available either, see
+	// types.BuiltinInstrumentationError.
+	WAZERO
 )
 
+// enginePool holds the engines of the runtime types, the wasmtime engine is
+// registered in runtime_wasmtime.go as it is only built with cgo
 var enginePool = map[RuntimeType]engine{
-	WASM: wasmtime.NewWASMTimeRuntime,
+	WAZERO: wazero.NewWazeroRuntime,
+}
+
+// builtinInstrument is the built-in instrumentation of the wasmtime binding,
+// which charges the default schedule. It is nil if the binding is not built,
+// and there is no pure Go implementation of the same schedule, so the code
+// is only metered with WithInstrumentation then. builtinInstrumentVersion
+// identifies the build of the binding, the instrumented code of another build
+// is not reused from the instrumentation cache.
+var (
+	builtinInstrument        func(code []byte) ([]byte, error)
+	builtinInstrumentVersion string
+)
+
+// WithProfiling enables gas profiling, the gas of each call is attributed to
+// the wasm functions and host apis, see types.AspectRuntime.GasProfile.
+// Profiling does not change the gas usage, but slows down the execution.
+func WithProfiling() Option {
+	return func(config *types.RuntimeConfig) {
+		config.Profiling = true
+	}
+}
+
+// WithFuelMetering charges the wasm execution with the fuel built into the
+// engine instead of the injected gas counter, which saves the instrumentation
+// of the code. The gas cost of the same code differs between the two modes.
+func WithFuelMetering() Option {
+	return func(config *types.RuntimeConfig) {
+		config.Metering = types.FuelMetering
+	}
+}
+
+// WithInstrumentation instruments the code with the given opcode costs instead
+// of the built-in pricing of the engine, runtimes with different configs are
+// pooled separately.
+func WithInstrumentation(config *instrument.Config) Option {
+	return func(runtimeConfig *types.RuntimeConfig) {
+		runtimeConfig.Metering = types.InstrumentedMetering
+		runtimeConfig.Instrumentation = config
+	}
+}
+
+// WithMaxStackHeight limits the stack height of the wasm code deterministically,
+// the height counts one plus the params and locals of each frame on the call
+// stack. Exceeding the limit fails the call with types.StackOverflowError.
+// The stack height is not limited by default, a deep recursion then fails at
+// the native stack overflow of the engine, whose depth depends on the
+// architecture and the code generation. instrument.DefaultMaxStackHeight fits
+// the default max wasm stack.
+func WithMaxStackHeight(height uint32) Option {
+	return func(config *types.RuntimeConfig) {
+		config.MaxStackHeight = height
+	}
+}
+
+// WithSnapshotReset makes the pool reset the runtime by restoring the memory and
+// globals saved after the first initialization, instead of recreating the
+// instance. It requires instrumented gas metering. Each restore compares the
+// whole memory with the snapshot, so it only pays off for the aspects with a
+// small memory or an expensive start, see BenchmarkSnapshotRestore.
+func WithSnapshotReset() Option {
+	return func(config *types.RuntimeConfig) {
+		config.Reset = types.SnapshotReset
+	}
+}
+
+// WithRuntimeOptions sets the resource limits of the runtime, the zero fields
+// of options keep their default values. The tables and the instances are
+// unlimited by default, limiting them must be agreed on by all the nodes.
+func WithRuntimeOptions(options RuntimeOptions) Option {
+	return func(config *types.RuntimeConfig) {
+		config.Options = options
+	}
+}
+
+// WithSourceMap supplies the source map of the code, so that the backtraces of
+// traps carry the positions in the original source. Without it, the source map
+// embedded as a data url in the sourceMappingURL section of the code is used.
+func WithSourceMap(sourceMap []byte) Option {
+	return func(config *types.RuntimeConfig) {
+		config.SourceMap = sourceMap
+	}
+}
+
+// WithGuestABI sets the memory management exports of the aspect, e.g.
+// types.AssemblyScriptABI, types.RustABI or types.TinyGoABI, and the exports
+// returning native i32 values
+func WithGuestABI(abi types.GuestABI) Option {
+	return func(config *types.RuntimeConfig) {
+		config.ABI = &abi
+	}
+}
+
+// WithLifecycle sets the export names and gas budgets of the lifecycle hooks,
+// an empty export name disables the hook
+func WithLifecycle(lifecycle types.Lifecycle) Option {
+	return func(config *types.RuntimeConfig) {
+		config.Lifecycle = &lifecycle
+	}
+}
+
+// WithWASI links the deterministic WASI subset, the clocks and the random bytes
+// are derived from the seed set with types.ContextWithWASISeed
+func WithWASI(wasi types.WASIConfig) Option {
+	return func(config *types.RuntimeConfig) {
+		config.WASI = &wasi
+	}
+}
+
+func newRuntimeConfig(opts []Option) *types.RuntimeConfig {
+	config := &types.RuntimeConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
 }
 
 // NewAspectRuntime is the factory method for creating aspect runtime
-func NewAspectRuntime(ctx context.Context, logger types.Logger, runtimeType RuntimeType, code []byte, apis *types.HostAPIRegistry) (types.AspectRuntime, error) {
+func NewAspectRuntime(ctx context.Context, logger types.Logger, runtimeType RuntimeType, code []byte, apis *types.HostAPIRegistry, opts ...Option) (types.AspectRuntime, error) {
 	engine := enginePool[runtimeType]
 	if engine == nil {
 		return nil, errors.New("runtime engine not support")
 	}
+	config := newRuntimeConfig(opts)
+	if err := config.Options.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid runtime options")
+	}
 
-	startTime := time.Now()
-	injectedCode, err := wasm.Instrument(code)
+	injectedCode, err := instrumentCode(logger, code, config)
 	if err != nil {
 		return nil, err
 	}
-	logger.Debug("instrumentation done", "duration", time.Since(startTime).String(),
-		"beforeSize", len(code),
-		"afterSize", len(injectedCode))
 
-	startTime = time.Now()
-	aspectRuntime, err := engine(ctx, logger, injectedCode, apis)
+	if config.Sources, err = sourceResolver(logger, code, injectedCode, config); err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	aspectRuntime, err := engine(ctx, logger, injectedCode, apis, config)
 	if err != nil {
 		return nil, err
 	}
@@ -50,3 +184,87 @@ func NewAspectRuntime(ctx context.Context, logger types.Logger, runtimeType Runt
 
 	return aspectRuntime, nil
 }
+
+// sourceResolver creates the resolver of the source positions from the source map
+// supplied or embedded in the code, it returns nil if there is no source map.
+func sourceResolver(logger types.Logger, code, injectedCode []byte, config *types.RuntimeConfig) (types.SourceResolver, error) {
+	var (
+		sourceMap *sourcemap.Map
+		err       error
+	)
+	if config.SourceMap != nil {
+		if sourceMap, err = sourcemap.Parse(config.SourceMap); err != nil {
+			return nil, err
+		}
+	} else if sourceMap, err = sourcemap.FromModule(code); err != nil {
+		// the embedded source map is only for debugging, the code is still valid
+		logger.Debug("unable to load embedded source map", "err", err)
+		return nil, nil
+	}
+
+	if sourceMap == nil {
+		return nil, nil
+	}
+	return sourcemap.NewResolver(sourceMap, code, injectedCode), nil
+}
+
+// instrumentCode injects the gas metering and the stack limit into the code,
+// the result is cached since it only depends on the code and the config.
+func instrumentCode(logger types.Logger, code []byte, config *types.RuntimeConfig) ([]byte, error) {
+	cache := sharedInstrumentCache()
+	key := instrumentCacheKey(code, config)
+	if cache != nil {
+		if injectedCode, ok := cache.Get(key); ok {
+			logger.Debug("instrumentation cache hit", "key", key)
+			return injectedCode, nil
+		}
+	}
+
+	release := types.AcquireCompileSlot()
+	defer release()
+
+	startTime := time.Now()
+	injectedCode := code
+	var err error
+	if config.Metering == types.InstrumentedMetering {
+		if config.Instrumentation != nil {
+			injectedCode, err = instrument.Instrument(code, config.Instrumentation)
+		} else if builtinInstrument != nil {
+			injectedCode, err = builtinInstrument(code)
+		} else {
+			err = errors.WithMessage(types.BuiltinInstrumentationError, "the default schedule requires cgo, use WithInstrumentation")
+		}
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("instrumentation done", "duration", time.Since(startTime).String(),
+			"beforeSize", len(code),
+			"afterSize", len(injectedCode))
+	}
+
+	// the stack limit is applied after the gas instrumentation, so that the
+	// stack accounting is not charged
+	if config.MaxStackHeight != 0 {
+		startTime = time.Now()
+		if injectedCode, err = instrument.LimitStack(injectedCode, config.MaxStackHeight); err != nil {
+			return nil, err
+		}
+		logger.Debug("stack limit injected", "duration", time.Since(startTime).String(),
+			"maxHeight", config.MaxStackHeight)
+	}
+
+	if config.Reset == types.SnapshotReset {
+		// all the mutable globals must be accessible to be saved and restored
+		if injectedCode, err = instrument.ExportGlobals(injectedCode); err != nil {
+			return nil, err
+		}
+	}
+
+	if cache != nil {
+		if err := cache.Put(key, injectedCode); err != nil {
+			// the code is still usable, it will be instrumented again next time
+			logger.Error("failed to cache instrumented code", "err", err)
+		}
+	}
+	return injectedCode, nil
+}
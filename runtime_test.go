@@ -1,34 +1,156 @@
 package runtime
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path"
 	"reflect"
 	"testing"
+	"time"
+	"unicode/utf16"
 
+	"github.com/artela-network/aspect-runtime/instrument"
 	"github.com/artela-network/aspect-runtime/types"
 	"github.com/artela-network/aspect-runtime/wasmtime"
+	"github.com/artela-network/aspect-runtime/wazero"
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v20"
 	"github.com/ethereum/go-ethereum/common/math"
+	pprof "github.com/google/pprof/profile"
 
 	"github.com/pkg/errors"
 
 	"github.com/stretchr/testify/require"
 )
 
-type mockedHostContext struct {
-	gas uint64
+// testRuntime is the engine the tests run on, the tests run on the wazero
+// engine with ASPECT_TEST_RUNTIME=wazero
+var testRuntime = WASM
+
+func TestMain(m *testing.M) {
+	if os.Getenv("ASPECT_TEST_RUNTIME") == "wazero" {
+		testRuntime = WAZERO
+	}
+	os.Exit(m.Run())
+}
+
+// requireWASMTime skips the tests of the features only supported by the wasmtime engine
+func requireWASMTime(t testing.TB) {
+	if testRuntime != WASM {
+		t.Skip("not supported by the wazero engine")
+	}
+}
+
+// interruptsRunningCalls reports whether the cancellation of the context and
+// Interrupt stop a running call, see wasmtime.EpochCallbackSupported
+func interruptsRunningCalls() bool {
+	return testRuntime == WAZERO || wasmtime.EpochCallbackSupported()
+}
+
+// supportedOptions drops the sets of options which the test runtime does not support
+func supportedOptions(sets ...[]Option) [][]Option {
+	if testRuntime == WASM {
+		return sets
+	}
+
+	supported := make([][]Option, 0, len(sets))
+	for _, opts := range sets {
+		config := newRuntimeConfig(opts)
+		if config.Metering == types.FuelMetering || config.Profiling || config.Reset == types.SnapshotReset || config.WASI != nil {
+			continue
+		}
+		supported = append(supported, opts)
+	}
+	return supported
 }
 
-func (m *mockedHostContext) RemainingGas() uint64 {
-	return m.gas
+// fixture builds variants of the test aspect, with functions written in raw opcodes
+type fixture struct {
+	*instrument.Module
+	t testing.TB
+}
+
+// newFixture decodes the test aspect
+func newFixture(t testing.TB) *fixture {
+	raw, err := os.ReadFile("./wasmtime/testdata/runtime_test.wasm")
+	require.Equal(t, nil, err)
+	m, err := instrument.DecodeModule(raw)
+	require.Equal(t, nil, err)
+	return &fixture{Module: m, t: t}
+}
+
+// funcIndex returns the index of an exported or imported function
+func (f *fixture) funcIndex(name string) uint32 {
+	for _, export := range f.Exports {
+		if export.Kind == instrument.ExternFunc && export.Name == name {
+			return export.Index
+		}
+	}
+	index := uint32(0)
+	for _, imp := range f.Imports {
+		if imp.Kind != instrument.ExternFunc {
+			continue
+		}
+		if imp.Name == name {
+			return index
+		}
+		index++
+	}
+	require.Fail(f.t, "function not found", name)
+	return 0
+}
+
+// addFunc adds a function exported as name, the function is not exported if
+// name is empty. The index is checked to fit in one byte, so that the function
+// can be called from raw opcodes.
+func (f *fixture) addFunc(name string, fnType instrument.FuncType, expr ...byte) uint32 {
+	index := f.ImportedFuncs() + uint32(len(f.Functions))
+	require.Less(f.t, index, uint32(0x80))
+	f.AddFunction(f.AddType(fnType), instrument.Code{Expr: expr})
+	if name != "" {
+		f.Exports = append(f.Exports, instrument.Export{Name: name, Kind: instrument.ExternFunc, Index: index})
+	}
+	return index
 }
 
-func (m *mockedHostContext) SetGas(gas uint64) {
-	m.gas = gas
+// addGlobal adds a mutable global initialized with a constant expression
+func (f *fixture) addGlobal(valueType byte, init ...byte) uint32 {
+	index := f.AddGlobal(instrument.Global{Type: valueType, Mutable: true, Init: init})
+	require.Less(f.t, index, uint32(0x80))
+	return index
 }
 
+// isolate tags the code with the name of the test. The instrumented code and
+// the compiled modules are cached by the hash of the code, so the tagged code
+// is never shared with the runtimes of other tests.
+func (f *fixture) isolate() *fixture {
+	payload := append([]byte{byte(len("aspect-test"))}, "aspect-test"...)
+	f.Sections = append(f.Sections, &instrument.Section{ID: instrument.SectionCustom, Payload: append(payload, f.t.Name()...)})
+	return f
+}
+
+// code encodes the test aspect
+func (f *fixture) code() []byte {
+	return f.Encode()
+}
+
+// isolateCaches gives the test an empty instrumentation cache, the previous
+// cache is restored once the test is done
+func isolateCaches(t testing.TB) *InstrumentCache {
+	previous := sharedInstrumentCache()
+	cache, err := NewInstrumentCache(DefaultInstrumentCacheSize, "")
+	require.Equal(t, nil, err)
+	SetInstrumentCache(cache)
+	t.Cleanup(func() {
+		SetInstrumentCache(previous)
+	})
+	return cache
+}
+
+type mockedHostContext struct{}
+
 func (m *mockedHostContext) SetVMContext(_ types.VMContext) {
 }
 
@@ -51,13 +173,12 @@ func (m *mockedLogger) With(keyvals ...interface{}) types.Logger {
 }
 
 // Helper: init hostAPI collection(@see type script impl :: declare)
-func addApis(t *testing.T, hostApis *types.HostAPIRegistry) error {
+func addApis(t require.TestingT, hostApis *types.HostAPIRegistry) error {
 	err := hostApis.AddAPI("runtime_test", "test", "hello", &types.HostFuncWithGasRule{
 		Func: func(arg string) (string, error) {
 			return "hello-" + arg + "-hello", nil
 		},
-		GasRule:     types.NewStaticGasRule(1),
-		HostContext: &mockedHostContext{},
+		GasRule: types.NewStaticGasRule(1),
 	})
 	if err != nil {
 		return err
@@ -67,8 +188,7 @@ func addApis(t *testing.T, hostApis *types.HostAPIRegistry) error {
 			tmp := arg2 + arg3
 			return arg1 + "-" + tmp, nil
 		},
-		GasRule:     types.NewStaticGasRule(1),
-		HostContext: &mockedHostContext{},
+		GasRule: types.NewStaticGasRule(1),
 	})
 	if err != nil {
 		return err
@@ -78,8 +198,7 @@ func addApis(t *testing.T, hostApis *types.HostAPIRegistry) error {
 			require.Equal(t, "greet3-hello", arg)
 			return nil
 		},
-		GasRule:     types.NewStaticGasRule(1),
-		HostContext: &mockedHostContext{},
+		GasRule: types.NewStaticGasRule(1),
 	})
 	if err != nil {
 		return err
@@ -88,8 +207,7 @@ func addApis(t *testing.T, hostApis *types.HostAPIRegistry) error {
 		Func: func(arg string) (string, error) {
 			return "", errors.New("error")
 		},
-		GasRule:     types.NewStaticGasRule(1),
-		HostContext: &mockedHostContext{},
+		GasRule: types.NewStaticGasRule(1),
 	})
 	if err != nil {
 		return err
@@ -103,8 +221,7 @@ func TestAddApi(t *testing.T) {
 		Func: func(arg string) (string, error) {
 			return "", errors.New("error")
 		},
-		GasRule:     types.NewStaticGasRule(1),
-		HostContext: &mockedHostContext{},
+		GasRule: types.NewStaticGasRule(1),
 	})
 	if err != nil {
 		return
@@ -128,7 +245,7 @@ func TestCallEmptyStr(t *testing.T) {
 		return
 	}
 
-	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 
 	{
@@ -151,7 +268,7 @@ func TestInfiniteLoop(t *testing.T) {
 		return
 	}
 
-	wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 
 	_, leftover, err := wasmTimeRuntime.Call("infiniteLoop", math.MaxInt64)
@@ -171,7 +288,7 @@ func TestFib(t *testing.T) {
 		return
 	}
 
-	wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 
 	_, leftover, err := wasmTimeRuntime.Call("fib", math.MaxInt64, uint64(math.MaxInt32), uint64(math.MaxInt32))
@@ -198,7 +315,7 @@ func TestCallNormal(t *testing.T) {
 		return
 	}
 
-	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 
 	{
@@ -232,7 +349,7 @@ func TestCallMultiArgs(t *testing.T) {
 		return
 	}
 
-	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 
 	{
@@ -263,7 +380,7 @@ func TestBytesNormal(t *testing.T) {
 		err             error
 	)
 
-	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 	res, leftover, err := wasmTimeRuntime.Call("testBytes", math.MaxInt64, arg)
 	fmt.Println(leftover)
@@ -291,7 +408,7 @@ func TestCallHostApiNoReturn(t *testing.T) {
 		err             error
 	)
 
-	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 	res, leftover, err := wasmTimeRuntime.Call("greet3", math.MaxInt64, arg)
 	fmt.Println(leftover)
@@ -320,7 +437,7 @@ func TestBytesNil(t *testing.T) {
 		err             error
 	)
 
-	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 	res, leftover, err := wasmTimeRuntime.Call("testBytes", math.MaxInt64, arg)
 	fmt.Println(leftover)
@@ -351,7 +468,7 @@ func TestLongString(t *testing.T) {
 		return
 	}
 
-	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WASM, raw, hostApis)
+	wasmTimeRuntime, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
 	require.Equal(t, nil, err)
 
 	{
@@ -365,3 +482,1240 @@ func TestLongString(t *testing.T) {
 	}
 	wasmTimeRuntime.Destroy() // to destroy the rt, in case of memory leak
 }
+
+// Test Case: gas profiling attributes all the gas used to functions and host apis
+func TestGasProfile(t *testing.T) {
+	requireWASMTime(t)
+
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+
+	plainRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+	require.Equal(t, nil, err)
+	_, plainLeftover, err := plainRuntime.Call("greet", types.MaxGas, "abcd")
+	require.Equal(t, nil, err)
+	require.Nil(t, plainRuntime.GasProfile())
+	plainRuntime.Destroy()
+
+	wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithProfiling())
+	require.Equal(t, nil, err)
+
+	res, leftover, err := wasmTimeRuntime.Call("greet", types.MaxGas, "abcd")
+	require.Equal(t, nil, err)
+	require.Equal(t, "hello-greet-abcd-hello-greet", res.(string))
+	// profiling must not change the gas usage
+	require.Equal(t, plainLeftover, leftover)
+
+	profile := wasmTimeRuntime.GasProfile()
+	require.NotNil(t, profile)
+	require.Equal(t, "greet", profile.Method)
+
+	attributed := profile.Unattributed
+	functions := make(map[string]types.FunctionGas)
+	for _, fn := range profile.Functions {
+		functions[fn.Name] = fn
+		attributed += fn.SelfGas
+		require.GreaterOrEqual(t, fn.TotalGas, fn.SelfGas)
+	}
+	require.Equal(t, int64(1), functions["runtime_test/greet"].Calls)
+	require.Equal(t, int64(1), functions["~start"].Calls)
+
+	require.Len(t, profile.HostAPIs, 1)
+	require.Equal(t, "runtime_test:test.hello", profile.HostAPIs[0].Name())
+	require.Equal(t, int64(1), profile.HostAPIs[0].Calls)
+	require.Greater(t, profile.HostAPIs[0].Gas, int64(0))
+	attributed += profile.HostAPIs[0].Gas
+
+	require.Equal(t, profile.GasUsed, attributed)
+	require.Equal(t, int64(0), profile.Unattributed)
+
+	var buf bytes.Buffer
+	require.Equal(t, nil, profile.WritePprof(&buf))
+	parsed, err := pprof.Parse(&buf)
+	require.Equal(t, nil, err)
+	require.Equal(t, len(profile.Functions)+len(profile.HostAPIs), len(parsed.Sample))
+
+	wasmTimeRuntime.Destroy()
+}
+
+type meteredHostContext struct {
+	vmCtx types.VMContext
+}
+
+func (m *meteredHostContext) SetVMContext(vmCtx types.VMContext) {
+	m.vmCtx = vmCtx
+}
+
+// Test Case: host apis charge gas with the gas meter shared with the vm
+func TestHostAPIGasMeter(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	call := func(hostGas int64) (int64, error) {
+		hostCtx := &meteredHostContext{}
+		hostApis := types.NewHostAPIRegistry(hostCtx, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+		err := hostApis.AddAPI("runtime_test", "test", "hello", &types.HostFuncWithGasRule{
+			Func: func(arg string) (string, error) {
+				if err := hostCtx.vmCtx.GasMeter().ConsumeGas(types.EVMGasToWASMGas(hostGas)); err != nil {
+					return "", err
+				}
+				return "hello-" + arg + "-hello", nil
+			},
+			GasRule: types.NewStaticGasRule(1),
+		})
+		require.Equal(t, nil, err)
+
+		wasmTimeRuntime, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+		require.Equal(t, nil, err)
+		defer wasmTimeRuntime.Destroy()
+
+		_, leftover, err := wasmTimeRuntime.Call("greet", 100000, "abcd")
+		return leftover, err
+	}
+
+	free, err := call(0)
+	require.Equal(t, nil, err)
+	charged, err := call(1000)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(1000), free-charged)
+
+	_, err = call(1000000)
+	require.NotNil(t, err)
+}
+
+// Test Case: both gas metering modes charge the same code deterministically
+func TestGasMeteringConformance(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	type testCall struct {
+		method string
+		args   []interface{}
+		result interface{}
+	}
+	calls := []testCall{
+		{"greet", []interface{}{"abcd"}, "hello-greet-abcd-hello-greet"},
+		{"greet2", []interface{}{"bonjour", "2", "5"}, "bonjour-25-over"},
+		{"testBytes", []interface{}{[]byte{0x1, 0x2, 0x3, 0x4}}, []byte{0x2, 0x3, 0x4, 0x5}},
+		{"testIncrease", nil, "10"},
+	}
+
+	custom := WithInstrumentation(&instrument.Config{DefaultCost: 2, CallCost: 10, MemoryPageCost: 100})
+	for _, opts := range supportedOptions(nil, []Option{WithFuelMetering()}, []Option{custom}) {
+		pool := NewRuntimePool(context.Background(), &mockedLogger{}, 10)
+		for _, c := range calls {
+			leftovers := make([]int64, 0, 3)
+			for i := 0; i < 3; i++ {
+				hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+				require.Equal(t, nil, addApis(t, hostApis))
+
+				// the first run creates a new runtime, the others reuse the pooled one
+				key, rt, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis, opts...)
+				require.Equal(t, nil, err)
+
+				res, leftover, err := rt.Call(c.method, 100000, c.args...)
+				require.Equal(t, nil, err)
+				require.Equal(t, c.result, res)
+				leftovers = append(leftovers, leftover)
+
+				pool.Return(key, rt)
+			}
+
+			require.Less(t, leftovers[0], int64(100000))
+			require.Equal(t, leftovers[0], leftovers[1], c.method)
+			require.Equal(t, leftovers[0], leftovers[2], c.method)
+		}
+	}
+
+	// all modes must stop endless code
+	for _, opts := range supportedOptions(nil, []Option{WithFuelMetering()}, []Option{custom}) {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+		_, leftover, err := rt.Call("infiniteLoop", 100000)
+		require.NotNil(t, err)
+		require.Equal(t, int64(0), leftover)
+		rt.Destroy()
+	}
+}
+
+// Test Case: bulk memory stays disabled with fuel metering, which would charge
+// memory.fill a flat cost regardless of its size
+func TestFuelBulkMemory(t *testing.T) {
+	requireWASMTime(t)
+
+	// add (func $fill (memory.fill (i32.const 0) (i32.const 0) (i32.const 65536)))
+	f := newFixture(t)
+	f.addFunc("fill", instrument.FuncType{}, 0x41, 0, 0x41, 0, 0x41, 0x80, 0x80, 0x04, 0xfc, 0x0b, 0x00, 0x0b)
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	_, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, f.code(), hostApis, WithFuelMetering())
+	require.NotNil(t, err)
+}
+
+// Test Case: the gas of the custom instrumentation follows the configured costs
+func TestCustomInstrumentation(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	gasUsed := func(config *instrument.Config, opts ...Option) int64 {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		opts = append(opts, WithInstrumentation(config))
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+		defer rt.Destroy()
+
+		res, leftover, err := rt.Call("testIncrease", 1000000)
+		require.Equal(t, nil, err)
+		require.Equal(t, "10", res)
+		return 1000000 - leftover
+	}
+
+	// host apis of the test registry are free, so the wasm cost scales with the opcode cost
+	base := gasUsed(&instrument.Config{DefaultCost: 1000})
+	require.Equal(t, 2*base, gasUsed(&instrument.Config{DefaultCost: 2000}))
+	require.Less(t, base, gasUsed(&instrument.Config{DefaultCost: 1000, CallCost: 1000}))
+
+	// profiling does not change the gas usage of the custom instrumentation
+	if testRuntime == WASM {
+		require.Equal(t, base, gasUsed(&instrument.Config{DefaultCost: 1000}, WithProfiling()))
+	}
+
+	// runtimes with different pricing are not shared in the pool
+	cheap := newRuntimeConfig([]Option{WithInstrumentation(&instrument.Config{DefaultCost: 1})})
+	expensive := newRuntimeConfig([]Option{WithInstrumentation(&instrument.Config{DefaultCost: 2})})
+	require.NotEqual(t, hashOfRuntimeArgs(WASM, cheap, raw), hashOfRuntimeArgs(WASM, expensive, raw))
+	require.NotEqual(t, hashOfRuntimeArgs(WASM, cheap, raw), hashOfRuntimeArgs(WASM, newRuntimeConfig(nil), raw))
+}
+
+// Test Case: deep recursion fails deterministically with a stack overflow
+func TestStackOverflow(t *testing.T) {
+	// add an endless recursion (func $recurse (result i32) call $recurse)
+	f := newFixture(t)
+	recurse := f.ImportedFuncs() + uint32(len(f.Functions))
+	f.addFunc("recurse", instrument.FuncType{Results: []byte{instrument.ValueI32}}, 0x10, byte(recurse), 0x0b)
+
+	// and a recursion keeping a wide operand stack alive across the call
+	//   (func $wide (param i64) (result i64)
+	//     (i64.add (local.get 0) (i64.const 1)) ... (call $wide (local.get 0)) (i64.add) ...)
+	wide := recurse + 1
+	wideExpr := make([]byte, 0, 256)
+	for i := 0; i < 32; i++ {
+		wideExpr = append(wideExpr, 0x20, 0, 0x42, byte(i+1), 0x7c)
+	}
+	wideExpr = append(wideExpr, 0x20, 0, 0x10, byte(wide))
+	for i := 0; i < 32; i++ {
+		wideExpr = append(wideExpr, 0x7c)
+	}
+	wideExpr = append(wideExpr, 0x0b)
+	f.addFunc("wide", instrument.FuncType{Params: []byte{instrument.ValueI64}, Results: []byte{instrument.ValueI64}}, wideExpr...)
+	raw := f.code()
+
+	for _, opts := range supportedOptions(nil, []Option{WithFuelMetering()}) {
+		// without a limit, the recursion is stopped by the native stack
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+		_, _, err = rt.Call("recurse", types.MaxGas)
+		require.Equal(t, types.StackOverflowError, err)
+		res, _, err := rt.Call("greet", 1000000, "abcd")
+		require.Equal(t, nil, err)
+		require.Equal(t, "hello-greet-abcd-hello-greet", res)
+		rt.Destroy()
+
+		opts = append(opts, WithMaxStackHeight(instrument.DefaultMaxStackHeight))
+		pool := NewRuntimePool(context.Background(), &mockedLogger{}, 10)
+		leftovers := make([]int64, 0, 3)
+		for i := 0; i < 3; i++ {
+			hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+			require.Equal(t, nil, addApis(t, hostApis))
+
+			key, rt, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis, opts...)
+			require.Equal(t, nil, err)
+
+			_, leftover, err := rt.Call("recurse", 1000000)
+			require.Equal(t, types.StackOverflowError, err)
+			leftovers = append(leftovers, leftover)
+
+			// the runtime is still usable after the overflow
+			res, _, err := rt.Call("greet", 1000000, "abcd")
+			require.Equal(t, nil, err)
+			require.Equal(t, "hello-greet-abcd-hello-greet", res)
+
+			pool.Return(key, rt)
+		}
+		require.Equal(t, leftovers[0], leftovers[1])
+		require.Equal(t, leftovers[0], leftovers[2])
+
+		// a lower limit stops the recursion earlier
+		hostApis = types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+		rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis,
+			append(opts, WithMaxStackHeight(1024))...)
+		require.Equal(t, nil, err)
+		_, leftover, err := rt.Call("recurse", 1000000)
+		require.Equal(t, types.StackOverflowError, err)
+		require.Greater(t, leftover, leftovers[0])
+		rt.Destroy()
+	}
+
+	// the stack height limit is reached before the native stack overflows, even
+	// with the smallest max wasm stack accepted for the limit
+	height := uint32(types.DefaultRuntimeOptions.MaxWasmStack / types.StackBytesPerHeight)
+	for _, opts := range supportedOptions(nil, []Option{WithFuelMetering()}, []Option{WithProfiling()}) {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis,
+			append(opts, WithMaxStackHeight(height))...)
+		require.Equal(t, nil, err)
+
+		_, _, err = rt.Call("recurse", types.MaxGas)
+		require.Equal(t, types.StackOverflowError, err)
+		_, _, err = rt.Call("wide", types.MaxGas, int64(1))
+		require.Equal(t, types.StackOverflowError, err)
+		rt.Destroy()
+	}
+}
+
+// Test Case: runtime options limit the resources of the runtime
+func TestRuntimeOptions(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	newRuntime := func(opts ...Option) (types.AspectRuntime, error) {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+		return NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+	}
+
+	// the deprecated constant follows the default
+	require.Equal(t, int64(wasmtime.MaxMemorySize), types.DefaultRuntimeOptions.MaxMemorySize)
+
+	for _, options := range []RuntimeOptions{
+		{MaxMemorySize: 1000},
+		{MaxTables: -2},
+		{MaxWasmStack: 64 * 1024 * 1024},
+	} {
+		_, err := newRuntime(WithRuntimeOptions(options))
+		require.NotNil(t, err, options)
+	}
+
+	// the max wasm stack must fit the stack height limit
+	_, err := newRuntime(WithRuntimeOptions(RuntimeOptions{MaxWasmStack: 1024}),
+		WithMaxStackHeight(instrument.DefaultMaxStackHeight))
+	require.NotNil(t, err)
+
+	// 1MB of input does not fit in 1MB of memory
+	input := make([]byte, 1024*1024)
+	rt, err := newRuntime(WithRuntimeOptions(RuntimeOptions{MaxMemorySize: 1024 * 1024}))
+	require.Equal(t, nil, err)
+	_, _, err = rt.Call("testBytes", types.MaxGas, input)
+	require.NotNil(t, err)
+	rt.Destroy()
+
+	rt, err = newRuntime()
+	require.Equal(t, nil, err)
+	res, _, err := rt.Call("testBytes", types.MaxGas, input)
+	require.Equal(t, nil, err)
+	require.Equal(t, len(input), len(res.([]byte)))
+	rt.Destroy()
+
+	// the options of the pool apply to all its runtimes
+	pool := NewRuntimePool(context.Background(), &mockedLogger{}, 10,
+		WithRuntimeOptions(RuntimeOptions{MaxMemorySize: 1024 * 1024}))
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	key, rt, err := pool.Runtime(context.Background(), testRuntime, raw, hostApis)
+	require.Equal(t, nil, err)
+	_, _, err = rt.Call("testBytes", types.MaxGas, input)
+	require.NotNil(t, err)
+	pool.Return(key, rt)
+}
+
+// Test Case: calls are stopped once the context is done or the runtime is interrupted
+func TestInterrupt(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	newRuntime := func(ctx context.Context, opts ...Option) types.AspectRuntime {
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+		require.Equal(t, nil, addApis(t, hostApis))
+		rt, err := NewAspectRuntime(ctx, &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+		return rt
+	}
+
+	for _, opts := range supportedOptions(nil, []Option{WithFuelMetering()}) {
+		// deadline of the context
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		rt := newRuntime(ctx, opts...)
+		start := time.Now()
+		_, _, err := rt.Call("infiniteLoop", types.MaxGas)
+		require.Equal(t, types.DeadlineExceededError, err)
+		require.Less(t, time.Since(start), 5*time.Second)
+		cancel()
+		rt.Destroy()
+
+		if !interruptsRunningCalls() {
+			continue
+		}
+
+		// cancellation of the context
+		ctx, cancel = context.WithCancel(context.Background())
+		rt = newRuntime(ctx, opts...)
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, _, err = rt.Call("infiniteLoop", types.MaxGas)
+		require.Equal(t, types.InterruptedError, err)
+
+		// the context stays done
+		_, leftover, err := rt.Call("greet", 1000000, "abcd")
+		require.Equal(t, types.InterruptedError, err)
+		require.Equal(t, int64(1000000), leftover)
+		rt.Destroy()
+
+		// explicit interruption, the runtime is usable afterwards
+		rt = newRuntime(context.Background(), opts...)
+		time.AfterFunc(50*time.Millisecond, rt.Interrupt)
+		_, _, err = rt.Call("infiniteLoop", types.MaxGas)
+		require.Equal(t, types.InterruptedError, err)
+
+		res, _, err := rt.Call("greet", 1000000, "abcd")
+		require.Equal(t, nil, err)
+		require.Equal(t, "hello-greet-abcd-hello-greet", res)
+		rt.Destroy()
+	}
+
+	// a done context fails the creation of the runtime
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	_, err := NewAspectRuntime(ctx, &mockedLogger{}, testRuntime, raw, hostApis)
+	require.Equal(t, types.InterruptedError, err)
+}
+
+// Test Case: the failures of the runtime are typed errors
+func TestErrors(t *testing.T) {
+	// add a division by zero (func $divide (result i32) (i32.div_s (i32.const 1) (i32.const 0)))
+	f := newFixture(t)
+	divide := f.addFunc("divide", instrument.FuncType{Results: []byte{instrument.ValueI32}}, 0x41, 1, 0x41, 0, 0x6d, 0x0b)
+	raw := f.code()
+
+	hostErr := errors.New("host failure")
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	require.Equal(t, nil, hostApis.AddAPI("runtime_test", "test", "hello", &types.HostFuncWithGasRule{
+		Func: func(arg string) (string, error) {
+			return "", hostErr
+		},
+		GasRule: types.NewStaticGasRule(1),
+	}))
+
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+	require.Equal(t, nil, err)
+	defer rt.Destroy()
+
+	_, _, err = rt.Call("notExist", 1000000)
+	require.True(t, errors.Is(err, types.MethodNotFoundError), err)
+
+	_, _, err = rt.Call("greet", 1000000, "abcd")
+	var apiErr *types.HostAPIError
+	require.True(t, errors.As(err, &apiErr), err)
+	require.Equal(t, types.MethodName("hello"), apiErr.Method)
+	require.True(t, errors.Is(err, hostErr))
+
+	_, _, err = rt.Call("divide", 1000000)
+	var trapErr *types.TrapError
+	require.True(t, errors.As(err, &trapErr), err)
+	require.Equal(t, types.TrapIntegerDivisionByZero, trapErr.Code)
+	require.Equal(t, "integer divide by zero", trapErr.Message)
+	if testRuntime == WASM {
+		// the function carries no name in the name section, it is named after the export
+		require.Equal(t, 1, len(trapErr.Backtrace))
+		require.Equal(t, types.Frame{FuncIndex: divide, FuncName: "divide", ModuleOffset: trapErr.Backtrace[0].ModuleOffset},
+			trapErr.Backtrace[0])
+		require.Contains(t, trapErr.Backtrace.String(), "0: divide (func[")
+	}
+
+	_, _, err = rt.Call("greet", 1000000, 1.5)
+	require.True(t, errors.Is(err, types.UnsupportedTypeError), err)
+
+	_, _, err = rt.Call("infiniteLoop", 1)
+	require.True(t, errors.Is(err, types.OutOfGasError), err)
+
+	// the imports of the module are not registered
+	pool := NewRuntimePool(context.Background(), &mockedLogger{}, 10)
+	_, _, err = pool.Runtime(context.Background(), testRuntime, raw, types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap))
+	var instErr *types.InstantiationError
+	require.True(t, errors.As(err, &instErr), err)
+}
+
+// Test Case: abort stops the call with the message and the location
+func TestAbort(t *testing.T) {
+	f := newFixture(t)
+	abort := f.funcIndex("abort")
+	require.Less(t, abort, uint32(1<<7))
+
+	// add (func $fail (param $ptr i32) (result i32)), which aborts with the
+	// string in the byte array argument, the file name is null
+	f.addFunc("fail", instrument.FuncType{Params: []byte{instrument.ValueI32}, Results: []byte{instrument.ValueI32}},
+		0x20, 0, 0x41, types.HeaderLen+4, 0x6a, // local.get 0, i32.const, i32.add
+		0x41, 0, 0x41, 12, 0x41, 34, // i32.const 0, i32.const 12, i32.const 34
+		0x10, byte(abort), 0x00, 0x0b, // call $abort, unreachable
+	)
+	raw := f.code()
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+	require.Equal(t, nil, err)
+	defer rt.Destroy()
+
+	// the size of the string in bytes, followed by the UTF-16 code units
+	message := "assertion failed ✓"
+	units := utf16.Encode([]rune(message))
+	arg := binary.LittleEndian.AppendUint32(nil, uint32(len(units)*2))
+	for _, unit := range units {
+		arg = binary.LittleEndian.AppendUint16(arg, unit)
+	}
+
+	_, _, err = rt.Call("fail", 1000000, arg)
+	var abortErr *types.AbortError
+	require.True(t, errors.As(err, &abortErr), err)
+	require.Equal(t, &types.AbortError{Message: message, Line: 12, Column: 34}, abortErr)
+
+	// the runtime is still usable after the abort
+	res, _, err := rt.Call("greet", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	require.Equal(t, "hello-greet-abcd-hello-greet", res)
+}
+
+// Test Case: traps are resolved to the original source with the source map
+func TestSourceMap(t *testing.T) {
+	requireWASMTime(t)
+
+	// add a division by zero (func $divide (result i32) (i32.div_s (i32.const 1) (i32.const 0)))
+	f := newFixture(t)
+	f.addFunc("divide", instrument.FuncType{Results: []byte{instrument.ValueI32}}, 0x41, 1, 0x41, 0, 0x6d, 0x0b)
+	raw := f.code()
+
+	// map the offset of i32.div_s to assembly/index.ts:10:5
+	m, err := instrument.DecodeModule(raw)
+	require.Equal(t, nil, err)
+	divOffset := m.Codes[len(m.Codes)-1].Offset + 4
+	var mappings []byte
+	for _, value := range []int{divOffset, 0, 9, 4} {
+		for v := value << 1; ; {
+			digit := v & 0x1f
+			if v >>= 5; v > 0 {
+				digit |= 0x20
+			}
+			mappings = append(mappings, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"[digit])
+			if v == 0 {
+				break
+			}
+		}
+	}
+	sourceMap := `{"version":3,"sources":["assembly/index.ts"],"names":[],"mappings":"` + string(mappings) + `"}`
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis,
+		WithSourceMap([]byte(sourceMap)))
+	require.Equal(t, nil, err)
+	defer rt.Destroy()
+
+	_, _, err = rt.Call("divide", 1000000)
+	var trapErr *types.TrapError
+	require.True(t, errors.As(err, &trapErr), err)
+	require.Equal(t, &types.SourcePosition{File: "assembly/index.ts", Line: 10, Column: 5}, trapErr.Backtrace.Source())
+	require.Contains(t, err.Error(), "at assembly/index.ts:10:5")
+
+	// an invalid source map fails the creation of the runtime
+	_, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithSourceMap([]byte("{}")))
+	require.NotNil(t, err)
+}
+
+func TestCallWithResult(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+
+	for _, opts := range supportedOptions(nil, []Option{WithSnapshotReset()}) {
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+
+		_, leftover, err := rt.Call("greet", 1000000, "abcd")
+		require.Equal(t, nil, err)
+		require.Equal(t, nil, rt.ResetStore(context.Background(), hostApis))
+
+		result, err := rt.CallWithResult("greet", 1000000, "abcd")
+		require.Equal(t, nil, err)
+		require.Equal(t, "hello-greet-abcd-hello-greet", result.Value)
+		require.Equal(t, leftover, result.GasLeft)
+		require.Equal(t, int64(1000000), result.GasUsed+result.GasLeft)
+		require.Equal(t, types.EVMGasToWASMGas(1000000), result.WASMGasUsed+result.WASMGasLeft)
+		require.Equal(t, result.GasLeft, types.WASMGasToEVMGas(result.WASMGasLeft))
+		require.Equal(t, map[string]int64{"runtime_test:test.hello": 1}, result.HostCalls)
+		require.Greater(t, result.PeakMemory, int64(0))
+		require.Equal(t, int64(0), result.PeakMemory%65536)
+		require.Greater(t, result.ExecDuration, time.Duration(0))
+		// the start function is skipped when the instance is restored from the snapshot
+		require.Equal(t, opts == nil, result.Initialized)
+
+		// the statistics are returned with the error
+		result, err = rt.CallWithResult("infiniteLoop", 1000)
+		require.True(t, errors.Is(err, types.OutOfGasError))
+		require.Nil(t, result.Value)
+		require.Equal(t, int64(1000), result.GasUsed)
+		require.Equal(t, int64(0), result.GasLeft)
+
+		rt.Destroy()
+	}
+}
+
+func TestCallBatch(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+	require.Equal(t, nil, err)
+	defer rt.Destroy()
+
+	calls := []types.BatchCall{
+		{Method: "testIncrease", Gas: 1000000},
+		{Method: "greet", Args: []interface{}{"abcd"}, Gas: 1000000},
+		{Method: "testIncrease", Gas: 1000000},
+	}
+
+	// the calls share the state of one instance
+	results, err := rt.CallBatch(&types.Batch{Calls: calls, Gas: 1000000})
+	require.Equal(t, nil, err)
+	require.Len(t, results, 3)
+	require.Equal(t, "10", results[0].Value)
+	require.Equal(t, "hello-greet-abcd-hello-greet", results[1].Value)
+	require.Equal(t, "20", results[2].Value)
+	require.True(t, results[0].Initialized)
+	require.False(t, results[1].Initialized)
+	require.Equal(t, int64(1), results[1].HostCalls["runtime_test:test.hello"])
+
+	// the shared gas is used by all the calls
+	for i := 1; i < len(results); i++ {
+		require.Equal(t, results[i-1].WASMGasLeft, results[i].WASMGasUsed+results[i].WASMGasLeft)
+	}
+	require.Equal(t, types.EVMGasToWASMGas(1000000), results[0].WASMGasUsed+results[0].WASMGasLeft)
+
+	// each call has its own gas
+	require.Equal(t, nil, rt.ResetStore(context.Background(), hostApis))
+	results, err = rt.CallBatch(&types.Batch{Calls: calls, Budget: types.PerCallGas})
+	require.Equal(t, nil, err)
+	for i, result := range results {
+		require.Equal(t, calls[i].Gas, result.GasUsed+result.GasLeft)
+	}
+	require.Equal(t, "10", results[0].Value)
+
+	failing := []types.BatchCall{
+		{Method: "testIncrease", Gas: 1000000},
+		{Method: "infiniteLoop", Gas: 1000},
+		{Method: "testIncrease", Gas: 1000000},
+	}
+
+	// the batch stops on the first failure
+	require.Equal(t, nil, rt.ResetStore(context.Background(), hostApis))
+	results, err = rt.CallBatch(&types.Batch{Calls: failing, Budget: types.PerCallGas})
+	require.True(t, errors.Is(err, types.OutOfGasError))
+	require.Len(t, results, 2)
+	require.True(t, errors.Is(results[1].Err, types.OutOfGasError))
+
+	// or goes on with the next calls
+	require.Equal(t, nil, rt.ResetStore(context.Background(), hostApis))
+	results, err = rt.CallBatch(&types.Batch{Calls: failing, Budget: types.PerCallGas, OnFailure: types.ContinueOnFailure})
+	require.True(t, errors.Is(err, types.OutOfGasError))
+	require.Len(t, results, 3)
+	require.Equal(t, nil, results[2].Err)
+	require.Equal(t, "20", results[2].Value)
+
+	// unless the shared gas has run out
+	require.Equal(t, nil, rt.ResetStore(context.Background(), hostApis))
+	results, err = rt.CallBatch(&types.Batch{Calls: failing, Gas: 1000000, OnFailure: types.ContinueOnFailure})
+	require.True(t, errors.Is(err, types.OutOfGasError))
+	require.Len(t, results, 2)
+}
+
+func TestNativeValues(t *testing.T) {
+	// add (func $add64 (param i64 i64) (result i64) (i64.add (local.get 0) (local.get 1)))
+	f := newFixture(t)
+	f.addFunc("add64", instrument.FuncType{
+		Params:  []byte{instrument.ValueI64, instrument.ValueI64},
+		Results: []byte{instrument.ValueI64},
+	}, 0x20, 0, 0x20, 1, 0x7c, 0x0b)
+	// add (func $extend (param i32) (result i64) (i64.extend_i32_u (local.get 0)))
+	f.addFunc("extend", instrument.FuncType{
+		Params:  []byte{instrument.ValueI32},
+		Results: []byte{instrument.ValueI64},
+	}, 0x20, 0, 0xad, 0x0b)
+	// add (func $id (param i32) (result i32) (local.get 0))
+	f.addFunc("id", instrument.FuncType{
+		Params:  []byte{instrument.ValueI32},
+		Results: []byte{instrument.ValueI32},
+	}, 0x20, 0, 0x0b)
+	raw := f.code()
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+	require.Equal(t, nil, err)
+	defer rt.Destroy()
+
+	// go int is passed as a native i32, and void methods return nil
+	res, _, err := rt.Call("fib", 1000000, 10, 10)
+	require.Equal(t, nil, err)
+	require.Nil(t, res)
+
+	res, _, err = rt.Call("add64", 1000000, int64(1)<<40, 2)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(1)<<40+2, res)
+
+	// the header protocol is still used for pointers
+	res, _, err = rt.Call("greet", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	require.Equal(t, "hello-greet-abcd-hello-greet", res)
+
+	// only go int is passed natively to i32 parameters, int32 is marshaled
+	// and passed as the pointer to the header encoded value
+	res, _, err = rt.Call("extend", 1000000, 5)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(5), res)
+	res, _, err = rt.Call("extend", 1000000, int32(5))
+	require.Equal(t, nil, err)
+	require.NotEqual(t, int64(5), res)
+	res, _, err = rt.Call("id", 1000000, int32(5))
+	require.Equal(t, nil, err)
+	require.Equal(t, int32(5), res)
+
+	_, _, err = rt.Call("add64", 1000000, "abcd", 2)
+	require.True(t, errors.Is(err, types.UnsupportedTypeError))
+	_, _, err = rt.Call("add64", 1000000, 1)
+	require.NotNil(t, err)
+
+	// the i32 results of the methods listed by the ABI are native values
+	abi := types.DefaultABI
+	abi.NativeResults = []string{"id"}
+	native, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithGuestABI(abi))
+	require.Equal(t, nil, err)
+	defer native.Destroy()
+	for _, v := range []int{0, 5, -1} {
+		res, _, err = native.Call("id", 1000000, v)
+		require.Equal(t, nil, err)
+		require.Equal(t, int32(v), res)
+	}
+	res, _, err = native.Call("greet", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	require.Equal(t, "hello-greet-abcd-hello-greet", res)
+}
+
+func TestMultiValue(t *testing.T) {
+	f := newFixture(t)
+	testIncrease := f.funcIndex("testIncrease")
+	require.Less(t, testIncrease, uint32(0x80))
+
+	// add (func $multi (result i32 i64 i32 f64)
+	//   (call $testIncrease) (i64.const 7) (i32.const 0) (f64.const 0.5))
+	f.addFunc("multi", instrument.FuncType{
+		Results: []byte{instrument.ValueI32, instrument.ValueI64, instrument.ValueI32, instrument.ValueF64},
+	},
+		0x10, byte(testIncrease),
+		0x42, 7,
+		0x41, 0,
+		0x44, 0, 0, 0, 0, 0, 0, 0xe0, 0x3f,
+		0x0b,
+	)
+	raw := f.code()
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+
+	// the default instrumentation does not support multi-value functions
+	for _, opts := range supportedOptions([]Option{WithFuelMetering()}, []Option{WithInstrumentation(&instrument.Config{DefaultCost: 1000})}) {
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+
+		// pointers are read with the type header, null pointers are nil
+		res, _, err := rt.Call("multi", 1000000)
+		require.Equal(t, nil, err)
+		require.Equal(t, []interface{}{"10", int64(7), nil, 0.5}, res)
+		rt.Destroy()
+	}
+}
+
+func TestGuestABI(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+
+	// the arguments are allocated with __new and pinned during the call
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithGuestABI(types.AssemblyScriptABI))
+	require.Equal(t, nil, err)
+	calls := make([]types.BatchCall, 100)
+	for i := range calls {
+		calls[i] = types.BatchCall{Method: "greet2", Args: []interface{}{"bonjour", "2", "5"}}
+	}
+	results, err := rt.CallBatch(&types.Batch{Calls: calls, Gas: types.MaxGas})
+	require.Equal(t, nil, err)
+	require.Equal(t, "bonjour-25-over", results[len(results)-1].Value)
+	rt.Destroy()
+
+	abi := types.AssemblyScriptABI
+	abi.Pin = "pin"
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithGuestABI(abi))
+	require.Equal(t, nil, err)
+	_, _, err = rt.Call("greet", 1000000, "abcd")
+	require.NotNil(t, err)
+	rt.Destroy()
+
+	// add a deallocator counting the freed bytes
+	//   (global $freed (mut i64) (i64.const 0))
+	//   (func $free (param i32 i32) (global.set $freed (i64.add (global.get $freed) (i64.extend_i32_u (local.get 1)))))
+	//   (func $freed (result i64) (global.get $freed))
+	f := newFixture(t)
+	freed := f.addGlobal(instrument.ValueI64, 0x42, 0, 0x0b)
+	f.addFunc("free", instrument.FuncType{Params: []byte{instrument.ValueI32, instrument.ValueI32}},
+		0x23, byte(freed), 0x20, 1, 0xad, 0x7c, 0x24, byte(freed), 0x0b)
+	f.addFunc("freed", instrument.FuncType{Results: []byte{instrument.ValueI64}}, 0x23, byte(freed), 0x0b)
+
+	abi = types.DefaultABI
+	abi.Free = "free"
+	abi.FreeWithSize = true
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, f.code(), hostApis, WithGuestABI(abi))
+	require.Equal(t, nil, err)
+	defer rt.Destroy()
+
+	results, err = rt.CallBatch(&types.Batch{Calls: []types.BatchCall{
+		{Method: "greet2", Args: []interface{}{"bonjour", "2", "5"}},
+		{Method: "freed"},
+	}, Gas: types.MaxGas})
+	require.Equal(t, nil, err)
+	size := 0
+	for _, arg := range []string{"bonjour", "2", "5"} {
+		size += len(types.NewString().Marshal(arg))
+	}
+	require.Equal(t, int64(size), results[1].Value)
+
+	// add a deallocator clobbering the freed memory, and a method returning
+	// its argument, the result is read before the argument is freed
+	//   (func $free (param i32 i32) (i32.store (local.get 0) (i32.const -1)))
+	//   (func $echo (param i32) (result i32) (local.get 0))
+	f = newFixture(t)
+	f.addFunc("free", instrument.FuncType{Params: []byte{instrument.ValueI32, instrument.ValueI32}},
+		0x20, 0, 0x41, 0x7f, 0x36, 2, 0, 0x0b)
+	f.addFunc("echo", instrument.FuncType{Params: []byte{instrument.ValueI32}, Results: []byte{instrument.ValueI32}},
+		0x20, 0, 0x0b)
+	echo, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, f.code(), hostApis, WithGuestABI(abi))
+	require.Equal(t, nil, err)
+	res, leftover, err := echo.Call("echo", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	require.Equal(t, "abcd", res)
+	echo.Destroy()
+
+	// the deallocator is charged to the call
+	echo, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, f.code(), hostApis)
+	require.Equal(t, nil, err)
+	_, unfreed, err := echo.Call("echo", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	require.Less(t, leftover, unfreed)
+	echo.Destroy()
+
+	// the start function must be exported if the ABI names one
+	abi = types.DefaultABI
+	abi.Start = "missing"
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithGuestABI(abi))
+	require.Equal(t, nil, err)
+	_, _, err = rt.Call("greet", 1000000, "abcd")
+	require.True(t, errors.Is(err, types.MethodNotFoundError))
+	rt.Destroy()
+
+	// the allocator must be exported
+	abi = types.RustABI
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithGuestABI(abi))
+	require.Equal(t, nil, err)
+	_, _, err = rt.Call("greet", 1000000, "abcd")
+	require.NotNil(t, err)
+	rt.Destroy()
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	// add the hooks counting their runs in globals, and the getters of the counts
+	f := newFixture(t)
+	for _, name := range []string{"init", "pre_call", "post_call", "teardown"} {
+		g := f.addGlobal(instrument.ValueI64, 0x42, 0, 0x0b)
+		f.addFunc("__aspect_"+name+"__", instrument.FuncType{}, 0x23, byte(g), 0x42, 1, 0x7c, 0x24, byte(g), 0x0b)
+		f.addFunc(name, instrument.FuncType{Results: []byte{instrument.ValueI64}}, 0x23, byte(g), 0x0b)
+	}
+	raw := f.code()
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+
+	for _, opts := range supportedOptions(nil, []Option{WithSnapshotReset()}) {
+		snapshot := newRuntimeConfig(opts).Reset == types.SnapshotReset
+		logger := &countingLogger{counts: make(map[string]int)}
+		rt, err := NewAspectRuntime(context.Background(), logger, testRuntime, raw, hostApis, opts...)
+		require.Equal(t, nil, err)
+
+		_, leftover, err := rt.Call("greet", 1000000, "abcd")
+		require.Equal(t, nil, err)
+		_, _, err = rt.Call("greet", 1000000, "abcd")
+		require.Equal(t, nil, err)
+
+		// the init hook runs once per instance, the call hooks around each call
+		res, _, err := rt.Call("init", 1000000)
+		require.Equal(t, nil, err)
+		require.Equal(t, int64(1), res)
+		res, _, err = rt.Call("pre_call", 1000000)
+		require.Equal(t, nil, err)
+		require.Equal(t, int64(4), res)
+		res, _, err = rt.Call("post_call", 1000000)
+		require.Equal(t, nil, err)
+		require.Equal(t, int64(4), res)
+
+		// the init hook is charged to each new or restored instance, so the gas
+		// is the same after a reset
+		require.Equal(t, nil, rt.ResetStore(context.Background(), hostApis))
+		_, resetLeftover, err := rt.Call("greet", 1000000, "abcd")
+		require.Equal(t, nil, err)
+		require.Equal(t, leftover, resetLeftover)
+		res, _, err = rt.Call("init", 1000000)
+		require.Equal(t, nil, err)
+		require.Equal(t, int64(1), res)
+
+		// the teardown hook runs before each instance is dropped, the snapshot
+		// keeps the instance
+		rt.Destroy()
+		if snapshot {
+			require.Equal(t, 1, logger.count("aspect torn down"))
+		} else {
+			require.Equal(t, 2, logger.count("aspect torn down"))
+		}
+	}
+
+	// the call hooks are charged to the call
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+	require.Equal(t, nil, err)
+	_, leftover, err := rt.Call("greet", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	rt.Destroy()
+
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithLifecycle(types.Lifecycle{}))
+	require.Equal(t, nil, err)
+	_, plainLeftover, err := rt.Call("greet", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	require.Less(t, leftover, plainLeftover)
+	res, _, err := rt.Call("init", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(0), res)
+	rt.Destroy()
+
+	// the init hook is charged to the call initializing the instance
+	lifecycle := types.DefaultLifecycle
+	lifecycle.Init = types.LifecycleHook{}
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithLifecycle(lifecycle))
+	require.Equal(t, nil, err)
+	_, noInitLeftover, err := rt.Call("greet", 1000000, "abcd")
+	require.Equal(t, nil, err)
+	require.Less(t, leftover, noInitLeftover)
+	rt.Destroy()
+
+	// a hook fails the call once its own budget is used up
+	lifecycle = types.DefaultLifecycle
+	lifecycle.PreCall.Gas = 0
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis, WithLifecycle(lifecycle))
+	require.Equal(t, nil, err)
+	_, leftover, err = rt.Call("greet", 1000000, "abcd")
+	require.True(t, errors.Is(err, types.OutOfGasError))
+	require.Greater(t, leftover, int64(0))
+	rt.Destroy()
+}
+
+// wasiTestModule calls the wasi functions, the results are returned as i64
+// so that they are not read as pointers
+const wasiTestModule = `(module
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "random_get" (func $random_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "clock_time_get" (func $clock_time_get (param i32 i64 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "path_open" (func $path_open (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $args_sizes_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (param i32)))
+  (memory (export "memory") 3)
+  (data (i32.const 0) "\10\00\00\00\0b\00\00\00")
+  (data (i32.const 16) "hello wasi\n")
+  (func (export "hello") (result i64)
+    (i64.extend_i32_u (i32.add
+      (i32.mul (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)) (i32.const 1000))
+      (i32.load (i32.const 8)))))
+  (func (export "iovs") (result i64)
+    (i64.extend_i32_u (call $fd_write (i32.const 1) (i32.const 0) (i32.const 0x20000001) (i32.const 8))))
+  (func (export "long") (result i64)
+    (i32.store (i32.const 64) (i32.const 0))
+    (i32.store (i32.const 68) (i32.const 0x20000))
+    (drop (call $fd_write (i32.const 1) (i32.const 64) (i32.const 1) (i32.const 72)))
+    (i64.load32_u (i32.const 72)))
+  (func (export "random") (result i64)
+    (drop (call $random_get (i32.const 32) (i32.const 8)))
+    (i64.load (i32.const 32)))
+  (func (export "clock") (result i64)
+    (drop (call $clock_time_get (i32.const 0) (i64.const 1) (i32.const 40)))
+    (i64.load (i32.const 40)))
+  (func (export "open") (result i64)
+    (i64.extend_i32_u (call $path_open (i32.const 3) (i32.const 0) (i32.const 16) (i32.const 5)
+      (i32.const 0) (i64.const 0) (i64.const 0) (i32.const 0) (i32.const 48))))
+  (func (export "args") (result i64)
+    (drop (call $args_sizes_get (i32.const 56) (i32.const 60)))
+    (i64.load (i32.const 56)))
+  (func (export "exit") (call $proc_exit (i32.const 3)))
+  (func (export "__aspect_start__")))`
+
+func TestWASI(t *testing.T) {
+	requireWASMTime(t)
+
+	raw, err := wasmtimego.Wat2Wasm(wasiTestModule)
+	require.Equal(t, nil, err)
+
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wasmtime.Wrap)
+
+	// wasi is opt-in
+	_, err = NewAspectRuntime(context.Background(), &mockedLogger{}, testRuntime, raw, hostApis)
+	require.NotNil(t, err)
+
+	wasi := types.DefaultWASIConfig
+	wasi.Args = []string{"a", "bc"}
+	newRuntime := func(seed types.WASISeed, logger types.Logger) types.AspectRuntime {
+		ctx := types.ContextWithWASISeed(context.Background(), seed)
+		rt, err := NewAspectRuntime(ctx, logger, testRuntime, raw, hostApis, WithWASI(wasi))
+		require.Equal(t, nil, err)
+		return rt
+	}
+
+	seed := types.WASISeed{Time: 1700000000000000000, Random: []byte("block hash")}
+	logger := &countingLogger{counts: make(map[string]int)}
+	rt := newRuntime(seed, logger)
+	defer rt.Destroy()
+
+	// stdout goes to the logger
+	res, _, err := rt.Call("hello", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(11), res)
+	require.Equal(t, 1, logger.count("aspect output"))
+
+	// too many io vectors fail the write, and long writes are short
+	res, _, err = rt.Call("iovs", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(28), res)
+	res, _, err = rt.Call("long", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(64*1024), res)
+	require.Equal(t, 2, logger.count("aspect output"))
+
+	// the output is charged before it is written
+	_, _, err = rt.Call("long", 100)
+	require.True(t, errors.Is(err, types.OutOfGasError))
+	require.Equal(t, 2, logger.count("aspect output"))
+
+	// the clocks and the random bytes are the same for each call with the same seed
+	random, _, err := rt.Call("random", 1000000)
+	require.Equal(t, nil, err)
+	res, _, err = rt.Call("random", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, random, res)
+
+	other := newRuntime(types.WASISeed{Time: seed.Time, Random: []byte("other hash")}, &mockedLogger{})
+	res, _, err = other.Call("random", 1000000)
+	require.Equal(t, nil, err)
+	require.NotEqual(t, random, res)
+	other.Destroy()
+
+	res, _, err = rt.Call("clock", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, seed.Time+1, res)
+
+	// the filesystem is denied with ENOTCAPABLE
+	res, _, err = rt.Call("open", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(76), res)
+
+	res, _, err = rt.Call("args", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(2)|int64(5)<<32, res)
+
+	_, _, err = rt.Call("exit", 1000000)
+	var exitErr *types.ExitError
+	require.True(t, errors.As(err, &exitErr))
+	require.Equal(t, int32(3), exitErr.Code)
+
+	// the output is charged per byte
+	wasi.ByteCost = 0
+	free := newRuntime(seed, &mockedLogger{})
+	freeResult, err := free.CallWithResult("hello", 1000000)
+	require.Equal(t, nil, err)
+	free.Destroy()
+	result, err := rt.CallWithResult("hello", 1000000)
+	require.Equal(t, nil, err)
+	require.Equal(t, freeResult.WASMGasUsed+11*types.DefaultWASIConfig.ByteCost, result.WASMGasUsed)
+}
+
+// Test Case: both engines reject a module over the table limits before it is instantiated
+func TestTableLimits(t *testing.T) {
+	f := newFixture(t)
+	f.Tables = append(f.Tables, instrument.Table{ElemType: 0x70, Min: 100 * 1024})
+	raw := f.code()
+
+	for _, runtimeType := range []RuntimeType{WASM, WAZERO} {
+		wrapper := wasmtime.Wrap
+		if runtimeType == WAZERO {
+			wrapper = wazero.Wrap
+		}
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wrapper)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		_, err := NewAspectRuntime(context.Background(), &mockedLogger{}, runtimeType, raw, hostApis,
+			WithRuntimeOptions(types.RuntimeOptions{MaxTableElements: 100*1024 - 1}))
+		var instErr *types.InstantiationError
+		require.True(t, errors.As(err, &instErr), "%v: %v", runtimeType, err)
+
+		// the tables are unlimited by default
+		for _, opts := range [][]Option{
+			{WithRuntimeOptions(types.RuntimeOptions{MaxTableElements: 100 * 1024})},
+			nil,
+		} {
+			rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, runtimeType, raw, hostApis, opts...)
+			require.Equal(t, nil, err)
+			res, _, err := rt.Call("testIncrease", types.MaxGas)
+			require.Equal(t, nil, err)
+			require.Equal(t, "10", res)
+			rt.Destroy()
+		}
+	}
+}
+
+// Test Case: without the wasmtime binding, the default schedule is unavailable
+// and a custom schedule charges other gas, see TestWazeroConformance for the gas
+// of the default schedule on wazero, which needs the binding.
+func TestNoBuiltinInstrumentation(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wazero.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+
+	rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, WAZERO, raw, hostApis)
+	require.Equal(t, nil, err)
+	_, defaultLeftover, err := rt.Call("testIncrease", 100000)
+	require.Equal(t, nil, err)
+	rt.Destroy()
+
+	// the build without cgo
+	isolateCaches(t)
+	builtin, version := builtinInstrument, builtinInstrumentVersion
+	builtinInstrument, builtinInstrumentVersion = nil, ""
+	defer func() {
+		builtinInstrument, builtinInstrumentVersion = builtin, version
+	}()
+
+	_, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WAZERO, raw, hostApis)
+	require.True(t, errors.Is(err, types.BuiltinInstrumentationError))
+
+	rt, err = NewAspectRuntime(context.Background(), &mockedLogger{}, WAZERO, raw, hostApis,
+		WithInstrumentation(&instrument.Config{DefaultCost: 1000}))
+	require.Equal(t, nil, err)
+	_, leftover, err := rt.Call("testIncrease", 100000)
+	require.Equal(t, nil, err)
+	require.NotEqual(t, defaultLeftover, leftover)
+	rt.Destroy()
+}
+
+// Test Case: the wazero engine runs the same code with the same results and gas
+// as wasmtime. The default schedule is built into the wasmtime binding, so the
+// gas is only compared in the builds with cgo.
+func TestWazeroConformance(t *testing.T) {
+	cwd, _ := os.Getwd()
+	raw, _ := os.ReadFile(path.Join(cwd, "./wasmtime/testdata/runtime_test.wasm"))
+
+	calls := []struct {
+		method string
+		args   []interface{}
+	}{
+		{"greet", []interface{}{"abcd"}},
+		{"greet2", []interface{}{"bonjour", "2", "5"}},
+		{"testBytes", []interface{}{[]byte{0x1, 0x2, 0x3, 0x4}}},
+		{"testIncrease", nil},
+		{"infiniteLoop", nil},
+	}
+
+	// the aspect rules are validated the same way, e.g. a floating-point function
+	//   (func (result f64) (f64.const 0))
+	f := newFixture(t)
+	f.addFunc("float", instrument.FuncType{Results: []byte{instrument.ValueF64}}, 0x44, 0, 0, 0, 0, 0, 0, 0, 0, 0x0b)
+	float := f.code()
+
+	results := make(map[RuntimeType][]*types.CallResult)
+	for _, runtimeType := range []RuntimeType{WASM, WAZERO} {
+		// the registries wrapped for either engine are accepted by wazero
+		wrapper := wasmtime.Wrap
+		if runtimeType == WAZERO {
+			wrapper = wazero.Wrap
+		}
+		hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wrapper)
+		require.Equal(t, nil, addApis(t, hostApis))
+
+		rt, err := NewAspectRuntime(context.Background(), &mockedLogger{}, runtimeType, raw, hostApis)
+		require.Equal(t, nil, err)
+		for _, c := range calls {
+			result, _ := rt.CallWithResult(c.method, 100000, c.args...)
+			results[runtimeType] = append(results[runtimeType], result)
+		}
+		rt.Destroy()
+
+		validator, err := NewValidator(context.Background(), &mockedLogger{}, runtimeType)
+		require.Equal(t, nil, err)
+		require.Equal(t, nil, validator.Validate(raw))
+		require.NotNil(t, validator.Validate(raw[:len(raw)/2]))
+		require.ErrorContains(t, validator.Validate(float), "floating-point")
+	}
+
+	for i, c := range calls {
+		expected, actual := results[WASM][i], results[WAZERO][i]
+		require.Equal(t, expected.Value, actual.Value, c.method)
+		require.Equal(t, expected.WASMGasUsed, actual.WASMGasUsed, c.method)
+		require.Equal(t, expected.HostCalls, actual.HostCalls, c.method)
+		require.Equal(t, expected.PeakMemory, actual.PeakMemory, c.method)
+		if expected.Err != nil {
+			require.Equal(t, expected.Err.Error(), actual.Err.Error(), c.method)
+		} else {
+			require.Equal(t, nil, actual.Err, c.method)
+		}
+	}
+	require.True(t, errors.Is(results[WAZERO][len(calls)-1].Err, types.OutOfGasError))
+
+	// the features of wasmtime are rejected
+	hostApis := types.NewHostAPIRegistry(&mockedHostContext{}, wazero.Wrap)
+	require.Equal(t, nil, addApis(t, hostApis))
+	for _, opt := range []Option{WithFuelMetering(), WithProfiling(), WithSnapshotReset(), WithWASI(types.DefaultWASIConfig)} {
+		_, err := NewAspectRuntime(context.Background(), &mockedLogger{}, WAZERO, raw, hostApis, opt)
+		require.NotNil(t, err)
+	}
+}
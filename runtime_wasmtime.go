@@ -0,0 +1,55 @@
+//go:build cgo
+
+package runtime
+
+import (
+	"runtime/debug"
+
+	"github.com/artela-network/aspect-runtime/wasmtime"
+	wasm "github.com/bytecodealliance/wasmtime-go/v20"
+)
+
+// the wasmtime engine is built on the wasmtime binding, which requires cgo
+func init() {
+	enginePool[WASM] = wasmtime.NewWASMTimeRuntime
+	validatorRegistry[WASM] = wasmtime.NewWASMTimeValidator
+	builtinInstrument = wasm.Instrument
+	builtinInstrumentVersion = bindingVersion()
+}
+
+// bindingVersion returns the version and the checksum of the wasmtime binding
+// module the binary is built with, it is empty if the build info is missing
+func bindingVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != "github.com/bytecodealliance/wasmtime-go/v20" {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		return dep.Path + "@" + dep.Version + " " + dep.Sum
+	}
+	return ""
+}
+
+// SetModuleCacheDir persists the compiled modules of all wasmtime runtimes in dir, so
+// that aspects are not recompiled after a restart. The least recently used
+// modules are removed once the cache grows over maxSize bytes. The cache is
+// disabled if dir is empty.
+func SetModuleCacheDir(dir string, maxSize int64) error {
+	if dir == "" {
+		wasmtime.SetDiskCache(nil)
+		return nil
+	}
+
+	cache, err := wasmtime.NewDiskCache(dir, maxSize)
+	if err != nil {
+		return err
+	}
+	wasmtime.SetDiskCache(cache)
+	return nil
+}
@@ -0,0 +1,52 @@
+package sourcemap
+
+import (
+	"sync"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// Resolver resolves the offsets of an instrumented module with the source map
+// of the original module, it implements types.SourceResolver. The offsets are
+// mapped back to the original module on the first trap, so the runtimes which
+// never trap do not pay for it.
+type Resolver struct {
+	sourceMap *Map
+
+	original     []byte
+	instrumented []byte
+
+	once    sync.Once
+	offsets *instrument.OffsetMap
+}
+
+var _ types.SourceResolver = (*Resolver)(nil)
+
+// NewResolver creates a resolver of the instrumented code of the original code
+func NewResolver(sourceMap *Map, original, instrumented []byte) *Resolver {
+	return &Resolver{
+		sourceMap:    sourceMap,
+		original:     original,
+		instrumented: instrumented,
+	}
+}
+
+// Resolve returns the source position of the instruction at the offset of the
+// function in the instrumented module
+func (r *Resolver) Resolve(funcIndex uint32, offset uint) (types.SourcePosition, bool) {
+	r.once.Do(func() {
+		// the positions are not resolved if the code cannot be decoded
+		r.offsets, _ = instrument.NewOffsetMap(r.original, r.instrumented)
+		r.original, r.instrumented = nil, nil
+	})
+	if r.offsets == nil {
+		return types.SourcePosition{}, false
+	}
+
+	original, ok := r.offsets.Original(funcIndex, offset)
+	if !ok {
+		return types.SourcePosition{}, false
+	}
+	return r.sourceMap.Resolve(original)
+}
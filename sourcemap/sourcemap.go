@@ -0,0 +1,231 @@
+package sourcemap
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// URLSection is the custom section holding the url of the source map of a module
+const URLSection = "sourceMappingURL"
+
+// Map is a source map (revision 3) of a wasm module, e.g. generated by the
+// AssemblyScript compiler with --sourceMap. The generated code of a wasm module
+// is a single line, and the columns are the offsets in the module.
+type Map struct {
+	sources  []string
+	mappings []mapping
+}
+
+// mapping maps the code from the offset to the next mapping to a source position
+type mapping struct {
+	offset uint
+	source int
+	line   int
+	column int
+}
+
+type rawMap struct {
+	Version    int      `json:"version"`
+	SourceRoot string   `json:"sourceRoot"`
+	Sources    []string `json:"sources"`
+	Mappings   string   `json:"mappings"`
+}
+
+// Parse parses a source map in the JSON format
+func Parse(data []byte) (*Map, error) {
+	var raw rawMap
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrap(err, "invalid source map")
+	}
+	if raw.Version != 3 {
+		return nil, errors.Errorf("unsupported source map version %d", raw.Version)
+	}
+
+	m := &Map{sources: make([]string, len(raw.Sources))}
+	for i, source := range raw.Sources {
+		if raw.SourceRoot != "" {
+			source = strings.TrimSuffix(raw.SourceRoot, "/") + "/" + source
+		}
+		m.sources[i] = source
+	}
+
+	// all fields but the generated column are relative to the previous segment
+	// of the whole map, the generated column to the previous segment of the line
+	var fields [5]int
+	for line, segments := range strings.Split(raw.Mappings, ";") {
+		fields[0] = 0
+		for _, segment := range strings.Split(segments, ",") {
+			if segment == "" {
+				continue
+			}
+			values, err := decodeVLQ(segment)
+			if err != nil {
+				return nil, err
+			}
+			for i, value := range values {
+				fields[i] += value
+			}
+			if line > 0 || len(values) < 4 {
+				// wasm code has no other lines, and segments without a source
+				// are not mapped
+				continue
+			}
+			if fields[0] < 0 || fields[1] < 0 || fields[1] >= len(m.sources) {
+				return nil, errors.New("invalid source map mapping")
+			}
+
+			m.mappings = append(m.mappings, mapping{
+				offset: uint(fields[0]),
+				source: fields[1],
+				line:   fields[2] + 1,
+				column: fields[3] + 1,
+			})
+		}
+	}
+
+	sort.SliceStable(m.mappings, func(i, j int) bool {
+		return m.mappings[i].offset < m.mappings[j].offset
+	})
+	return m, nil
+}
+
+// Resolve returns the source position of the code at the offset of the module
+func (m *Map) Resolve(offset uint) (types.SourcePosition, bool) {
+	i := sort.Search(len(m.mappings), func(i int) bool {
+		return m.mappings[i].offset > offset
+	})
+	if i == 0 {
+		return types.SourcePosition{}, false
+	}
+
+	entry := m.mappings[i-1]
+	return types.SourcePosition{
+		File:   m.sources[entry.source],
+		Line:   entry.line,
+		Column: entry.column,
+	}, true
+}
+
+// FromModule returns the source map embedded in the module, which is a data url
+// in the sourceMappingURL section. It returns nil if the module has no source
+// map url, and an error if the url refers to an external file, which is never
+// loaded by the runtime.
+func FromModule(code []byte) (*Map, error) {
+	rawURL, ok, err := embeddedURL(code)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	data, err := decodeDataURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// embeddedURL looks up the sourceMappingURL section, only the section headers
+// are read so that modules without a source map are not decoded.
+func embeddedURL(code []byte) (string, bool, error) {
+	const headerSize = 8
+	if len(code) < headerSize {
+		return "", false, errors.New("invalid wasm header")
+	}
+
+	// uvarint reads an unsigned LEB128 value, which is the same encoding
+	uvarint := func(data []byte) (int, int) {
+		value, n := binary.Uvarint(data)
+		if n <= 0 || value > uint64(len(data)-n) {
+			return 0, -1
+		}
+		return int(value), n
+	}
+
+	rest := code[headerSize:]
+	for len(rest) > 0 {
+		id := rest[0]
+		size, n := uvarint(rest[1:])
+		if n < 0 {
+			return "", false, errors.New("invalid wasm section")
+		}
+		payload := rest[1+n : 1+n+size]
+		rest = rest[1+n+size:]
+		if id != instrument.SectionCustom {
+			continue
+		}
+
+		nameSize, n := uvarint(payload)
+		if n < 0 {
+			return "", false, errors.New("invalid wasm custom section")
+		}
+		if string(payload[n:n+nameSize]) != URLSection {
+			continue
+		}
+
+		payload = payload[n+nameSize:]
+		urlSize, n := uvarint(payload)
+		if n < 0 {
+			return "", false, errors.New("invalid source map url section")
+		}
+		return string(payload[n : n+urlSize]), true, nil
+	}
+	return "", false, nil
+}
+
+// decodeDataURL decodes a url of the form data:application/json;base64,<data>
+func decodeDataURL(rawURL string) ([]byte, error) {
+	if !strings.HasPrefix(rawURL, "data:") {
+		return nil, errors.Errorf("external source map %s is not supported", rawURL)
+	}
+
+	header, data, ok := strings.Cut(strings.TrimPrefix(rawURL, "data:"), ",")
+	if !ok {
+		return nil, errors.New("invalid source map data url")
+	}
+	if strings.HasSuffix(header, ";base64") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	decoded, err := url.PathUnescape(data)
+	return []byte(decoded), err
+}
+
+const base64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// decodeVLQ decodes the base64 VLQ values of a segment
+func decodeVLQ(segment string) ([]int, error) {
+	values := make([]int, 0, 5)
+	value, shift := 0, 0
+	for i := 0; i < len(segment); i++ {
+		digit := strings.IndexByte(base64Chars, segment[i])
+		if digit < 0 || shift > 30 {
+			return nil, errors.Errorf("invalid source map segment %s", segment)
+		}
+
+		value += (digit & 0x1f) << shift
+		if digit&0x20 != 0 {
+			shift += 5
+			continue
+		}
+
+		if value&1 != 0 {
+			value = -(value >> 1)
+		} else {
+			value >>= 1
+		}
+		values = append(values, value)
+		value, shift = 0, 0
+	}
+	if shift != 0 || len(values) > 5 {
+		return nil, errors.Errorf("invalid source map segment %s", segment)
+	}
+	return values, nil
+}
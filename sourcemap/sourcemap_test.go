@@ -0,0 +1,100 @@
+package sourcemap
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// encodeVLQ encodes the values of a source map segment
+func encodeVLQ(values ...int) string {
+	var out []byte
+	for _, value := range values {
+		v := value << 1
+		if value < 0 {
+			v = (-value << 1) | 1
+		}
+		for {
+			digit := v & 0x1f
+			v >>= 5
+			if v > 0 {
+				digit |= 0x20
+			}
+			out = append(out, base64Chars[digit])
+			if v == 0 {
+				break
+			}
+		}
+	}
+	return string(out)
+}
+
+func TestDecodeVLQ(t *testing.T) {
+	for _, values := range [][]int{{0}, {1, -1}, {15, 16, -16, 1000000}, {0, 0, 0, 0, 0}} {
+		decoded, err := decodeVLQ(encodeVLQ(values...))
+		require.Equal(t, nil, err)
+		require.Equal(t, values, decoded)
+	}
+
+	_, err := decodeVLQ("g")
+	require.NotNil(t, err)
+	_, err = decodeVLQ("!")
+	require.NotNil(t, err)
+}
+
+func TestParse(t *testing.T) {
+	// offset 10 -> a.ts:1:1, offset 20 -> b.ts:5:3, offset 30 has no source
+	mappings := encodeVLQ(10, 0, 0, 0) + "," + encodeVLQ(10, 1, 4, 2) + "," + encodeVLQ(10)
+	m, err := Parse([]byte(`{"version":3,"sourceRoot":"assembly","sources":["a.ts","b.ts"],"names":[],"mappings":"` + mappings + `"}`))
+	require.Equal(t, nil, err)
+
+	_, ok := m.Resolve(9)
+	require.False(t, ok)
+
+	pos, ok := m.Resolve(10)
+	require.True(t, ok)
+	require.Equal(t, types.SourcePosition{File: "assembly/a.ts", Line: 1, Column: 1}, pos)
+
+	pos, ok = m.Resolve(35)
+	require.True(t, ok)
+	require.Equal(t, types.SourcePosition{File: "assembly/b.ts", Line: 5, Column: 3}, pos)
+
+	_, err = Parse([]byte(`{"version":2,"sources":[],"mappings":""}`))
+	require.NotNil(t, err)
+	_, err = Parse([]byte(`{"version":3,"sources":[],"mappings":"` + encodeVLQ(0, 0, 0, 0) + `"}`))
+	require.NotNil(t, err)
+}
+
+func TestFromModule(t *testing.T) {
+	m := &instrument.Module{}
+	m.AddFunction(m.AddType(instrument.FuncType{}), instrument.Code{Expr: []byte{0x0b}})
+	code := m.Encode()
+
+	sourceMap, err := FromModule(code)
+	require.Equal(t, nil, err)
+	require.Nil(t, sourceMap)
+
+	withURL := func(url string) []byte {
+		var payload []byte
+		payload = append(payload, byte(len(URLSection)))
+		payload = append(payload, URLSection...)
+		payload = append(payload, byte(len(url)))
+		payload = append(payload, url...)
+		section := append([]byte{instrument.SectionCustom, byte(len(payload))}, payload...)
+		return append(append([]byte{}, code...), section...)
+	}
+
+	data := `{"version":3,"sources":["a.ts"],"mappings":"` + encodeVLQ(1, 0, 2, 3) + `"}`
+	sourceMap, err = FromModule(withURL("data:application/json;base64," + base64.StdEncoding.EncodeToString([]byte(data))))
+	require.Equal(t, nil, err)
+	pos, ok := sourceMap.Resolve(1)
+	require.True(t, ok)
+	require.Equal(t, types.SourcePosition{File: "a.ts", Line: 3, Column: 4}, pos)
+
+	_, err = FromModule(withURL("index.wasm.map"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,117 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// GuestABI names the exports the runtime uses to manage the memory of an
+// aspect. The arguments of a call are allocated with the allocator, pinned
+// during the call if the guest has a garbage collector, and unpinned and freed
+// once the result is read and the post-call hook is done. The memory
+// management calls are charged to the gas of the call. Empty names are not
+// used.
+type GuestABI struct {
+	// Memory is the linear memory export
+	Memory string
+
+	// Start is the function initializing the instance before the calls, the
+	// calls fail if it is not exported
+	Start string
+
+	// Alloc is the allocator, called with the size followed by AllocArgs,
+	// which returns the pointer of the allocated memory
+	Alloc     string
+	AllocArgs []int32
+
+	// Free releases the memory allocated for the arguments, called with the
+	// pointer, and the size if FreeWithSize is set
+	Free         string
+	FreeWithSize bool
+
+	// Pin and Unpin keep the arguments from being collected by the garbage
+	// collector of the guest during the call
+	Pin   string
+	Unpin string
+
+	// NativeResults are the exports whose i32 results are native values, the
+	// i32 results of the other exports are pointers of the header protocol.
+	// The i64, f32 and f64 results are always native.
+	NativeResults []string
+}
+
+var (
+	// DefaultABI is the ABI of the aspects built with the aspect libraries,
+	// which export an allocate function
+	DefaultABI = GuestABI{
+		Memory: "memory",
+		Start:  "__aspect_start__",
+		Alloc:  "allocate",
+	}
+
+	// AssemblyScriptABI uses the runtime exports of AssemblyScript (--exportRuntime),
+	// the arguments are allocated as ArrayBuffer and pinned during the call
+	AssemblyScriptABI = GuestABI{
+		Memory:    "memory",
+		Start:     "__aspect_start__",
+		Alloc:     "__new",
+		AllocArgs: []int32{assemblyScriptArrayBufferID},
+		Pin:       "__pin",
+		Unpin:     "__unpin",
+	}
+
+	// RustABI uses the alloc and dealloc exports conventional for Rust,
+	// dealloc takes the size of the allocation as the layout
+	RustABI = GuestABI{
+		Memory:       "memory",
+		Alloc:        "alloc",
+		Free:         "dealloc",
+		FreeWithSize: true,
+	}
+
+	// TinyGoABI uses the malloc and free exports of TinyGo, and the
+	// _initialize export of reactor modules
+	TinyGoABI = GuestABI{
+		Memory: "memory",
+		Start:  "_initialize",
+		Alloc:  "malloc",
+		Free:   "free",
+	}
+)
+
+// assemblyScriptArrayBufferID is the class id of ArrayBuffer in AssemblyScript
+const assemblyScriptArrayBufferID = 1
+
+// Hash returns the hash of the ABI, used to pool runtimes with different ABIs separately
+func (a *GuestABI) Hash() []byte {
+	var buf []byte
+	for _, name := range []string{a.Memory, a.Start, a.Alloc, a.Free, a.Pin, a.Unpin} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(name)))
+		buf = append(buf, name...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(a.AllocArgs)))
+	for _, arg := range a.AllocArgs {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(arg))
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(a.NativeResults)))
+	for _, name := range a.NativeResults {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(name)))
+		buf = append(buf, name...)
+	}
+	if a.FreeWithSize {
+		buf = append(buf, 1)
+	}
+
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
+
+// NativeResult checks whether the i32 results of the export are native values
+func (a *GuestABI) NativeResult(method string) bool {
+	for _, name := range a.NativeResults {
+		if name == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,385 @@
+package types
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CallEngine is the engine specific part of a runtime, the calls and the
+// batches of both engines are run on top of it by CallWithResult and CallBatch.
+// The engine is locked for the whole call.
+type CallEngine interface {
+	sync.Locker
+
+	Logger() Logger
+
+	// VMContext returns the context of the instance
+	VMContext() VMContext
+
+	// Hooks returns the lifecycle hooks exported by the module
+	Hooks() Lifecycle
+
+	// GuestABI returns the guest ABI of the module
+	GuestABI() *GuestABI
+
+	// BeginCall prepares the engine for a call or a batch, the returned
+	// function ends it and clears the interruption request
+	BeginCall() (end func())
+
+	// Interruption returns the error of an interrupted call, nil if the call can go on
+	Interruption() error
+
+	// Init fills up the gas of the call and initializes the instance, it
+	// returns false if the instance is restored rather than initialized, even
+	// if it fails
+	Init(gas int64) (initialized bool, err error)
+
+	// Invoke calls an export, the results are decoded to int32, int64, float32
+	// or float64, and to a []interface{} of them for an export with multiple
+	// results
+	Invoke(method string, args ...interface{}) (interface{}, error)
+
+	// ReleaseArgs unpins and frees the arguments allocated by Invoke, the
+	// guest calls are charged to the gas left by the call
+	ReleaseArgs()
+
+	// ResetStackHeight resets the stack height counter of the instrumentation
+	ResetStackHeight() error
+
+	// CountHostCalls starts counting the host calls from zero, or stops
+	// counting them if count is false
+	CountHostCalls(count bool)
+
+	// HostCalls returns the number of calls of each host api counted
+	HostCalls() map[string]int64
+
+	// MemorySize returns the size of the linear memory of the instance
+	MemorySize() (int64, error)
+}
+
+// CallProfiler is implemented by the engines which collect the gas profile of
+// the calls, a profile is only collected for the calls with an initialized
+// instance, and never for the batches.
+type CallProfiler interface {
+	CollectProfile(method string, gas int64)
+}
+
+// CallWithResult calls the method with the gas limit and collects the
+// statistics of the execution, see AspectRuntime.
+func CallWithResult(e CallEngine, method string, gas int64, args ...interface{}) (result *CallResult, err error) {
+	startTime := time.Now()
+	result = &CallResult{}
+
+	defer func() {
+		e.Logger().Info("aspect execution done",
+			"duration", time.Since(startTime).String(),
+			"remainingGas", result.GasLeft,
+			"gasUsed", result.GasUsed,
+			"err", err)
+	}()
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.Logger().Info("calling aspect", "method", method, "gas", gas)
+	defer e.BeginCall()()
+	if err := e.Interruption(); err != nil {
+		setGas(result, EVMGasToWASMGas(gas), EVMGasToWASMGas(gas))
+		result.Err = err
+		return result, err
+	}
+
+	if err := initCall(e, result, gas); err != nil {
+		return result, err
+	}
+
+	if profiler, ok := e.(CallProfiler); ok {
+		defer profiler.CollectProfile(method, gas)
+	}
+
+	return result, execute(e, result, EVMGasToWASMGas(gas), method, args...)
+}
+
+// CallBatch calls the methods of the batch in order, the instance is
+// initialized once for the whole batch, see AspectRuntime.
+func CallBatch(e CallEngine, batch *Batch) (results []*CallResult, err error) {
+	startTime := time.Now()
+
+	defer func() {
+		e.Logger().Info("aspect batch done",
+			"duration", time.Since(startTime).String(),
+			"calls", len(results),
+			"err", err)
+	}()
+
+	if len(batch.Calls) == 0 {
+		return nil, nil
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	gas := batch.Gas
+	if batch.Budget == PerCallGas {
+		gas = batch.Calls[0].Gas
+	}
+
+	e.Logger().Info("calling aspect batch", "calls", len(batch.Calls), "gas", gas)
+	defer e.BeginCall()()
+
+	for i, call := range batch.Calls {
+		result := &CallResult{}
+		results = append(results, result)
+
+		callErr := batchCall(e, result, i, gas, call, batch.Budget)
+		if callErr == nil {
+			continue
+		}
+
+		callErr = errors.WithMessagef(callErr, "batch call %d (%s) failed", i, call.Method)
+		if err == nil {
+			err = callErr
+		}
+		if batch.OnFailure == StopOnFailure || batchStopped(callErr, batch.Budget) {
+			return results, err
+		}
+	}
+	return results, err
+}
+
+// batchCall runs the i-th call of a batch, the first call initializes the instance
+func batchCall(e CallEngine, result *CallResult, i int, gas int64, call BatchCall, budget GasBudget) error {
+	e.Logger().Info("calling aspect", "method", call.Method, "index", i)
+	if err := e.Interruption(); err != nil {
+		result.Err = err
+		return err
+	}
+
+	wasmBudget := EVMGasToWASMGas(gas)
+	switch {
+	case i == 0:
+		if err := initCall(e, result, gas); err != nil {
+			return err
+		}
+	case budget == PerCallGas:
+		wasmBudget = EVMGasToWASMGas(call.Gas)
+		if err := e.VMContext().AddEVMGas(call.Gas); err != nil {
+			setGas(result, wasmBudget, 0)
+			result.Err = err
+			return err
+		}
+		if err := e.ResetStackHeight(); err != nil {
+			result.Err = err
+			return err
+		}
+	default:
+		// the remaining gas of the batch is the budget of the call
+		left, err := e.VMContext().RemainingWASMGas()
+		if err != nil {
+			result.Err = err
+			return err
+		}
+		wasmBudget = left
+		if err := e.ResetStackHeight(); err != nil {
+			result.Err = err
+			return err
+		}
+	}
+
+	if i > 0 {
+		e.CountHostCalls(true)
+	}
+	return execute(e, result, wasmBudget, call.Method, call.Args...)
+}
+
+// batchStopped checks whether the batch cannot go on after the error, i.e. the
+// call is interrupted or the shared gas has run out
+func batchStopped(err error, budget GasBudget) bool {
+	if errors.Is(err, InterruptedError) || errors.Is(err, DeadlineExceededError) {
+		return true
+	}
+	return budget == SharedGas && errors.Is(err, OutOfGasError)
+}
+
+// initCall initializes the instance for a call, and fills the init statistics of the result
+func initCall(e CallEngine, result *CallResult, gas int64) error {
+	e.CountHostCalls(true)
+
+	e.Logger().Debug("initializing aspect")
+	initStart := time.Now()
+	initialized, err := e.Init(gas)
+	result.Initialized = initialized
+	result.InitDuration = time.Since(initStart)
+	if err != nil {
+		collectStats(e, result)
+		setGas(result, EVMGasToWASMGas(gas), 0)
+		result.Err = errors.WithMessage(err, "aspect init failed")
+		return result.Err
+	}
+	return nil
+}
+
+// execute calls the method of an initialized instance and fills the result,
+// wasmBudget is the WASM gas available to the call
+func execute(e CallEngine, result *CallResult, wasmBudget int64, method string, args ...interface{}) (err error) {
+	defer func() {
+		collectStats(e, result)
+		e.CountHostCalls(false)
+		result.Err = err
+	}()
+
+	logger := e.Logger()
+	logger.Debug("executing aspect")
+	execStart := time.Now()
+	defer func() {
+		result.ExecDuration = time.Since(execStart)
+	}()
+
+	hooks := e.Hooks()
+	var val interface{}
+	callErr := RunHook(e, "pre-call", hooks.PreCall, true)
+	if callErr == nil {
+		val, callErr = e.Invoke(method, args...)
+	}
+	if callErr == nil {
+		// the result is read before the post-call hook can change the memory
+		result.Value, callErr = readResult(e, e.GuestABI().NativeResult(method), val)
+	}
+	if callErr == nil {
+		callErr = RunHook(e, "post-call", hooks.PostCall, true)
+	}
+	if callErr != nil {
+		result.Value = nil
+	}
+	// the arguments stay alive until the result is read and the post-call hook
+	// is done, the unpin and free calls of the guest are charged to the call
+	e.ReleaseArgs()
+
+	wasmLeft, gasErr := e.VMContext().RemainingWASMGas()
+	if gasErr != nil {
+		logger.Error("failed to get remaining gas", "err", gasErr)
+		setGas(result, wasmBudget, 0)
+		result.Value = nil
+		return gasErr
+	}
+	setGas(result, wasmBudget, wasmLeft)
+
+	logger.Info("aspect executed", "method", method, "leftover", result.GasLeft, "result", val, "err", callErr)
+	return callErr
+}
+
+// readResult decodes the value returned by the wasm method, the results of a
+// method with multiple results are decoded into a []interface{}. native is set
+// if the i32 results of the method are native values, see GuestABI.
+func readResult(e CallEngine, native bool, val interface{}) (interface{}, error) {
+	vals, ok := val.([]interface{})
+	if !ok {
+		return readValue(e, native, val)
+	}
+
+	results := make([]interface{}, len(vals))
+	for i, v := range vals {
+		res, err := readValue(e, native, v)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "result %d", i)
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
+// readValue decodes a value returned by the wasm method, an i32 is a pointer
+// of the header protocol unless the method returns native values, the other
+// value types are returned as they are
+func readValue(e CallEngine, native bool, val interface{}) (interface{}, error) {
+	var ptr int32
+	switch v := val.(type) {
+	case nil:
+		// the method has no result
+		return nil, nil
+	case int64, float32, float64:
+		return v, nil
+	case int32:
+		if native {
+			return v, nil
+		}
+		ptr = v
+	default:
+		return nil, errors.Errorf("read output failed, value: %v", val)
+	}
+
+	if ptr == 0 {
+		// void functions this will be 0
+		return nil, nil
+	}
+
+	ctx, logger := e.VMContext(), e.Logger()
+	header, err := ctx.ReadMemory(ptr, HeaderLen)
+	if err != nil {
+		logger.Error("failed to read return value header", "err", err)
+		return nil, err
+	}
+
+	h := &TypeHeader{}
+	dataType, dataLen, err := h.Unmarshal(header)
+	if err != nil {
+		logger.Error("failed to unmarshal return value header", "err", err)
+		return nil, errors.WithMessagef(InvalidReturnHeaderError, "read output failed, %v", err)
+	}
+
+	resType, err := TypeObjectMapping(dataType)
+	if err != nil {
+		logger.Error("unsupported return value data type", "err", err, "dataType", dataType)
+		return nil, errors.WithMessage(err, "unsupported result type")
+	}
+
+	retData, err := ctx.ReadMemory(ptr, HeaderLen+dataLen)
+	if err != nil {
+		logger.Error("failed to read return value", "err", err)
+		return nil, errors.Errorf("read output failed, %v", err)
+	}
+
+	res, err := resType.Unmarshal(retData)
+	if err != nil {
+		logger.Error("failed to unmarshal return value", "err", err)
+		return nil, errors.Errorf("read output failed, %v", err)
+	}
+
+	return res, nil
+}
+
+// setGas fills the gas of the result from the WASM gas available to the call
+// and the remaining WASM gas
+func setGas(result *CallResult, wasmBudget, wasmLeft int64) {
+	result.WASMGasLeft = wasmLeft
+	result.WASMGasUsed = wasmBudget - wasmLeft
+	result.GasLeft = WASMGasToEVMGas(wasmLeft)
+	result.GasUsed = WASMGasToEVMGas(wasmBudget) - result.GasLeft
+}
+
+// collectStats fills the host calls and the memory usage of the result
+func collectStats(e CallEngine, result *CallResult) {
+	result.HostCalls = e.HostCalls()
+	if size, err := e.MemorySize(); err == nil {
+		result.PeakMemory = size
+	}
+}
+
+// ContextError maps the error of a done context to the interruption errors
+func ContextError(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return DeadlineExceededError
+	default:
+		return InterruptedError
+	}
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"runtime"
+	"sync"
+)
+
+// compileSlots limits the number of aspects instrumented or compiled at the
+// same time, by all the engines
+var compileSlots = struct {
+	sync.RWMutex
+	slots chan struct{}
+}{slots: make(chan struct{}, runtime.NumCPU())}
+
+// SetMaxConcurrentCompilations limits the number of aspects instrumented or
+// compiled at the same time, the default is the number of CPUs.
+func SetMaxConcurrentCompilations(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	compileSlots.Lock()
+	defer compileSlots.Unlock()
+
+	compileSlots.slots = make(chan struct{}, n)
+}
+
+// AcquireCompileSlot waits for a slot to instrument or compile an aspect, the
+// slot must be released once the work is done. The slot must not be held
+// while waiting for another compilation, which may need the slot.
+func AcquireCompileSlot() (release func()) {
+	compileSlots.RLock()
+	slots := compileSlots.slots
+	compileSlots.RUnlock()
+
+	slots <- struct{}{}
+	return func() {
+		<-slots
+	}
+}
@@ -0,0 +1,216 @@
+package types
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+)
+
+// WASMPageSize is the size of a wasm memory page
+const WASMPageSize = 64 * 1024
+
+// StackBytesPerHeight is the native stack size reserved for each unit of the
+// stack height, see instrument.LimitStack. The MaxWasmStack of a runtime must
+// cover the stack height limit at this rate, so that the deterministic limit is
+// always reached before the native stack overflows. The worst case measured on
+// x86-64 is 48 bytes, for the smallest frames of fuel metered code, it is
+// doubled to leave room for other architectures and the host api frames.
+const StackBytesPerHeight = 96
+
+// MaxWasmStackLimit is the largest max wasm stack accepted, the wasm code of
+// wasmtime runs on the native stack of the calling thread, which must be larger
+// than this. wazero grows the stack on demand, it is bounded the same way so
+// that the options are accepted by both engines alike.
+const MaxWasmStackLimit = 4 * 1024 * 1024
+
+// RuntimeOptions are the resource limits of a runtime, zero fields are set
+// to the value in DefaultRuntimeOptions.
+type RuntimeOptions struct {
+	// MaxMemorySize is the max size of the linear memory in bytes, it must be
+	// a multiple of WASMPageSize. The engine reserves this size of address
+	// space for each memory.
+	MaxMemorySize int64
+
+	// MaxTables is the max number of tables in a runtime
+	MaxTables int64
+
+	// MaxTableElements is the max number of elements of each table
+	MaxTableElements int64
+
+	// MaxInstances is the max number of instances in a runtime, which also
+	// limits the number of memories
+	MaxInstances int64
+
+	// MaxWasmStack is the max size of the native stack used by the wasm code
+	// in bytes. It must fit the stack height limit of the runtime, see
+	// RuntimeConfig.MaxStackHeight.
+	MaxWasmStack int64
+}
+
+// DefaultMaxMemorySize is the max size of the linear memory used if RuntimeOptions does not set one
+const DefaultMaxMemorySize = 10 * 1024 * 1024
+
+// Unlimited disables the limit of MaxTables, MaxTableElements or MaxInstances
+const Unlimited int64 = -1
+
+// DefaultRuntimeOptions are the limits used for the fields not set in
+// RuntimeOptions. The tables and the instances are unlimited like before the
+// options were introduced, limiting them is a consensus change, as the modules
+// over the limits fail to instantiate on every node.
+var DefaultRuntimeOptions = RuntimeOptions{
+	MaxMemorySize:    DefaultMaxMemorySize,
+	MaxTables:        Unlimited,
+	MaxTableElements: Unlimited,
+	MaxInstances:     Unlimited,
+	MaxWasmStack:     512 * 1024,
+}
+
+// withDefaults fills the zero fields with the default values
+func (o RuntimeOptions) withDefaults() RuntimeOptions {
+	fill := func(value *int64, defaultValue int64) {
+		if *value == 0 {
+			*value = defaultValue
+		}
+	}
+	fill(&o.MaxMemorySize, DefaultRuntimeOptions.MaxMemorySize)
+	fill(&o.MaxTables, DefaultRuntimeOptions.MaxTables)
+	fill(&o.MaxTableElements, DefaultRuntimeOptions.MaxTableElements)
+	fill(&o.MaxInstances, DefaultRuntimeOptions.MaxInstances)
+	fill(&o.MaxWasmStack, DefaultRuntimeOptions.MaxWasmStack)
+	return o
+}
+
+// Validate checks that the options are in range, the engine may put more
+// restrictions on them.
+func (o RuntimeOptions) Validate() error {
+	o = o.withDefaults()
+	if o.MaxMemorySize < 0 || o.MaxWasmStack < 0 {
+		return errors.New("negative runtime limit")
+	}
+	if o.MaxTables < Unlimited || o.MaxTableElements < Unlimited || o.MaxInstances < Unlimited {
+		return errors.New("negative runtime limit, only Unlimited is allowed")
+	}
+	if o.MaxMemorySize%WASMPageSize != 0 {
+		return errors.Errorf("max memory size %d is not a multiple of the wasm page size", o.MaxMemorySize)
+	}
+	if o.MaxMemorySize > 65536*WASMPageSize {
+		return errors.Errorf("max memory size %d exceeds 4GB", o.MaxMemorySize)
+	}
+	return nil
+}
+
+// GasMetering is the way the execution of wasm code is charged
+type GasMetering byte
+
+const (
+	// InstrumentedMetering injects a gas counter into the wasm code
+	InstrumentedMetering GasMetering = iota
+
+	// FuelMetering uses the fuel consumption built into the engine, the code
+	// runs without instrumentation and each instruction costs one WASM gas.
+	FuelMetering
+)
+
+// ResetMode is the way a pooled runtime is reset for the next call
+type ResetMode byte
+
+const (
+	// StoreReset recreates the store and instance for each call
+	StoreReset ResetMode = iota
+
+	// SnapshotReset restores the memory and globals saved after the first
+	// initialization of the instance in place, which saves the instantiation
+	// and the start function. The gas used by the start function is still
+	// charged, so the gas usage is the same as StoreReset.
+	SnapshotReset
+)
+
+// RuntimeConfig holds the optional features of an aspect runtime
+type RuntimeConfig struct {
+	// Profiling enables attributing the gas of each call to wasm functions
+	// and host apis, see AspectRuntime.GasProfile
+	Profiling bool
+
+	// Metering selects how the wasm execution is charged
+	Metering GasMetering
+
+	// Instrumentation is the pricing of the instrumented metering, the
+	// built-in instrumentation of the engine is used if it is nil.
+	Instrumentation *instrument.Config
+
+	// MaxStackHeight limits the stack height of the wasm code, see
+	// instrument.LimitStack. The stack height is not limited if it is 0, a
+	// deep recursion is then only stopped by the native stack overflow of the
+	// engine, at a depth depending on the architecture.
+	MaxStackHeight uint32
+
+	// Reset selects how the runtime is reset when it is reused by the pool
+	Reset ResetMode
+
+	// Options are the resource limits of the runtime
+	Options RuntimeOptions
+
+	// SourceMap is the source map of the code supplied with the runtime, the
+	// source map embedded in the code is used if it is nil.
+	SourceMap []byte
+
+	// Sources resolves the backtraces of traps to the original source, it is
+	// set up from the source map when the runtime is created.
+	Sources SourceResolver
+
+	// ABI names the memory management exports of the aspect, DefaultABI is
+	// used if it is nil
+	ABI *GuestABI
+
+	// Lifecycle are the lifecycle hooks of the aspect, DefaultLifecycle is
+	// used if it is nil
+	Lifecycle *Lifecycle
+
+	// WASI enables the deterministic WASI subset if it is set
+	WASI *WASIConfig
+}
+
+// SourceResolver resolves an offset of a function in the compiled code to the
+// position in the original source
+type SourceResolver interface {
+	Resolve(funcIndex uint32, offset uint) (SourcePosition, bool)
+}
+
+// Limits returns the resource limits of the runtime with the defaults filled
+func (c *RuntimeConfig) Limits() RuntimeOptions {
+	return c.Options.withDefaults()
+}
+
+// GuestABI returns the guest ABI of the runtime
+func (c *RuntimeConfig) GuestABI() *GuestABI {
+	if c.ABI == nil {
+		return &DefaultABI
+	}
+	return c.ABI
+}
+
+// Hooks returns the lifecycle hooks of the runtime
+func (c *RuntimeConfig) Hooks() *Lifecycle {
+	if c.Lifecycle == nil {
+		return &DefaultLifecycle
+	}
+	return c.Lifecycle
+}
+
+// Validate checks the options of the runtime against the stack height limit,
+// the engine may put more restrictions on the config.
+func (c *RuntimeConfig) Validate() error {
+	if err := c.Options.Validate(); err != nil {
+		return err
+	}
+
+	limits := c.Limits()
+	if limits.MaxWasmStack > MaxWasmStackLimit {
+		return errors.Errorf("max wasm stack %d exceeds %d", limits.MaxWasmStack, MaxWasmStackLimit)
+	}
+	if need := int64(c.MaxStackHeight) * StackBytesPerHeight; limits.MaxWasmStack < need {
+		return errors.Errorf("max wasm stack %d is too small for stack height %d, need at least %d",
+			limits.MaxWasmStack, c.MaxStackHeight, need)
+	}
+	return nil
+}
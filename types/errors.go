@@ -1,7 +1,204 @@
 package types
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 var (
-	OutOfGasError = errors.New("out of gas")
+	OutOfGasError      = errors.New("out of gas")
+	StackOverflowError = errors.New("stack overflow")
+
+	// InterruptedError is returned by calls stopped by the cancellation of the
+	// context or by Interrupt, DeadlineExceededError by the context deadline.
+	InterruptedError      = errors.New("execution interrupted")
+	DeadlineExceededError = errors.New("execution deadline exceeded")
+
+	// MethodNotFoundError is returned when the called method is not exported
+	MethodNotFoundError = errors.New("method not found")
+
+	// InvalidReturnHeaderError is returned when the header of the returned
+	// value cannot be decoded
+	InvalidReturnHeaderError = errors.New("invalid return header")
+
+	// UnsupportedTypeError is returned for values and host functions of types
+	// which cannot be passed between the host and the wasm code
+	UnsupportedTypeError = errors.New("unsupported type")
+
+	// BuiltinInstrumentationError is returned for the code metered with the
+	// default schedule in a build without the wasmtime binding, i.e. without
+	// cgo. The default schedule is only implemented by the binding, so such a
+	// build must not run the aspects of a chain charging the default schedule.
+	BuiltinInstrumentationError = errors.New("built-in instrumentation unavailable")
+)
+
+// TrapCode is the code of a wasm trap, the values follow the trap codes of wasmtime
+type TrapCode int
+
+const (
+	TrapStackOverflow TrapCode = iota
+	TrapMemoryOutOfBounds
+	TrapHeapMisaligned
+	TrapTableOutOfBounds
+	TrapIndirectCallToNull
+	TrapBadSignature
+	TrapIntegerOverflow
+	TrapIntegerDivisionByZero
+	TrapBadConversionToInteger
+	TrapUnreachableCodeReached
+	TrapInterrupt
+	TrapOutOfFuel
+
+	// TrapUnknown is the code of traps not raised by an instruction
+	TrapUnknown TrapCode = -1
 )
+
+var trapCodeNames = [...]string{
+	"stack overflow",
+	"memory out of bounds",
+	"heap misaligned",
+	"table out of bounds",
+	"indirect call to null",
+	"bad signature",
+	"integer overflow",
+	"integer division by zero",
+	"bad conversion to integer",
+	"unreachable code reached",
+	"interrupt",
+	"out of fuel",
+}
+
+func (c TrapCode) String() string {
+	if c < 0 || int(c) >= len(trapCodeNames) {
+		return "unknown"
+	}
+	return trapCodeNames[c]
+}
+
+// SourcePosition is a position in the original source of the wasm code, the
+// line and the column start from 1.
+type SourcePosition struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p SourcePosition) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Frame is a wasm function on the call stack of a trap
+type Frame struct {
+	FuncIndex uint32
+	// FuncName is resolved from the name section or the exports of the module
+	FuncName string
+	// ModuleOffset is the offset of the trapping instruction in the module
+	ModuleOffset uint
+	// Source is the position in the original source, nil without a source map
+	Source *SourcePosition
+}
+
+// Backtrace is the call stack of a trap, starting from the innermost frame
+type Backtrace []Frame
+
+func (b Backtrace) String() string {
+	var sb strings.Builder
+	for i, frame := range b {
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		fmt.Fprintf(&sb, "%d: %s (func[%d] @ 0x%x)", i, frame.FuncName, frame.FuncIndex, frame.ModuleOffset)
+		if frame.Source != nil {
+			fmt.Fprintf(&sb, " at %s", frame.Source)
+		}
+	}
+	return sb.String()
+}
+
+// Source returns the source position of the innermost frame which has one
+func (b Backtrace) Source() *SourcePosition {
+	for _, frame := range b {
+		if frame.Source != nil {
+			return frame.Source
+		}
+	}
+	return nil
+}
+
+// TrapError is a trap of the wasm execution
+type TrapError struct {
+	Code      TrapCode
+	Message   string
+	Backtrace Backtrace
+}
+
+func (e *TrapError) Error() string {
+	msg := fmt.Sprintf("wasm trap (%s): %s", e.Code, e.Message)
+	if source := e.Backtrace.Source(); source != nil {
+		msg += " at " + source.String()
+	}
+	return msg
+}
+
+// HostAPIError is returned when a host api called by the wasm code fails, Err
+// is the error returned by the host api.
+type HostAPIError struct {
+	Module    Module
+	Namespace NameSpace
+	Method    MethodName
+	Err       error
+}
+
+func (e *HostAPIError) Error() string {
+	return fmt.Sprintf("host api %s:%s.%s failed: %v", e.Module, e.Namespace, e.Method, e.Err)
+}
+
+func (e *HostAPIError) Unwrap() error {
+	return e.Err
+}
+
+// InstantiationError is returned when the wasm module cannot be instantiated
+type InstantiationError struct {
+	Err error
+}
+
+func (e *InstantiationError) Error() string {
+	return fmt.Sprintf("unable to instantiate wasm module: %v", e.Err)
+}
+
+func (e *InstantiationError) Unwrap() error {
+	return e.Err
+}
+
+// AbortError is returned when the wasm code calls abort, the position is the
+// one passed to abort, or resolved with the source map if there is none.
+type AbortError struct {
+	Message string
+	File    string
+	Line    int32
+	Column  int32
+
+	Backtrace Backtrace
+}
+
+func (e *AbortError) Error() string {
+	msg := "aborted"
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.File != "" {
+		msg += fmt.Sprintf(" at %s:%d:%d", e.File, e.Line, e.Column)
+	}
+	return msg
+}
+
+// ExitError is returned when the wasm code calls proc_exit of WASI
+type ExitError struct {
+	Code int32
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exited with code %d", e.Code)
+}
@@ -1,5 +1,11 @@
 package types
 
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
 type HostFuncGasRule interface {
 	SetContext(ctx VMContext)
 	ConsumeGas(dataSize int64) error
@@ -20,7 +26,7 @@ type StaticGasRule struct {
 }
 
 func (s *StaticGasRule) ConsumeGas(_ int64) error {
-	return s.ctx.ConsumeWASMGas(s.cost)
+	return s.ctx.GasMeter().ConsumeGas(s.cost)
 }
 
 func NewStaticGasRule(cost int64) *StaticGasRule {
@@ -44,5 +50,112 @@ func NewDynamicGasRule(fixedCost int64, multiplier int64) *DynamicGasRule {
 }
 
 func (d *DynamicGasRule) ConsumeGas(dataSize int64) error {
-	return d.ctx.ConsumeWASMGas(d.fixedCost + dataSize*d.multiplier)
+	return d.ctx.GasMeter().ConsumeGas(d.fixedCost + dataSize*d.multiplier)
+}
+
+// GasMeter tracks the gas of an aspect call in WASM gas, the wasm code, the
+// host apis and the EVM gas conversions all read and write the same meter.
+type GasMeter interface {
+	// ConsumeGas charges the given gas, if there is not enough gas left the
+	// meter is drained and OutOfGasError is returned.
+	ConsumeGas(gas int64) error
+
+	// RefundGas gives back gas which has been consumed
+	RefundGas(gas int64) error
+
+	// RemainingGas returns the gas left, OutOfGasError is returned if the meter has been drained
+	RemainingGas() (int64, error)
+
+	// Child creates a nested meter capped at limit, the gas consumed and
+	// refunded with the child meter is applied to this meter as well.
+	Child(limit int64) (GasMeter, error)
+}
+
+// EVMGasToWASMGas converts EVM gas to WASM gas, the result is capped at math.MaxInt64
+func EVMGasToWASMGas(gas int64) int64 {
+	if gas > MaxGas {
+		return math.MaxInt64
+	}
+	return gas * EVMGasToWASMGasMultiplier
+}
+
+// WASMGasToEVMGas converts WASM gas to EVM gas, the remainder below one EVM gas is dropped
+func WASMGasToEVMGas(gas int64) int64 {
+	return gas / EVMGasToWASMGasMultiplier
+}
+
+// ChildGasMeter is a GasMeter with its own limit, all the gas it consumes is
+// charged to its parent meter at the same time.
+type ChildGasMeter struct {
+	parent GasMeter
+	limit  int64
+	used   int64
+}
+
+// NewChildGasMeter creates a meter nested in parent, capped at limit
+func NewChildGasMeter(parent GasMeter, limit int64) (*ChildGasMeter, error) {
+	if limit < 0 {
+		return nil, errors.New("negative gas limit")
+	}
+	return &ChildGasMeter{
+		parent: parent,
+		limit:  limit,
+	}, nil
+}
+
+func (m *ChildGasMeter) ConsumeGas(gas int64) error {
+	if gas < 0 {
+		return errors.New("negative gas")
+	}
+
+	if gas > m.limit-m.used {
+		// drain the budget of the child only, the parent keeps what is beyond the limit
+		if err := m.parent.ConsumeGas(m.limit - m.used); err != nil {
+			return err
+		}
+		m.used = m.limit
+		return OutOfGasError
+	}
+
+	if err := m.parent.ConsumeGas(gas); err != nil {
+		m.used = m.limit
+		return err
+	}
+	m.used += gas
+	return nil
+}
+
+func (m *ChildGasMeter) RefundGas(gas int64) error {
+	if gas < 0 || gas > m.used {
+		return errors.New("invalid gas refund")
+	}
+	if err := m.parent.RefundGas(gas); err != nil {
+		return err
+	}
+	m.used -= gas
+	return nil
+}
+
+func (m *ChildGasMeter) RemainingGas() (int64, error) {
+	if m.used >= m.limit {
+		return 0, OutOfGasError
+	}
+
+	remaining, err := m.parent.RemainingGas()
+	if err != nil {
+		return 0, err
+	}
+	if left := m.limit - m.used; left < remaining {
+		return left, nil
+	}
+	return remaining, nil
+}
+
+func (m *ChildGasMeter) Child(limit int64) (GasMeter, error) {
+	return NewChildGasMeter(m, limit)
+}
+
+// GasUsed returns the gas consumed with this meter
+func (m *ChildGasMeter) GasUsed() int64 {
+	return m.used
 }
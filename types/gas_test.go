@@ -0,0 +1,82 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockedGasMeter struct {
+	gas int64
+}
+
+func (m *mockedGasMeter) ConsumeGas(gas int64) error {
+	if m.gas < gas {
+		m.gas = -1
+		return OutOfGasError
+	}
+	m.gas -= gas
+	return nil
+}
+
+func (m *mockedGasMeter) RefundGas(gas int64) error {
+	m.gas += gas
+	return nil
+}
+
+func (m *mockedGasMeter) RemainingGas() (int64, error) {
+	if m.gas < 0 {
+		return 0, OutOfGasError
+	}
+	return m.gas, nil
+}
+
+func (m *mockedGasMeter) Child(limit int64) (GasMeter, error) {
+	return NewChildGasMeter(m, limit)
+}
+
+func TestChildGasMeter(t *testing.T) {
+	parent := &mockedGasMeter{gas: 1000}
+
+	child, err := parent.Child(100)
+	require.Equal(t, nil, err)
+
+	require.Equal(t, nil, child.ConsumeGas(30))
+	remaining, err := child.RemainingGas()
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(70), remaining)
+	require.Equal(t, int64(970), parent.gas)
+
+	require.Equal(t, nil, child.RefundGas(10))
+	require.Equal(t, int64(980), parent.gas)
+
+	// nested meters are capped by the smallest limit
+	grandChild, err := child.Child(500)
+	require.Equal(t, nil, err)
+	remaining, err = grandChild.RemainingGas()
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(80), remaining)
+
+	// exceeding the limit only drains the child budget
+	require.Equal(t, OutOfGasError, child.ConsumeGas(200))
+	require.Equal(t, int64(900), parent.gas)
+	_, err = child.RemainingGas()
+	require.Equal(t, OutOfGasError, err)
+
+	// the parent running out of gas stops the child as well
+	small := &mockedGasMeter{gas: 10}
+	child, err = small.Child(100)
+	require.Equal(t, nil, err)
+	require.Equal(t, OutOfGasError, child.ConsumeGas(20))
+	_, err = child.RemainingGas()
+	require.Equal(t, OutOfGasError, err)
+
+	_, err = parent.Child(-1)
+	require.NotNil(t, err)
+}
+
+func TestGasConversion(t *testing.T) {
+	require.Equal(t, int64(1000), EVMGasToWASMGas(1))
+	require.Equal(t, int64(1), WASMGasToEVMGas(1999))
+	require.Equal(t, int64(MaxGas*EVMGasToWASMGasMultiplier), EVMGasToWASMGas(MaxGas))
+}
@@ -0,0 +1,101 @@
+package types
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// ReadHostParams reads the arguments of a host api from the pointers passed by
+// the wasm code, it also returns the total size of the data read, which is
+// charged by the gas rule of the host api.
+func ReadHostParams(ctx VMContext, ptrs ...int32) ([]reflect.Value, int64, error) {
+	args := make([]reflect.Value, len(ptrs))
+	paramSize := int64(0)
+
+	if len(args) == 0 {
+		return args, paramSize, nil
+	}
+
+	for i, ptr := range ptrs {
+		h := &TypeHeader{}
+		header, err := ctx.ReadMemory(ptr, HeaderLen)
+		if err != nil {
+			return nil, paramSize, err
+		}
+
+		dataType, dataLen, err := h.Unmarshal(header)
+		if err != nil {
+			return nil, paramSize, err
+		}
+
+		paramSize += int64(dataLen)
+
+		reqType, err := TypeObjectMapping(dataType)
+		if err != nil {
+			return nil, paramSize, err
+		}
+
+		reqData, err := ctx.ReadMemory(ptr, HeaderLen+dataLen)
+		if err != nil {
+			return nil, paramSize, err
+		}
+
+		value, err := reqType.Unmarshal(reqData)
+		if err != nil {
+			return nil, paramSize, err
+		}
+		args[i] = reflect.ValueOf(value)
+	}
+
+	return args, paramSize, nil
+}
+
+func storeValue(ctx VMContext, value reflect.Value) (int32, error) {
+	retIndex := AssertType(value.Interface())
+
+	resType, err := TypeObjectMapping(retIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	data := resType.Marshal(value.Interface())
+	ptr, err := ctx.AllocMemory(int32(len(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := ctx.WriteMemory(ptr, data); err != nil {
+		return 0, err
+	}
+
+	return ptr, nil
+}
+
+// WriteHostResults writes the results of a host api into the memory and
+// returns their pointers, the last result must be an error, which is
+// returned instead if it is not nil.
+func WriteHostResults(ctx VMContext, values []reflect.Value) ([]int32, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	lastRetVal := values[len(values)-1].Interface()
+	if _, ok := lastRetVal.(error); !ok && lastRetVal != nil {
+		return nil, errors.New("invalid host func, last return value must be error")
+	} else if ok && lastRetVal != nil {
+		return nil, lastRetVal.(error)
+	}
+
+	valuesLen := len(values) - 1
+	int32Ary := make([]int32, valuesLen)
+	for i, value := range values[:valuesLen] {
+		i2, err := storeValue(ctx, value)
+		if err != nil {
+			return nil, err
+		}
+		int32Ary[i] = i2
+	}
+
+	return int32Ary, nil
+}
@@ -0,0 +1,129 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHookGas is the EVM gas budget of each default lifecycle hook
+const DefaultHookGas = 1_000_000
+
+// LifecycleHook is an optional export without parameters called by the runtime
+type LifecycleHook struct {
+	Export string
+
+	// Gas is the EVM gas budget of the hook
+	Gas int64
+}
+
+// Lifecycle are the lifecycle hooks of an aspect. A hook is only used if the
+// aspect exports it, and fails the call if it fails.
+type Lifecycle struct {
+	// Init runs once per instance after the start function, its gas is
+	// charged to the call initializing the instance like the gas of the start
+	// function. A snapshot keeps the instance initialized, its gas is
+	// charged to each call restored from it with the gas of the start function.
+	Init LifecycleHook
+
+	// PreCall and PostCall run before and after each call, their gas is
+	// charged to the call
+	PreCall  LifecycleHook
+	PostCall LifecycleHook
+
+	// Teardown runs before an initialized instance is dropped, i.e. when the
+	// runtime is reset without a snapshot or destroyed, e.g. evicted from the
+	// pool. Its gas is not charged and its failures are only logged.
+	Teardown LifecycleHook
+}
+
+// DefaultLifecycle are the hooks used if the runtime is not configured with others
+var DefaultLifecycle = Lifecycle{
+	Init:     LifecycleHook{Export: "__aspect_init__", Gas: DefaultHookGas},
+	PreCall:  LifecycleHook{Export: "__aspect_pre_call__", Gas: DefaultHookGas},
+	PostCall: LifecycleHook{Export: "__aspect_post_call__", Gas: DefaultHookGas},
+	Teardown: LifecycleHook{Export: "__aspect_teardown__", Gas: DefaultHookGas},
+}
+
+// Hash returns the hash of the hooks, used to pool runtimes with different hooks separately
+func (l *Lifecycle) Hash() []byte {
+	var buf []byte
+	for _, hook := range []LifecycleHook{l.Init, l.PreCall, l.PostCall, l.Teardown} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(hook.Export)))
+		buf = append(buf, hook.Export...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(hook.Gas))
+	}
+
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
+
+// RunHook calls a lifecycle hook with its own gas budget. The gas used by a
+// charged hook is charged to the gas of the call, which also limits the
+// budget, the gas of the call is left untouched by the other hooks.
+func RunHook(e CallEngine, name string, hook LifecycleHook, charged bool) error {
+	if hook.Export == "" {
+		return nil
+	}
+
+	ctx := e.VMContext()
+	remaining, err := ctx.RemainingWASMGas()
+	if err != nil {
+		if charged {
+			return err
+		}
+		remaining = 0
+	}
+
+	budget := EVMGasToWASMGas(hook.Gas)
+	if charged && budget > remaining {
+		budget = remaining
+	}
+	if err := ctx.SetWASMGas(budget); err != nil {
+		return err
+	}
+
+	e.Logger().Debug("running lifecycle hook", "hook", name, "export", hook.Export, "gas", hook.Gas)
+	_, callErr := e.Invoke(hook.Export)
+
+	left, err := ctx.RemainingWASMGas()
+	if err != nil {
+		// the hook is out of gas
+		left = 0
+	}
+	if err := ctx.SetWASMGas(remaining); err != nil {
+		return err
+	}
+
+	if charged {
+		hookMeter, err := NewChildGasMeter(ctx.GasMeter(), budget)
+		if err != nil {
+			return err
+		}
+		if err := hookMeter.ConsumeGas(budget - left); err != nil {
+			return err
+		}
+	}
+
+	if callErr != nil {
+		return errors.WithMessagef(callErr, "%s hook %s failed", name, hook.Export)
+	}
+	return nil
+}
+
+// Teardown runs the teardown hook of an initialized instance before it is
+// dropped, the engine checks that the instance is initialized and alive
+func Teardown(e CallEngine) {
+	logger := e.Logger()
+
+	// the last call may have trapped in the middle of the stack
+	if err := e.ResetStackHeight(); err != nil {
+		logger.Error("failed to reset stack height", "err", err)
+	}
+	if err := RunHook(e, "teardown", e.Hooks().Teardown, false); err != nil {
+		logger.Error("failed to tear down aspect", "err", err)
+	} else {
+		logger.Info("aspect torn down")
+	}
+}
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+)
+
+// NativeArgs converts the arguments of an export to the values of its
+// parameters, params are the value types of the parameters, one for each
+// argument. The arguments taken natively are converted by NativeArg, the
+// others are marshaled into the memory allocated by alloc and passed as
+// pointers.
+func NativeArgs(ctx VMContext, params []byte, args []interface{}, alloc func(size int32) (int32, error)) ([]interface{}, error) {
+	vals := make([]interface{}, len(args))
+	for i, arg := range args {
+		native, ok, err := NativeArg(params[i], arg)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "argument %d", i)
+		}
+		if ok {
+			vals[i] = native
+			continue
+		}
+
+		typeIndex := AssertType(arg)
+		rtType, err := TypeObjectMapping(typeIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		data := rtType.Marshal(arg)
+		ptr, err := alloc(int32(len(data)))
+
+		ctx.Logger().Debug("input data length", "index", i, "len", len(data), "type", typeIndex.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ctx.WriteMemory(ptr, data); err != nil {
+			return nil, err
+		}
+
+		vals[i] = ptr
+	}
+	return vals, nil
+}
+
+// NativeArg converts the argument of an export to the int32, int64, float32
+// or float64 value of the parameter, if the parameter takes it natively.
+// Pointers of the header protocol are i32, so the sized Go types passed to i32
+// parameters keep being marshaled into the memory, only Go int is passed as a
+// native i32. The other value types are never pointers, and always take
+// native values.
+func NativeArg(kind byte, arg interface{}) (interface{}, bool, error) {
+	switch kind {
+	case instrument.ValueI32:
+		v, ok := arg.(int)
+		if !ok {
+			return nil, false, nil
+		}
+		if v < math.MinInt32 || int64(v) > math.MaxUint32 {
+			return nil, false, errors.Errorf("value %d overflows i32", v)
+		}
+		// unsigned values are passed with the same bits
+		return int32(uint32(v)), true, nil
+
+	case instrument.ValueI64:
+		switch v := arg.(type) {
+		case int:
+			return int64(v), true, nil
+		case int8:
+			return int64(v), true, nil
+		case int16:
+			return int64(v), true, nil
+		case int32:
+			return int64(v), true, nil
+		case int64:
+			return v, true, nil
+		case uint8:
+			return int64(v), true, nil
+		case uint16:
+			return int64(v), true, nil
+		case uint32:
+			return int64(v), true, nil
+		case uint64:
+			// unsigned values are passed with the same bits
+			return int64(v), true, nil
+		}
+
+	case instrument.ValueF32:
+		switch v := arg.(type) {
+		case float32:
+			return v, true, nil
+		case float64:
+			return float32(v), true, nil
+		}
+
+	case instrument.ValueF64:
+		switch v := arg.(type) {
+		case float32:
+			return float64(v), true, nil
+		case float64:
+			return v, true, nil
+		}
+	}
+
+	return nil, false, errors.WithMessagef(UnsupportedTypeError, "%T for %s parameter", arg, valueTypeName(kind))
+}
+
+// valueTypeName returns the name of a wasm value type
+func valueTypeName(kind byte) string {
+	switch kind {
+	case instrument.ValueI32:
+		return "i32"
+	case instrument.ValueI64:
+		return "i64"
+	case instrument.ValueF32:
+		return "f32"
+	case instrument.ValueF64:
+		return "f64"
+	}
+	return fmt.Sprintf("0x%02x", kind)
+}
@@ -0,0 +1,41 @@
+package types
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+)
+
+func TestNativeArg(t *testing.T) {
+	tests := []struct {
+		kind   byte
+		arg    interface{}
+		native interface{}
+		ok     bool
+	}{
+		{instrument.ValueI32, 7, int32(7), true},
+		{instrument.ValueI32, -1, int32(-1), true},
+		// sized types of i32 parameters are pointers of the header protocol
+		{instrument.ValueI32, int32(7), nil, false},
+		{instrument.ValueI32, "str", nil, false},
+		{instrument.ValueI64, int32(-7), int64(-7), true},
+		{instrument.ValueI64, uint64(math.MaxUint64), int64(-1), true},
+		{instrument.ValueF32, 1.5, float32(1.5), true},
+		{instrument.ValueF64, float32(1.5), 1.5, true},
+	}
+
+	for i, test := range tests {
+		native, ok, err := NativeArg(test.kind, test.arg)
+		require.NoError(t, err, i)
+		require.Equal(t, test.ok, ok, i)
+		require.Equal(t, test.native, native, i)
+	}
+
+	_, _, err := NativeArg(instrument.ValueI64, "str")
+	require.ErrorIs(t, err, UnsupportedTypeError)
+	_, _, err = NativeArg(instrument.ValueF64, 1)
+	require.ErrorIs(t, err, UnsupportedTypeError)
+}
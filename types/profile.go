@@ -0,0 +1,110 @@
+package types
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// GasProfile is the gas breakdown of the last aspect call, it is only
+// collected when the runtime is created with profiling enabled.
+// All gas values are in WASM gas.
+type GasProfile struct {
+	Method string
+
+	// GasUsed is the total gas consumed by the call, including init
+	GasUsed int64
+
+	// Functions are the wasm functions executed during the call
+	Functions []FunctionGas
+
+	// HostAPIs are the host apis invoked during the call, the gas of a host api
+	// does not include the wasm code it called back into (e.g. allocations).
+	HostAPIs []HostAPIGas
+
+	// Unattributed is the gas that cannot be assigned to a function or host api,
+	// e.g. gas consumed by frames that never returned because of a trap.
+	Unattributed int64
+}
+
+// FunctionGas is the gas used by a single wasm function
+type FunctionGas struct {
+	Index uint32
+	Name  string
+	Calls int64
+
+	// SelfGas is the gas consumed by the function body itself
+	SelfGas int64
+
+	// TotalGas is the gas consumed by the function and everything it called,
+	// recursive calls are counted once per frame.
+	TotalGas int64
+}
+
+// HostAPIGas is the gas used by a single host api
+type HostAPIGas struct {
+	Module    Module
+	NameSpace NameSpace
+	Method    MethodName
+	Calls     int64
+	Gas       int64
+}
+
+// Name returns the display name of the host api
+func (h *HostAPIGas) Name() string {
+	return fmt.Sprintf("%s:%s.%s", h.Module, h.NameSpace, h.Method)
+}
+
+// Sort orders the functions and host apis by gas usage, most expensive first
+func (p *GasProfile) Sort() {
+	sort.SliceStable(p.Functions, func(i, j int) bool {
+		return p.Functions[i].SelfGas > p.Functions[j].SelfGas
+	})
+	sort.SliceStable(p.HostAPIs, func(i, j int) bool {
+		return p.HostAPIs[i].Gas > p.HostAPIs[j].Gas
+	})
+}
+
+// WritePprof writes the profile in the gzipped pprof protobuf format, the
+// output can be inspected with `go tool pprof`.
+func (p *GasProfile) WritePprof(w io.Writer) error {
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "calls", Unit: "count"},
+			{Type: "gas", Unit: "gas"},
+		},
+		PeriodType: &profile.ValueType{Type: "gas", Unit: "gas"},
+		Period:     1,
+		Comments:   []string{"aspect method: " + p.Method},
+	}
+
+	addSample := func(name string, calls, gas int64) {
+		id := uint64(len(prof.Function) + 1)
+		fn := &profile.Function{ID: id, Name: name, SystemName: name}
+		loc := &profile.Location{ID: id, Line: []profile.Line{{Function: fn}}}
+		prof.Function = append(prof.Function, fn)
+		prof.Location = append(prof.Location, loc)
+		prof.Sample = append(prof.Sample, &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{calls, gas},
+		})
+	}
+
+	for _, fn := range p.Functions {
+		addSample(fn.Name, fn.Calls, fn.SelfGas)
+	}
+	for i := range p.HostAPIs {
+		api := &p.HostAPIs[i]
+		addSample("[host] "+api.Name(), api.Calls, api.Gas)
+	}
+	if p.Unattributed != 0 {
+		addSample("[unattributed]", 0, p.Unattributed)
+	}
+
+	if err := prof.CheckValid(); err != nil {
+		return err
+	}
+	return prof.Write(w)
+}
@@ -9,15 +9,18 @@ type (
 type HostFuncWrapper func(api *HostAPIRegistry, module Module, ns NameSpace, method MethodName, hostFunc *HostFuncWithGasRule) (interface{}, error)
 
 type HostFuncWithGasRule struct {
-	Func        interface{}
-	GasRule     HostFuncGasRule
-	HostContext HostContext
+	Func    interface{}
+	GasRule HostFuncGasRule
 }
 
 type HostAPIRegistry struct {
 	// a function defined in Module::Namespace::MethodName
 	wrapperFuncs map[Module]map[NameSpace]map[MethodName]interface{}
 
+	// hostFuncs are the host apis before wrapping, so that engines which cannot
+	// call the wrapped functions can wrap them on their own
+	hostFuncs map[Module]map[NameSpace]map[MethodName]*HostFuncWithGasRule
+
 	hostFuncWrapper HostFuncWrapper
 
 	ctx VMContext
@@ -28,6 +31,7 @@ type HostAPIRegistry struct {
 func NewHostAPIRegistry(ctx HostContext, hostFuncWrapper HostFuncWrapper) *HostAPIRegistry {
 	return &HostAPIRegistry{
 		wrapperFuncs:    make(map[Module]map[NameSpace]map[MethodName]interface{}),
+		hostFuncs:       make(map[Module]map[NameSpace]map[MethodName]*HostFuncWithGasRule),
 		hostFuncWrapper: hostFuncWrapper,
 		hostCtx:         ctx,
 	}
@@ -52,6 +56,16 @@ func (h *HostAPIRegistry) AddAPI(module Module, ns NameSpace, method MethodName,
 	}
 
 	h.wrapperFuncs[module][ns][method] = wrapper
+
+	if h.hostFuncs[module] == nil {
+		h.hostFuncs[module] = make(map[NameSpace]map[MethodName]*HostFuncWithGasRule, 1)
+	}
+
+	if h.hostFuncs[module][ns] == nil {
+		h.hostFuncs[module][ns] = make(map[MethodName]*HostFuncWithGasRule, 1)
+	}
+
+	h.hostFuncs[module][ns][method] = hostFunc
 	return nil
 }
 
@@ -59,6 +73,11 @@ func (h *HostAPIRegistry) WrapperFuncs() map[Module]map[NameSpace]map[MethodName
 	return h.wrapperFuncs
 }
 
+// HostFuncs returns the host apis as they are added, keyed the same way as WrapperFuncs
+func (h *HostAPIRegistry) HostFuncs() map[Module]map[NameSpace]map[MethodName]*HostFuncWithGasRule {
+	return h.hostFuncs
+}
+
 func (h *HostAPIRegistry) SetContext(ctx VMContext) {
 	h.ctx = ctx
 	h.hostCtx.SetVMContext(ctx)
@@ -66,4 +85,5 @@ func (h *HostAPIRegistry) SetContext(ctx VMContext) {
 
 func (h *HostAPIRegistry) Destroy() {
 	h.wrapperFuncs = nil
+	h.hostFuncs = nil
 }
@@ -0,0 +1,82 @@
+package types
+
+import "time"
+
+// CallResult is the result of an aspect call with the statistics of the
+// execution, it is also returned when the call fails.
+type CallResult struct {
+	// Value is the decoded return value, nil if the call fails
+	Value interface{}
+
+	// GasUsed and GasLeft are in EVM gas, the gas used includes init
+	GasUsed int64
+	GasLeft int64
+
+	// WASMGasUsed and WASMGasLeft are the same gas in WASM gas
+	WASMGasUsed int64
+	WASMGasLeft int64
+
+	// HostCalls is the number of calls of each host api, keyed by module:namespace.method
+	HostCalls map[string]int64
+
+	// PeakMemory is the size of the linear memory in bytes, the memory never
+	// shrinks so it is the peak of the call
+	PeakMemory int64
+
+	// Initialized is false if the start function was skipped, i.e. the
+	// instance was restored from a snapshot
+	Initialized bool
+
+	// InitDuration and ExecDuration are the wall time of the initialization
+	// and of the execution of the method
+	InitDuration time.Duration
+	ExecDuration time.Duration
+
+	// Err is the error of the call, the same as the error returned with the result
+	Err error
+}
+
+// GasBudget is how the gas of a batch is given to its calls
+type GasBudget int
+
+const (
+	// SharedGas gives the gas of the batch to all the calls, each call uses
+	// the gas left by the previous ones
+	SharedGas GasBudget = iota
+
+	// PerCallGas gives each call the gas of its BatchCall
+	PerCallGas
+)
+
+// FailurePolicy is what a batch does after a failed call
+type FailurePolicy int
+
+const (
+	// StopOnFailure skips the rest of the calls after a failed call
+	StopOnFailure FailurePolicy = iota
+
+	// ContinueOnFailure runs the rest of the calls after a failed call, unless
+	// the batch is interrupted or its shared gas has run out
+	ContinueOnFailure
+)
+
+// BatchCall is a call of a batch
+type BatchCall struct {
+	Method string
+	Args   []interface{}
+
+	// Gas is the EVM gas of the call with PerCallGas, the init of the
+	// instance is charged to the first call
+	Gas int64
+}
+
+// Batch is an ordered list of calls run in one initialized instance
+type Batch struct {
+	Calls []BatchCall
+
+	// Gas is the EVM gas of the whole batch with SharedGas
+	Gas int64
+
+	Budget    GasBudget
+	OnFailure FailurePolicy
+}
@@ -89,6 +89,6 @@ func TypeObjectMapping(index TypeIndex) (IType, error) {
 	case TypeUint64:
 		return NewUint64(), nil
 	default:
-		return nil, errors.Errorf("type of index %d is not valid", index)
+		return nil, errors.WithMessagef(UnsupportedTypeError, "type of index %d", index)
 	}
 }
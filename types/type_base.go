@@ -2,6 +2,8 @@ package types
 
 import (
 	"context"
+
+	"github.com/artela-network/aspect-runtime/instrument"
 )
 
 // IType is the interface of all runtime types
@@ -13,9 +15,9 @@ type IType interface {
 	Unmarshal(data []byte) (interface{}, error)
 }
 
+// HostContext is the context of the host apis, the gas of a host api is
+// charged with the GasMeter of the VMContext.
 type HostContext interface {
-	RemainingGas() uint64
-	SetGas(gas uint64)
 	SetVMContext(vmContext VMContext)
 }
 
@@ -30,6 +32,7 @@ type VMContext interface {
 	ConsumeWASMGas(gas int64) error
 	AddEVMGas(gas int64) error
 	SetWASMGas(gas int64) error
+	GasMeter() GasMeter
 	Logger() Logger
 }
 
@@ -42,14 +45,45 @@ type Logger interface {
 }
 
 type AspectRuntime interface {
+	// Call calls the exported method with the gas limit, and returns the result
+	// and the gas left. Arguments of i32 parameters are marshaled into the
+	// memory and passed as pointers, except for Go int which is passed as the
+	// i32 value, so e.g. an int32 argument arrives as the pointer to the
+	// marshaled int32. Arguments of i64, f32 and f64 parameters are passed as
+	// their values.
 	Call(method string, gas int64, args ...interface{}) (interface{}, int64, error)
+
+	// CallWithResult calls the method like Call, the result carries the
+	// statistics of the execution and is returned even if the call fails.
+	CallWithResult(method string, gas int64, args ...interface{}) (*CallResult, error)
+
+	// CallBatch calls the methods of the batch in order in one initialized
+	// instance. The results of the calls which have run are returned, with the
+	// first error of the batch.
+	CallBatch(batch *Batch) ([]*CallResult, error)
+
 	Destroy()
 	Reset()
 	ResetStore(ctx context.Context, apis *HostAPIRegistry) error
 	Context() context.Context
 	Logger() Logger
+
+	// GasProfile returns the gas breakdown of the last call,
+	// nil if the runtime is not created with profiling enabled.
+	GasProfile() *GasProfile
+
+	// Interrupt stops the running call with InterruptedError, or the next call
+	// if none is running. It is safe to be called from any goroutine.
+	Interrupt()
 }
 
 type Validator interface {
 	Validate([]byte) error
 }
+
+// ValidateAspect checks the aspect rules shared by the validators of all the
+// engines, on top of the wasm validation of the engine, see
+// instrument.ValidateAspect. The entrypoint is the start of DefaultABI.
+func ValidateAspect(code []byte) error {
+	return instrument.ValidateAspect(code, DefaultABI.Start)
+}
@@ -0,0 +1,71 @@
+package types
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// WASIConfig enables a deterministic subset of wasi_snapshot_preview1 for the
+// aspects built with toolchains depending on it, e.g. Rust and TinyGo. The
+// output to stdout and stderr goes to the logger of the runtime, the clocks
+// and the random bytes are derived from the WASISeed of the context, and the
+// filesystem is denied.
+type WASIConfig struct {
+	// Args and Env are the arguments and the environment variables (KEY=value) of the aspect
+	Args []string
+	Env  []string
+
+	// CallCost is the WASM gas charged for each WASI call, and ByteCost for
+	// each byte read or written by the call
+	CallCost int64
+	ByteCost int64
+}
+
+// DefaultWASIConfig is a WASI config without arguments and environment variables
+var DefaultWASIConfig = WASIConfig{
+	CallCost: 1000,
+	ByteCost: 10,
+}
+
+// Hash returns the hash of the config, used to pool runtimes with different configs separately
+func (c *WASIConfig) Hash() []byte {
+	var buf []byte
+	for _, list := range [][]string{c.Args, c.Env} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(list)))
+		for _, item := range list {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(item)))
+			buf = append(buf, item...)
+		}
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.CallCost))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.ByteCost))
+
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
+
+// WASISeed is the host provided state of the WASI clocks and random bytes,
+// e.g. the time and the hash of the block. The same seed gives the same values
+// to each call.
+type WASISeed struct {
+	// Time is the time of the realtime clock in nanoseconds since the epoch
+	Time int64
+
+	// Random seeds the random bytes
+	Random []byte
+}
+
+type wasiSeedKey struct{}
+
+// ContextWithWASISeed returns a context carrying the WASI seed of the calls of
+// the runtime created or reset with it
+func ContextWithWASISeed(ctx context.Context, seed WASISeed) context.Context {
+	return context.WithValue(ctx, wasiSeedKey{}, seed)
+}
+
+// WASISeedFromContext returns the WASI seed of the context, the zero seed is used without one
+func WASISeedFromContext(ctx context.Context) WASISeed {
+	seed, _ := ctx.Value(wasiSeedKey{}).(WASISeed)
+	return seed
+}
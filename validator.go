@@ -3,7 +3,7 @@ package runtime
 import (
 	"context"
 	"github.com/artela-network/aspect-runtime/types"
-	"github.com/artela-network/aspect-runtime/wasmtime"
+	"github.com/artela-network/aspect-runtime/wazero"
 	"github.com/pkg/errors"
 	"sync"
 )
@@ -12,7 +12,7 @@ type validatorConstructor func(ctx context.Context, logger types.Logger) (types.
 
 var (
 	validatorRegistry = map[RuntimeType]validatorConstructor{
-		WASM: wasmtime.NewWASMTimeValidator,
+		WAZERO: wazero.NewWazeroValidator,
 	}
 	validatorCache sync.Map
 )
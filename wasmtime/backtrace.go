@@ -0,0 +1,64 @@
+package wasmtime
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// backtrace resolves the frames of a trap with the function names of the module,
+// and the positions in the original source if there is a source map
+func (w *wasmTimeRuntime) backtrace(trap *wasmtime.Trap) types.Backtrace {
+	frames := trap.Frames()
+	backtrace := make(types.Backtrace, 0, len(frames))
+	for _, frame := range frames {
+		index := frame.FuncIndex()
+		name, ok := w.compiled.names[index]
+		if !ok {
+			if funcName := frame.FuncName(); funcName != nil {
+				name = *funcName
+			} else {
+				name = fmt.Sprintf("func[%d]", index)
+			}
+		}
+
+		f := types.Frame{
+			FuncIndex:    index,
+			FuncName:     name,
+			ModuleOffset: frame.ModuleOffset(),
+		}
+		// the offsets of the profiled code are moved by the profiler, which
+		// is not known to the resolver
+		if w.config.Sources != nil && !w.config.Profiling {
+			if source, ok := w.config.Sources.Resolve(index, f.ModuleOffset); ok {
+				f.Source = &source
+			}
+		}
+		backtrace = append(backtrace, f)
+	}
+	return backtrace
+}
+
+// aspectKey identifies the code of the runtime in the logs
+func (w *wasmTimeRuntime) aspectKey() string {
+	return hex.EncodeToString(w.compiled.key.codeHash[:8])
+}
+
+// trapMessage extracts the cause of a trap from its message, the backtrace
+// formatted by the engine is dropped since it is resolved by backtrace.
+func trapMessage(trap *wasmtime.Trap) string {
+	msg := trap.Message()
+	if i := strings.Index(msg, "Caused by:"); i >= 0 {
+		msg = msg[i+len("Caused by:"):]
+	}
+
+	msg = strings.TrimSpace(msg)
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	return strings.TrimPrefix(msg, "wasm trap: ")
+}
@@ -0,0 +1,220 @@
+package wasmtime
+
+import (
+	"crypto/sha256"
+	"os"
+	"sync"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// engineKey identifies the options of the engine config, see defaultWASMTimeConfig
+type engineKey struct {
+	metering      types.GasMetering
+	maxMemorySize int64
+	maxWasmStack  int64
+}
+
+func newEngineKey(config *types.RuntimeConfig) engineKey {
+	limits := config.Limits()
+	return engineKey{
+		metering:      config.Metering,
+		maxMemorySize: limits.MaxMemorySize,
+		maxWasmStack:  limits.MaxWasmStack,
+	}
+}
+
+// engines are shared by all runtimes of the process, one for each engine
+// config. Engines are thread-safe and never closed.
+var engines = struct {
+	sync.Mutex
+	m map[engineKey]*wasmtime.Engine
+}{m: make(map[engineKey]*wasmtime.Engine)}
+
+func sharedEngine(config *types.RuntimeConfig) *wasmtime.Engine {
+	engines.Lock()
+	defer engines.Unlock()
+
+	key := newEngineKey(config)
+	engine, ok := engines.m[key]
+	if !ok {
+		engine = wasmtime.NewEngineWithConfig(defaultWASMTimeConfig(config))
+		engines.m[key] = engine
+	}
+	return engine
+}
+
+// moduleKey identifies a compiled module by the engine and the hash of the code
+type moduleKey struct {
+	engine    engineKey
+	profiling bool
+	codeHash  [sha256.Size]byte
+}
+
+// compiledModule is a module shared by the runtimes of the same code, it is
+// closed once the last runtime releases it.
+type compiledModule struct {
+	key    moduleKey
+	module *wasmtime.Module
+
+	// functions are the profiled functions if profiling is enabled
+	functions []instrument.ProfiledFunction
+
+	// names are the function names of the module, keyed by function index
+	names map[uint32]string
+
+	// ready is closed once the module is compiled or err is set
+	ready chan struct{}
+	err   error
+
+	refs int
+}
+
+var modules = struct {
+	sync.Mutex
+	m map[moduleKey]*compiledModule
+}{m: make(map[moduleKey]*compiledModule)}
+
+// CachedModules returns the number of compiled modules held by the runtimes
+func CachedModules() int {
+	modules.Lock()
+	defer modules.Unlock()
+
+	return len(modules.m)
+}
+
+// acquireModule returns the compiled module of the code, the code is only
+// compiled if none of the living runtimes holds it, concurrent callers of the
+// same code wait for a single compilation. The module must be released with
+// releaseModule after use.
+func acquireModule(logger types.Logger, engine *wasmtime.Engine, code []byte, config *types.RuntimeConfig) (*compiledModule, error) {
+	key := moduleKey{
+		engine:    newEngineKey(config),
+		profiling: config.Profiling,
+		codeHash:  sha256.Sum256(code),
+	}
+
+	modules.Lock()
+	if cached, ok := modules.m[key]; ok {
+		cached.refs++
+		modules.Unlock()
+
+		<-cached.ready
+		if cached.err != nil {
+			releaseModule(cached)
+			return nil, cached.err
+		}
+		logger.Debug("compiled module cache hit")
+		return cached, nil
+	}
+
+	compiled := &compiledModule{key: key, refs: 1, ready: make(chan struct{})}
+	modules.m[key] = compiled
+	modules.Unlock()
+
+	compiled.err = compiled.compile(logger, engine, code, config)
+	if compiled.err != nil {
+		// drop the failed entry, so that the next caller tries again
+		modules.Lock()
+		delete(modules.m, key)
+		modules.Unlock()
+	}
+	close(compiled.ready)
+
+	if compiled.err != nil {
+		releaseModule(compiled)
+		return nil, compiled.err
+	}
+	return compiled, nil
+}
+
+func (c *compiledModule) compile(logger types.Logger, engine *wasmtime.Engine, code []byte, config *types.RuntimeConfig) (err error) {
+	if config.Profiling {
+		release := types.AcquireCompileSlot()
+		code, c.functions, err = instrument.InjectProfiler(code)
+		release()
+		if err != nil {
+			logger.Error("failed to inject profiler", "err", err)
+			return errors.Wrap(err, "unable to inject profiler")
+		}
+	}
+
+	c.names = functionNames(logger, code)
+	c.module, err = loadModule(logger, engine, c.key, code)
+	return err
+}
+
+// functionNames collects the names of the functions for the backtraces of traps
+func functionNames(logger types.Logger, code []byte) map[uint32]string {
+	m, err := instrument.DecodeModule(code)
+	if err != nil {
+		// the traps are reported with the function indices only
+		logger.Error("failed to decode function names", "err", err)
+		return nil
+	}
+
+	names := make(map[uint32]string, len(m.FunctionNames))
+	for index, name := range m.FunctionNames {
+		names[index] = name
+	}
+	for _, export := range m.Exports {
+		if _, ok := names[export.Index]; !ok && export.Kind == instrument.ExternFunc {
+			names[export.Index] = export.Name
+		}
+	}
+	return names
+}
+
+// loadModule loads the module from the disk cache if there is one, otherwise
+// compiles the code and saves the result to the disk cache.
+func loadModule(logger types.Logger, engine *wasmtime.Engine, key moduleKey, code []byte) (*wasmtime.Module, error) {
+	cache := sharedDiskCache()
+	if cache != nil {
+		module, err := cache.load(engine, key)
+		if err == nil {
+			logger.Debug("module loaded from disk cache")
+			return module, nil
+		}
+		if !os.IsNotExist(err) {
+			logger.Error("failed to load module from disk cache, recompiling", "err", err)
+		}
+	}
+
+	release := types.AcquireCompileSlot()
+	module, err := wasmtime.NewModule(engine, code)
+	release()
+	if err != nil {
+		logger.Error("failed to create wasm module", "err", err, "size", len(code))
+		return nil, errors.Wrap(err, "unable create wasm module")
+	}
+
+	if cache != nil {
+		if err := cache.store(module, key); err != nil {
+			// the cache is only an optimization, the compiled module is still usable
+			logger.Error("failed to save module to disk cache", "err", err)
+		}
+	}
+	return module, nil
+}
+
+// releaseModule drops a reference to the module, and closes it if it is the last one
+func releaseModule(compiled *compiledModule) {
+	modules.Lock()
+	defer modules.Unlock()
+
+	compiled.refs--
+	if compiled.refs > 0 {
+		return
+	}
+
+	if modules.m[compiled.key] == compiled {
+		delete(modules.m, compiled.key)
+	}
+	if compiled.module != nil {
+		compiled.module.Close()
+	}
+}
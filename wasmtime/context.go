@@ -2,7 +2,9 @@ package wasmtime
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"unicode/utf16"
 
 	"github.com/artela-network/aspect-runtime/types"
 	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
@@ -17,15 +19,43 @@ type Context struct {
 	Instance *wasmtime.Instance
 	Store    *wasmtime.Store
 
-	gasCounterGlobal *wasmtime.Global
-	allocator        *wasmtime.Func
+	gasMeter vmGasMeter
+
+	// abi names the memory management exports, the functions are looked up
+	// on first use
+	abi       *types.GuestABI
+	allocator *wasmtime.Func
+	abiFuncs  map[string]*wasmtime.Func
+
+	// args are the arguments allocated for the current call, released after it
+	args []allocation
+
+	profiler *profiler
+
+	interruption *interruption
+
+	// trapErr is the error which made the host trap the wasm code, it is
+	// returned by the call instead of the trap
+	trapErr error
+
+	// hostCalls counts the calls of each host api during the current call
+	hostCalls map[hostAPI]int64
+
+	// initialized is set once the init hook has run on the instance
+	initialized bool
+
+	// wasi is the state of the WASI clocks and random bytes, if WASI is enabled
+	wasi *wasiState
 }
 
 func NewContext(ctx context.Context, logger types.Logger) *Context {
-	return &Context{
+	c := &Context{
 		Context: ctx,
 		logger:  logger,
+		abi:     &types.DefaultABI,
 	}
+	c.gasMeter = &globalGasMeter{ctx: c}
+	return c
 }
 
 func (c *Context) Logger() types.Logger {
@@ -70,11 +100,39 @@ func (c *Context) Reset() {
 	}
 	c.Store = nil
 
-	c.gasCounterGlobal = nil
+	c.gasMeter.reset()
+}
+
+// readASString reads an AssemblyScript string, the UTF-16 code units are
+// preceded by their size in bytes stored in the object header.
+func (c *Context) readASString(ptr int32) (string, error) {
+	if ptr == 0 {
+		return "", nil
+	}
+
+	mem, err := c.memory()
+	if err != nil {
+		return "", err
+	}
+
+	start := int64(uint32(ptr))
+	if start < 4 || start > int64(len(mem)) {
+		return "", errors.New("memory out of bound")
+	}
+	end := start + int64(binary.LittleEndian.Uint32(mem[start-4:])&^1)
+	if end > int64(len(mem)) {
+		return "", errors.New("memory out of bound")
+	}
+
+	units := make([]uint16, (end-start)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(mem[start+2*int64(i):])
+	}
+	return string(utf16.Decode(units)), nil
 }
 
 func (c *Context) memory() ([]byte, error) {
-	memExport := c.Instance.GetExport(c.Store, "memory")
+	memExport := c.Instance.GetExport(c.Store, c.abi.Memory)
 	if memExport == nil {
 		return nil, errors.New("memory export not found")
 	}
@@ -89,78 +147,117 @@ func (c *Context) memory() ([]byte, error) {
 
 func (c *Context) AllocMemory(size int32) (int32, error) {
 	if c.allocator == nil {
-		c.allocator = c.Instance.GetFunc(c.Store, "allocate")
+		c.allocator = c.Instance.GetFunc(c.Store, c.abi.Alloc)
 		if c.allocator == nil {
-			return 0, errors.New("function 'allocate' does not exist")
+			return 0, errors.New("function '" + c.abi.Alloc + "' does not exist")
 		}
 	}
 
-	res, err := c.allocator.Call(c.Store, size)
-	if err != nil {
-		return 0, err
+	args := make([]interface{}, 0, 1+len(c.abi.AllocArgs))
+	args = append(args, size)
+	for _, arg := range c.abi.AllocArgs {
+		args = append(args, arg)
 	}
 
-	return res.(int32), nil
-}
-
-// gasCounter get the gas counter from wasm,
-// "__gas_counter__" global variable is an i64 injected by wasm instrument lib
-func (c *Context) gasCounter() (*wasmtime.Global, error) {
-	if c.gasCounterGlobal != nil {
-		return c.gasCounterGlobal, nil
+	res, err := c.allocator.Call(c.Store, args...)
+	if err != nil {
+		return 0, err
 	}
 
-	export := c.Instance.GetExport(c.Store, "__gas_counter__")
-	if export == nil {
-		return nil, errors.New("gas counter not exported")
+	ptr, ok := res.(int32)
+	if !ok {
+		return 0, errors.New("function '" + c.abi.Alloc + "' does not return a pointer")
 	}
+	return ptr, nil
+}
 
-	c.gasCounterGlobal = export.Global()
-	return export.Global(), nil
+// allocation is the memory allocated for an argument of a call
+type allocation struct {
+	ptr  int32
+	size int32
 }
 
-func (c *Context) RemainingEVMGas() (int64, error) {
-	leftover, err := c.RemainingWASMGas()
+// allocArg allocates the memory of an argument of the current call, which is
+// pinned until releaseArgs if the abi has a pin function
+func (c *Context) allocArg(size int32) (int32, error) {
+	ptr, err := c.AllocMemory(size)
 	if err != nil {
-		return leftover, err
+		return 0, err
 	}
 
-	return leftover / types.EVMGasToWASMGasMultiplier, nil
+	if c.abi.Pin != "" {
+		if err := c.callABI(c.abi.Pin, ptr); err != nil {
+			return 0, err
+		}
+	}
+	c.args = append(c.args, allocation{ptr: ptr, size: size})
+	return ptr, nil
 }
 
-func (c *Context) RemainingWASMGas() (int64, error) {
-	gasCounter, err := c.gasCounter()
-	if err != nil {
-		return 0, err
+// releaseArgs unpins and frees the arguments of the current call, the guest
+// calls are charged to the gas left by the call. The call is done, so the
+// failures are only logged.
+func (c *Context) releaseArgs() {
+	args := c.args
+	c.args = nil
+
+	for _, arg := range args {
+		if c.abi.Unpin != "" {
+			if err := c.callABI(c.abi.Unpin, arg.ptr); err != nil {
+				c.logger.Error("failed to unpin argument", "err", err)
+				return
+			}
+		}
+		if c.abi.Free != "" {
+			params := []interface{}{arg.ptr}
+			if c.abi.FreeWithSize {
+				params = append(params, arg.size)
+			}
+			if err := c.callABI(c.abi.Free, params...); err != nil {
+				c.logger.Error("failed to free argument", "err", err)
+				return
+			}
+		}
 	}
+}
 
-	leftover := gasCounter.Get(c.Store).I64()
-	if leftover < 0 {
-		return 0, types.OutOfGasError
+// callABI calls a memory management export of the abi
+func (c *Context) callABI(name string, args ...interface{}) error {
+	fn, ok := c.abiFuncs[name]
+	if !ok {
+		fn = c.Instance.GetFunc(c.Store, name)
+		if fn == nil {
+			return errors.New("function '" + name + "' does not exist")
+		}
+		if c.abiFuncs == nil {
+			c.abiFuncs = make(map[string]*wasmtime.Func)
+		}
+		c.abiFuncs[name] = fn
 	}
 
-	return leftover, nil
+	_, err := fn.Call(c.Store, args...)
+	return err
 }
 
-func (c *Context) ConsumeWASMGas(gas int64) error {
-	gasCounter, err := c.gasCounter()
+func (c *Context) GasMeter() types.GasMeter {
+	return c.gasMeter
+}
+
+func (c *Context) RemainingEVMGas() (int64, error) {
+	leftover, err := c.RemainingWASMGas()
 	if err != nil {
-		return err
+		return leftover, err
 	}
 
-	leftover := gasCounter.Get(c.Store).I64()
-	if leftover < gas {
-		if err := gasCounter.Set(c.Store, wasmtime.ValI64(-1)); err != nil {
-			return err
-		}
-		return types.OutOfGasError
-	}
+	return types.WASMGasToEVMGas(leftover), nil
+}
 
-	if err := gasCounter.Set(c.Store, wasmtime.ValI64(leftover-gas)); err != nil {
-		return err
-	}
+func (c *Context) RemainingWASMGas() (int64, error) {
+	return c.gasMeter.RemainingGas()
+}
 
-	return nil
+func (c *Context) ConsumeWASMGas(gas int64) error {
+	return c.gasMeter.ConsumeGas(gas)
 }
 
 func (c *Context) AddEVMGas(gas int64) error {
@@ -169,27 +266,9 @@ func (c *Context) AddEVMGas(gas int64) error {
 		return errors.New("gas overflow")
 	}
 
-	gasCounter, err := c.gasCounter()
-	if err != nil {
-		return err
-	}
-
-	if err := gasCounter.Set(c.Store, wasmtime.ValI64(gas*types.EVMGasToWASMGasMultiplier)); err != nil {
-		return err
-	}
-
-	return nil
+	return c.gasMeter.setGas(types.EVMGasToWASMGas(gas))
 }
 
 func (c *Context) SetWASMGas(gas int64) error {
-	gasCounter, err := c.gasCounter()
-	if err != nil {
-		return err
-	}
-
-	if err := gasCounter.Set(c.Store, wasmtime.ValI64(gas)); err != nil {
-		return err
-	}
-
-	return nil
+	return c.gasMeter.setGas(gas)
 }
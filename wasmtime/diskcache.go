@@ -0,0 +1,202 @@
+package wasmtime
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+)
+
+const (
+	// diskCacheVersion must be bumped when the file format, the engine version
+	// or the engine config changes
+	diskCacheVersion = 2
+
+	diskCacheExt = ".cwasm"
+)
+
+// diskCacheMagic prefixes every cache file, followed by the sha256 of the payload
+var diskCacheMagic = []byte("aspect-cwasm\x00")
+
+// DiskCache persists compiled modules in a directory, so that they are not
+// recompiled after a restart. Each file holds a serialized module, and is
+// checked against the hash in its header before being loaded. The least
+// recently used files are evicted when the directory grows over maxSize.
+//
+// The serialized modules are loaded as native code, so the directory must
+// not be writable by anyone else.
+type DiskCache struct {
+	sync.Mutex
+
+	dir     string
+	maxSize int64
+}
+
+var diskCache = struct {
+	sync.RWMutex
+	cache *DiskCache
+}{}
+
+// NewDiskCache creates a disk cache in dir, the directory is created if it does not exist
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("max size of the module cache must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "unable to create module cache dir")
+	}
+	return &DiskCache{dir: dir, maxSize: maxSize}, nil
+}
+
+// SetDiskCache sets the disk cache used by all runtimes, nil disables it
+func SetDiskCache(cache *DiskCache) {
+	diskCache.Lock()
+	defer diskCache.Unlock()
+
+	diskCache.cache = cache
+}
+
+func sharedDiskCache() *DiskCache {
+	diskCache.RLock()
+	defer diskCache.RUnlock()
+
+	return diskCache.cache
+}
+
+// fileName builds the name of a cache file from all the inputs of the compiled code
+func (c *DiskCache) fileName(key moduleKey) string {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, []uint32{diskCacheVersion, instrument.Version})
+	_ = binary.Write(&buf, binary.BigEndian, []int64{key.engine.maxMemorySize, key.engine.maxWasmStack})
+	buf.WriteByte(byte(key.engine.metering))
+	if key.profiling {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.Write(key.codeHash[:])
+
+	hash := sha256.Sum256(buf.Bytes())
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:])+diskCacheExt)
+}
+
+// load deserializes the cached module, corrupted or incompatible files are removed
+func (c *DiskCache) load(engine *wasmtime.Engine, key moduleKey) (*wasmtime.Module, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	name := c.fileName(key)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := c.verify(data)
+	if err == nil {
+		var module *wasmtime.Module
+		if module, err = wasmtime.NewModuleDeserialize(engine, payload); err == nil {
+			// mark the file as recently used
+			now := time.Now()
+			_ = os.Chtimes(name, now, now)
+			return module, nil
+		}
+	}
+
+	_ = os.Remove(name)
+	return nil, err
+}
+
+func (c *DiskCache) verify(data []byte) ([]byte, error) {
+	headerLen := len(diskCacheMagic) + sha256.Size
+	if len(data) < headerLen || !bytes.Equal(data[:len(diskCacheMagic)], diskCacheMagic) {
+		return nil, errors.New("invalid module cache header")
+	}
+
+	payload := data[headerLen:]
+	hash := sha256.Sum256(payload)
+	if !bytes.Equal(hash[:], data[len(diskCacheMagic):headerLen]) {
+		return nil, errors.New("module cache checksum mismatch")
+	}
+	return payload, nil
+}
+
+// store serializes the module into the cache and evicts the old files if needed
+func (c *DiskCache) store(module *wasmtime.Module, key moduleKey) error {
+	payload, err := module.Serialize()
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize module")
+	}
+	hash := sha256.Sum256(payload)
+
+	c.Lock()
+	defer c.Unlock()
+
+	// write to a temp file first, so that readers never see a partial file
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, part := range [][]byte{diskCacheMagic, hash[:], payload} {
+		if _, err := tmp.Write(part); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.fileName(key)); err != nil {
+		return err
+	}
+
+	return c.evict()
+}
+
+// evict removes the least recently used files until the cache fits in maxSize
+func (c *DiskCache) evict() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	files := make([]os.FileInfo, 0, len(entries))
+	total := int64(0)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), diskCacheExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, file.Name())); err != nil {
+			return err
+		}
+		total -= file.Size()
+	}
+	return nil
+}
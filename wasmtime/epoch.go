@@ -0,0 +1,120 @@
+package wasmtime
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// epochInterval is the period of the epoch ticks, the running calls check
+// whether they are interrupted at each tick.
+const epochInterval = 10 * time.Millisecond
+
+var startTicker sync.Once
+
+// tickEpochs advances the epochs of all shared engines, it runs for the whole
+// life of the process.
+func tickEpochs() {
+	ticker := time.NewTicker(epochInterval)
+	for range ticker.C {
+		engines.Lock()
+		for _, engine := range engines.m {
+			engine.IncrementEpoch()
+		}
+		engines.Unlock()
+	}
+}
+
+// interruption stops the execution once the context is done or an
+// interruption is requested. It is a non-consensus safety net, the
+// deterministic limit of the execution is gas.
+type interruption struct {
+	ctx       context.Context
+	requested *atomic.Bool
+
+	// err is the reason of the last interruption
+	err error
+}
+
+func (i *interruption) check() error {
+	if i.requested.Load() {
+		return types.InterruptedError
+	}
+	return types.ContextError(i.ctx)
+}
+
+// epochCallbackStore is the store of a binding exposing the epoch deadline
+// callback of the wasmtime c api. fn is called each time the deadline is
+// reached, it returns the ticks to the next deadline, or the error stopping
+// the execution.
+type epochCallbackStore interface {
+	SetEpochDeadlineCallback(fn func() (delta uint64, err error))
+}
+
+// EpochCallbackSupported reports whether the wasmtime binding exposes the
+// epoch deadline callback. Without it the running calls are only stopped by
+// the deadline of the context, the cancellation of the context and Interrupt
+// are checked before each call and each call of a batch.
+func EpochCallbackSupported() bool {
+	_, ok := interface{}(&wasmtime.Store{}).(epochCallbackStore)
+	return ok
+}
+
+// noDeadline is the epoch deadline of the calls without a context deadline,
+// far enough to be never reached and to never overflow the epoch
+const noDeadline = math.MaxInt64
+
+// watchEpochs makes the store check the interruption at each epoch tick if the
+// binding exposes the epoch deadline callback, see armEpochs otherwise.
+func watchEpochs(store *wasmtime.Store, i *interruption) {
+	startTicker.Do(func() {
+		go tickEpochs()
+	})
+
+	callbackStore, ok := interface{}(store).(epochCallbackStore)
+	if !ok {
+		store.SetEpochDeadline(noDeadline)
+		return
+	}
+
+	store.SetEpochDeadline(1)
+	callbackStore.SetEpochDeadlineCallback(func() (uint64, error) {
+		if i.err = i.check(); i.err != nil {
+			return 0, i.err
+		}
+		return 1, nil
+	})
+}
+
+// armEpochs sets the epoch deadline of the store to the deadline of the
+// context before a call, the store traps once it is reached. It is only needed
+// without the epoch deadline callback, which checks the context on each tick.
+func armEpochs(store *wasmtime.Store, i *interruption) {
+	if EpochCallbackSupported() {
+		return
+	}
+
+	var deadline time.Time
+	ok := false
+	if i.ctx != nil {
+		deadline, ok = i.ctx.Deadline()
+	}
+	if !ok {
+		store.SetEpochDeadline(noDeadline)
+		return
+	}
+
+	// the trap must never come before the deadline, so one more tick is added
+	// for the tick in progress
+	until := time.Until(deadline)
+	if until < 0 {
+		until = 0
+	}
+	store.SetEpochDeadline(uint64(until/epochInterval) + 2)
+}
@@ -0,0 +1,218 @@
+package wasmtime
+
+import (
+	"errors"
+	"math"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+var (
+	_ vmGasMeter = (*globalGasMeter)(nil)
+	_ vmGasMeter = (*fuelGasMeter)(nil)
+)
+
+// vmGasMeter is the gas meter of the wasm instance, it holds the gas of the
+// whole call and is refilled by the runtime before each call.
+type vmGasMeter interface {
+	types.GasMeter
+
+	// setGas replaces the remaining gas
+	setGas(gas int64) error
+	// drain marks the meter as out of gas
+	drain() error
+	// reset drops the references to the instance
+	reset()
+}
+
+// globalGasMeter is the gas meter backed by the gas counter of the instance,
+// "__gas_counter__" global variable is an i64 injected by wasm instrument lib.
+// The wasm code charges the counter directly, so the counter is the only
+// place where the remaining gas is kept.
+type globalGasMeter struct {
+	ctx *Context
+
+	counter *wasmtime.Global
+}
+
+func (m *globalGasMeter) gasCounter() (*wasmtime.Global, error) {
+	if m.counter != nil {
+		return m.counter, nil
+	}
+
+	export := m.ctx.Instance.GetExport(m.ctx.Store, "__gas_counter__")
+	if export == nil {
+		return nil, errors.New("gas counter not exported")
+	}
+
+	m.counter = export.Global()
+	return m.counter, nil
+}
+
+func (m *globalGasMeter) ConsumeGas(gas int64) error {
+	if gas < 0 {
+		return errors.New("negative gas")
+	}
+
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return err
+	}
+
+	leftover := gasCounter.Get(m.ctx.Store).I64()
+	if leftover < gas {
+		if err := gasCounter.Set(m.ctx.Store, wasmtime.ValI64(-1)); err != nil {
+			return err
+		}
+		return types.OutOfGasError
+	}
+
+	return gasCounter.Set(m.ctx.Store, wasmtime.ValI64(leftover-gas))
+}
+
+func (m *globalGasMeter) RefundGas(gas int64) error {
+	if gas < 0 {
+		return errors.New("negative gas")
+	}
+
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return err
+	}
+
+	leftover := gasCounter.Get(m.ctx.Store).I64()
+	if leftover < 0 {
+		// out of gas is final
+		return types.OutOfGasError
+	}
+	if gas > math.MaxInt64-leftover {
+		return errors.New("gas overflow")
+	}
+
+	return gasCounter.Set(m.ctx.Store, wasmtime.ValI64(leftover+gas))
+}
+
+func (m *globalGasMeter) RemainingGas() (int64, error) {
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return 0, err
+	}
+
+	leftover := gasCounter.Get(m.ctx.Store).I64()
+	if leftover < 0 {
+		return 0, types.OutOfGasError
+	}
+
+	return leftover, nil
+}
+
+func (m *globalGasMeter) Child(limit int64) (types.GasMeter, error) {
+	return types.NewChildGasMeter(m, limit)
+}
+
+func (m *globalGasMeter) setGas(gas int64) error {
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return err
+	}
+
+	return gasCounter.Set(m.ctx.Store, wasmtime.ValI64(gas))
+}
+
+func (m *globalGasMeter) drain() error {
+	return m.setGas(-1)
+}
+
+func (m *globalGasMeter) reset() {
+	m.counter = nil
+}
+
+// fuelGasMeter is the gas meter backed by the fuel of the wasmtime store,
+// one unit of fuel is one unit of WASM gas. The engine charges the fuel of
+// each executed instruction and traps when the fuel runs out.
+type fuelGasMeter struct {
+	ctx *Context
+
+	// exhausted marks that the call has run out of gas, as the fuel of the
+	// store cannot go below zero.
+	exhausted bool
+}
+
+func (m *fuelGasMeter) fuel() (int64, error) {
+	if m.exhausted {
+		return 0, types.OutOfGasError
+	}
+
+	fuel, err := m.ctx.Store.GetFuel()
+	if err != nil {
+		return 0, err
+	}
+	if fuel > math.MaxInt64 {
+		return math.MaxInt64, nil
+	}
+	return int64(fuel), nil
+}
+
+func (m *fuelGasMeter) ConsumeGas(gas int64) error {
+	if gas < 0 {
+		return errors.New("negative gas")
+	}
+
+	leftover, err := m.fuel()
+	if err != nil {
+		return err
+	}
+
+	if leftover < gas {
+		if err := m.drain(); err != nil {
+			return err
+		}
+		return types.OutOfGasError
+	}
+
+	return m.ctx.Store.SetFuel(uint64(leftover - gas))
+}
+
+func (m *fuelGasMeter) RefundGas(gas int64) error {
+	if gas < 0 {
+		return errors.New("negative gas")
+	}
+
+	leftover, err := m.fuel()
+	if err != nil {
+		return err
+	}
+	if gas > math.MaxInt64-leftover {
+		return errors.New("gas overflow")
+	}
+
+	return m.ctx.Store.SetFuel(uint64(leftover + gas))
+}
+
+func (m *fuelGasMeter) RemainingGas() (int64, error) {
+	return m.fuel()
+}
+
+func (m *fuelGasMeter) Child(limit int64) (types.GasMeter, error) {
+	return types.NewChildGasMeter(m, limit)
+}
+
+func (m *fuelGasMeter) setGas(gas int64) error {
+	if gas < 0 {
+		return m.drain()
+	}
+
+	m.exhausted = false
+	return m.ctx.Store.SetFuel(uint64(gas))
+}
+
+func (m *fuelGasMeter) drain() error {
+	m.exhausted = true
+	return m.ctx.Store.SetFuel(0)
+}
+
+func (m *fuelGasMeter) reset() {
+	m.exhausted = false
+}
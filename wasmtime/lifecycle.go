@@ -0,0 +1,39 @@
+package wasmtime
+
+import (
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// exportedHooks returns the hooks exported by the module, the hooks which are
+// not exported as functions without parameters are disabled
+func exportedHooks(logger types.Logger, module *wasmtime.Module, hooks *types.Lifecycle) types.Lifecycle {
+	exported := make(map[string]bool)
+	for _, export := range module.Exports() {
+		fn := export.Type().FuncType()
+		if fn != nil && len(fn.Params()) == 0 {
+			exported[export.Name()] = true
+		}
+	}
+
+	found := *hooks
+	for _, hook := range []*types.LifecycleHook{&found.Init, &found.PreCall, &found.PostCall, &found.Teardown} {
+		if !exported[hook.Export] {
+			hook.Export = ""
+			continue
+		}
+		logger.Debug("lifecycle hook found", "export", hook.Export, "gas", hook.Gas)
+	}
+	return found
+}
+
+// teardown runs the teardown hook of the instance before it is dropped, the
+// hook only runs on the instances initialized by the init hook
+func (w *wasmTimeRuntime) teardown() {
+	if w.ctx == nil || w.ctx.Instance == nil || !w.ctx.initialized || w.hooks.Teardown.Export == "" {
+		return
+	}
+	w.ctx.initialized = false
+	types.Teardown(w)
+}
@@ -0,0 +1,160 @@
+package wasmtime
+
+import (
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// newLinker creates the linker of the runtime. The host functions are defined
+// without a store, so the linker is created once and reused by ResetStore. The
+// functions defined are trampolines which look up the host api in the current
+// registry of the runtime, since each reset may come with a new registry.
+func (w *wasmTimeRuntime) newLinker() (*wasmtime.Linker, error) {
+	linker := wasmtime.NewLinker(w.engine)
+
+	if err := w.linkToHostFns(linker); err != nil {
+		linker.Close()
+		return nil, err
+	}
+
+	if err := w.linkAbort(linker); err != nil {
+		linker.Close()
+		return nil, err
+	}
+
+	if w.config.WASI != nil {
+		if err := w.linkWASI(linker); err != nil {
+			linker.Close()
+			return nil, err
+		}
+	}
+
+	return linker, nil
+}
+
+func (w *wasmTimeRuntime) linkToHostFns(linker *wasmtime.Linker) error {
+	for module, namespaces := range w.apis.WrapperFuncs() {
+		for ns, methods := range namespaces {
+			for method, function := range methods {
+				trampoline, err := w.trampoline(module, ns, method, function)
+				if err == nil {
+					err = linker.FuncWrap(buildModuleName(module), buildModuleMethod(ns, method), trampoline)
+				}
+				if err != nil {
+					w.logger.Error("failed to link host api", "module", module, "namespace", ns, "method", method, "err", err)
+					return errors.Wrapf(
+						err, "unable to link host api %s:%s.%s", module, ns, method,
+					)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// linkAbort links the abort function of AssemblyScript, which is called with
+// the message and the file name as strings, and the line and the column.
+func (w *wasmTimeRuntime) linkAbort(linker *wasmtime.Linker) error {
+	abort := func(message, file, line, column int32) *wasmtime.Trap {
+		err := &types.AbortError{Line: line, Column: column}
+
+		var readErr error
+		if err.Message, readErr = w.ctx.readASString(message); readErr != nil {
+			w.logger.Error("failed to read abort message", "err", readErr)
+		}
+		if err.File, readErr = w.ctx.readASString(file); readErr != nil {
+			w.logger.Error("failed to read abort file name", "err", readErr)
+		}
+
+		w.logger.Info("aspect aborted", "message", err.Message, "file", err.File, "line", line, "column", column)
+		w.ctx.trapErr = err
+		return wasmtime.NewTrap(err.Error())
+	}
+	if err := linker.FuncWrap("env", "abort", abort); err != nil {
+		return errors.Wrapf(err, "unable to link to abort")
+	}
+	return nil
+}
+
+// hostFunc returns the wrapped host api from the current registry
+func (w *wasmTimeRuntime) hostFunc(module types.Module, ns types.NameSpace, method types.MethodName) interface{} {
+	if w.apis == nil {
+		return nil
+	}
+	return w.apis.WrapperFuncs()[module][ns][method]
+}
+
+// trampoline builds a function of the same signature as the wrapped host api,
+// which calls the host api registered in the current registry.
+func (w *wasmTimeRuntime) trampoline(module types.Module, ns types.NameSpace, method types.MethodName, function interface{}) (interface{}, error) {
+	missing := func() *wasmtime.Trap {
+		err := &types.HostAPIError{Module: module, Namespace: ns, Method: method, Err: errors.New("host api not found")}
+		if w.ctx != nil {
+			w.ctx.trapErr = err
+		}
+		return wasmtime.NewTrap(err.Error())
+	}
+
+	switch function.(type) {
+	case func() *wasmtime.Trap:
+		return func() *wasmtime.Trap {
+			if fn, ok := w.hostFunc(module, ns, method).(func() *wasmtime.Trap); ok {
+				return fn()
+			}
+			return missing()
+		}, nil
+	case func(int32) *wasmtime.Trap:
+		return func(arg int32) *wasmtime.Trap {
+			if fn, ok := w.hostFunc(module, ns, method).(func(int32) *wasmtime.Trap); ok {
+				return fn(arg)
+			}
+			return missing()
+		}, nil
+	case func(int32, int32) *wasmtime.Trap:
+		return func(arg1 int32, arg2 int32) *wasmtime.Trap {
+			if fn, ok := w.hostFunc(module, ns, method).(func(int32, int32) *wasmtime.Trap); ok {
+				return fn(arg1, arg2)
+			}
+			return missing()
+		}, nil
+	case func(int32, int32, int32) *wasmtime.Trap:
+		return func(arg1 int32, arg2 int32, arg3 int32) *wasmtime.Trap {
+			if fn, ok := w.hostFunc(module, ns, method).(func(int32, int32, int32) *wasmtime.Trap); ok {
+				return fn(arg1, arg2, arg3)
+			}
+			return missing()
+		}, nil
+	case func() (int32, *wasmtime.Trap):
+		return func() (int32, *wasmtime.Trap) {
+			if fn, ok := w.hostFunc(module, ns, method).(func() (int32, *wasmtime.Trap)); ok {
+				return fn()
+			}
+			return 0, missing()
+		}, nil
+	case func(int32) (int32, *wasmtime.Trap):
+		return func(arg int32) (int32, *wasmtime.Trap) {
+			if fn, ok := w.hostFunc(module, ns, method).(func(int32) (int32, *wasmtime.Trap)); ok {
+				return fn(arg)
+			}
+			return 0, missing()
+		}, nil
+	case func(int32, int32) (int32, *wasmtime.Trap):
+		return func(arg1 int32, arg2 int32) (int32, *wasmtime.Trap) {
+			if fn, ok := w.hostFunc(module, ns, method).(func(int32, int32) (int32, *wasmtime.Trap)); ok {
+				return fn(arg1, arg2)
+			}
+			return 0, missing()
+		}, nil
+	case func(int32, int32, int32) (int32, *wasmtime.Trap):
+		return func(arg1 int32, arg2 int32, arg3 int32) (int32, *wasmtime.Trap) {
+			if fn, ok := w.hostFunc(module, ns, method).(func(int32, int32, int32) (int32, *wasmtime.Trap)); ok {
+				return fn(arg1, arg2, arg3)
+			}
+			return 0, missing()
+		}, nil
+	}
+
+	return nil, errors.New("host function not supported")
+}
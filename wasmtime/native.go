@@ -0,0 +1,23 @@
+package wasmtime
+
+import (
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+)
+
+// valueType maps the kind of a wasm value to its value type, the reference
+// types are disabled and never passed to an export
+func valueType(kind wasmtime.ValKind) byte {
+	switch kind {
+	case wasmtime.KindI32:
+		return instrument.ValueI32
+	case wasmtime.KindI64:
+		return instrument.ValueI64
+	case wasmtime.KindF32:
+		return instrument.ValueF32
+	case wasmtime.KindF64:
+		return instrument.ValueF64
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package wasmtime
+
+import (
+	"fmt"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// hostAPI identifies a host api in the gas profile
+type hostAPI struct {
+	module types.Module
+	ns     types.NameSpace
+	method types.MethodName
+}
+
+// String returns the name of the host api as module:namespace.method
+func (a hostAPI) String() string {
+	return fmt.Sprintf("%s:%s.%s", a.module, a.ns, a.method)
+}
+
+// profiler collects the gas profile of an aspect call, wasm functions are
+// measured by the counters injected with instrument.InjectProfiler, host apis
+// are measured by the host function wrapper.
+type profiler struct {
+	functions []instrument.ProfiledFunction
+
+	hostAPIs map[hostAPI]*types.HostAPIGas
+	order    []hostAPI
+}
+
+func newProfiler(functions []instrument.ProfiledFunction) *profiler {
+	return &profiler{
+		functions: functions,
+		hostAPIs:  make(map[hostAPI]*types.HostAPIGas),
+	}
+}
+
+// reset clears the counters of the previous call
+func (p *profiler) reset(ctx *Context) error {
+	p.hostAPIs = make(map[hostAPI]*types.HostAPIGas)
+	p.order = nil
+
+	if err := ctx.setProfileCounter(instrument.ProfileChildExport, 0); err != nil {
+		return err
+	}
+	for _, fn := range p.functions {
+		for _, name := range []string{fn.SelfExport, fn.TotalExport, fn.CallsExport} {
+			if err := ctx.setProfileCounter(name, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enterHost samples the counters before a host api is executed
+func (p *profiler) enterHost(ctx *Context) (gas int64, child int64) {
+	gas, _ = ctx.RemainingWASMGas()
+	child, _ = ctx.profileCounter(instrument.ProfileChildExport)
+	return gas, child
+}
+
+// exitHost records the gas used by a host api, the gas of wasm code called back
+// during the host api has already been accounted by the wasm counters, so only
+// the remaining part is attributed to the host api and its caller's callees.
+func (p *profiler) exitHost(ctx *Context, api hostAPI, gasBefore, childBefore int64) {
+	gasAfter, _ := ctx.RemainingWASMGas()
+	childAfter, err := ctx.profileCounter(instrument.ProfileChildExport)
+	if err != nil {
+		ctx.Logger().Error("failed to read profile counter", "err", err)
+		return
+	}
+
+	cost := (gasBefore - gasAfter) - (childAfter - childBefore)
+	if err := ctx.setProfileCounter(instrument.ProfileChildExport, childAfter+cost); err != nil {
+		ctx.Logger().Error("failed to update profile counter", "err", err)
+	}
+
+	stat, ok := p.hostAPIs[api]
+	if !ok {
+		stat = &types.HostAPIGas{Module: api.module, NameSpace: api.ns, Method: api.method}
+		p.hostAPIs[api] = stat
+		p.order = append(p.order, api)
+	}
+	stat.Calls++
+	stat.Gas += cost
+}
+
+// report builds the gas profile of the last call
+func (p *profiler) report(ctx *Context, method string, gasUsed int64) (*types.GasProfile, error) {
+	profile := &types.GasProfile{
+		Method:  method,
+		GasUsed: gasUsed,
+	}
+
+	attributed := int64(0)
+	for _, fn := range p.functions {
+		calls, err := ctx.profileCounter(fn.CallsExport)
+		if err != nil {
+			return nil, err
+		}
+		if calls == 0 {
+			continue
+		}
+		self, err := ctx.profileCounter(fn.SelfExport)
+		if err != nil {
+			return nil, err
+		}
+		total, err := ctx.profileCounter(fn.TotalExport)
+		if err != nil {
+			return nil, err
+		}
+
+		profile.Functions = append(profile.Functions, types.FunctionGas{
+			Index:    fn.Index,
+			Name:     fn.Name,
+			Calls:    calls,
+			SelfGas:  self,
+			TotalGas: total,
+		})
+		attributed += self
+	}
+
+	for _, api := range p.order {
+		stat := p.hostAPIs[api]
+		profile.HostAPIs = append(profile.HostAPIs, *stat)
+		attributed += stat.Gas
+	}
+
+	profile.Unattributed = gasUsed - attributed
+	profile.Sort()
+	return profile, nil
+}
+
+func (c *Context) profileCounter(name string) (int64, error) {
+	global, err := c.profileGlobal(name)
+	if err != nil {
+		return 0, err
+	}
+	return global.Get(c.Store).I64(), nil
+}
+
+func (c *Context) setProfileCounter(name string, value int64) error {
+	global, err := c.profileGlobal(name)
+	if err != nil {
+		return err
+	}
+	return global.Set(c.Store, wasmtime.ValI64(value))
+}
+
+func (c *Context) profileGlobal(name string) (*wasmtime.Global, error) {
+	export := c.Instance.GetExport(c.Store, name)
+	if export == nil || export.Global() == nil {
+		return nil, errors.Errorf("profile counter %s not exported", name)
+	}
+	return export.Global(), nil
+}
@@ -0,0 +1,95 @@
+package wasmtime
+
+import (
+	"bytes"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/pkg/errors"
+)
+
+// snapshotPageSize is the granularity of the memory restore, only the pages
+// which differ from the snapshot are written back.
+const snapshotPageSize = 4096
+
+// snapshot is the state of an instance right after __aspect_start__, it is
+// restored in place instead of creating a new instance when the runtime is
+// reused. All mutable globals are exported by instrument.ExportGlobals, and
+// tables and data segments cannot be changed without bulk memory, so the
+// memory and the globals are the whole mutable state of the instance.
+type snapshot struct {
+	memory  []byte
+	globals []globalSnapshot
+
+	// startGas is the WASM gas used by __aspect_start__, which is charged on
+	// each restore to keep the gas usage the same as a fresh instance
+	startGas int64
+}
+
+type globalSnapshot struct {
+	global *wasmtime.Global
+	value  wasmtime.Val
+}
+
+// takeSnapshot saves the current state of the instance
+func takeSnapshot(ctx *Context, module *wasmtime.Module, startGas int64) (*snapshot, error) {
+	mem, err := ctx.memory()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &snapshot{
+		memory:   append([]byte{}, mem...),
+		startGas: startGas,
+	}
+
+	for _, export := range module.Exports() {
+		globalType := export.Type().GlobalType()
+		if globalType == nil || !globalType.Mutable() {
+			continue
+		}
+
+		extern := ctx.Instance.GetExport(ctx.Store, export.Name())
+		if extern == nil || extern.Global() == nil {
+			return nil, errors.Errorf("global %s not found", export.Name())
+		}
+		global := extern.Global()
+		s.globals = append(s.globals, globalSnapshot{global: global, value: global.Get(ctx.Store)})
+	}
+
+	return s, nil
+}
+
+// restore writes the saved state back to the instance. It returns false if the
+// memory has grown, as the memory cannot be shrunk, and the instance must be
+// recreated instead.
+//
+// The writes of the guest are not tracked by the engine, so the whole memory
+// is compared with the snapshot, the cost is linear in the size of the memory
+// rather than in the pages written. BenchmarkSnapshotRestore measures about
+// 1.6ms for a memory of 32MiB, against 75us for a new instance and its start.
+func (s *snapshot) restore(ctx *Context) (bool, error) {
+	mem, err := ctx.memory()
+	if err != nil {
+		return false, err
+	}
+	if len(mem) != len(s.memory) {
+		return false, nil
+	}
+
+	for offset := 0; offset < len(mem); offset += snapshotPageSize {
+		end := offset + snapshotPageSize
+		if end > len(mem) {
+			end = len(mem)
+		}
+		if !bytes.Equal(mem[offset:end], s.memory[offset:end]) {
+			copy(mem[offset:end], s.memory[offset:end])
+		}
+	}
+
+	for _, g := range s.globals {
+		if err := g.global.Set(ctx.Store, g.value); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,35 @@
+package wasmtime
+
+import (
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+)
+
+// stackHeight returns the stack height counter injected by instrument.LimitStack
+func (c *Context) stackHeight() (uint32, error) {
+	global, err := c.stackHeightGlobal()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(global.Get(c.Store).I32()), nil
+}
+
+// resetStackHeight clears the counter, which is left over the limit by a stack
+// overflow. The counter is only exported if the stack height is limited.
+func (c *Context) resetStackHeight() error {
+	global, err := c.stackHeightGlobal()
+	if err != nil {
+		return nil
+	}
+	return global.Set(c.Store, wasmtime.ValI32(0))
+}
+
+func (c *Context) stackHeightGlobal() (*wasmtime.Global, error) {
+	export := c.Instance.GetExport(c.Store, instrument.StackHeightExport)
+	if export == nil || export.Global() == nil {
+		return nil, errors.New("stack height counter not exported")
+	}
+	return export.Global(), nil
+}
@@ -0,0 +1,363 @@
+package wasmtime
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
+	"github.com/pkg/errors"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+const wasiModule = "wasi_snapshot_preview1"
+
+// errno values of wasi_snapshot_preview1
+const (
+	errnoSuccess    int32 = 0
+	errnoBadf       int32 = 8
+	errnoFault      int32 = 21
+	errnoInval      int32 = 28
+	errnoNotsup     int32 = 58
+	errnoSpipe      int32 = 70
+	errnoNotcapable int32 = 76
+)
+
+// limits of fd_write, a write with more io vectors fails like writev with
+// more than IOV_MAX on Linux, and the output over the limit is not written
+const (
+	maxWASIIovs   = 1024
+	maxWASIOutput = 64 * 1024
+)
+
+// clock ids of wasi_snapshot_preview1
+const (
+	clockRealtime  int32 = 0
+	clockMonotonic int32 = 1
+	clockProcess   int32 = 2
+	clockThread    int32 = 3
+)
+
+// wasiState is the state of the clocks and the random bytes of a call, it is
+// reset from the seed before each call so that the calls are deterministic
+type wasiState struct {
+	seed types.WASISeed
+
+	// clockReads is the number of clock reads, each read advances the clocks
+	// by a nanosecond
+	clockReads int64
+
+	// random is the unread part of the current random block
+	random      []byte
+	randomBlock uint64
+}
+
+func newWASIState(seed types.WASISeed) *wasiState {
+	return &wasiState{seed: seed}
+}
+
+// now returns the time of the clock
+func (s *wasiState) now(clock int32) int64 {
+	s.clockReads++
+	if clock == clockRealtime {
+		return s.seed.Time + s.clockReads
+	}
+	return s.clockReads
+}
+
+// read fills buf with the next random bytes, the stream is the sha256 of the
+// seed followed by the index of each block
+func (s *wasiState) read(buf []byte) {
+	for len(buf) > 0 {
+		if len(s.random) == 0 {
+			block := make([]byte, 0, len(s.seed.Random)+8)
+			block = append(block, s.seed.Random...)
+			block = binary.BigEndian.AppendUint64(block, s.randomBlock)
+			sum := sha256.Sum256(block)
+			s.random = sum[:]
+			s.randomBlock++
+		}
+		n := copy(buf, s.random)
+		s.random = s.random[n:]
+		buf = buf[n:]
+	}
+}
+
+// wasiSlice returns the memory in [ptr, ptr+size)
+func (c *Context) wasiSlice(ptr, size int32) ([]byte, bool) {
+	mem, err := c.memory()
+	if err != nil {
+		return nil, false
+	}
+
+	start, end := int64(uint32(ptr)), int64(uint32(ptr))+int64(uint32(size))
+	if end > int64(len(mem)) {
+		return nil, false
+	}
+	return mem[start:end], true
+}
+
+func (c *Context) wasiPutUint32(ptr int32, v uint32) bool {
+	buf, ok := c.wasiSlice(ptr, 4)
+	if ok {
+		binary.LittleEndian.PutUint32(buf, v)
+	}
+	return ok
+}
+
+func (c *Context) wasiPutUint64(ptr int32, v uint64) bool {
+	buf, ok := c.wasiSlice(ptr, 8)
+	if ok {
+		binary.LittleEndian.PutUint64(buf, v)
+	}
+	return ok
+}
+
+// linkWASI links the deterministic subset of wasi_snapshot_preview1
+func (w *wasmTimeRuntime) linkWASI(linker *wasmtime.Linker) error {
+	functions := map[string]interface{}{
+		"args_sizes_get": func(countPtr, sizePtr int32) (int32, *wasmtime.Trap) {
+			return w.wasiSizes(w.config.WASI.Args, countPtr, sizePtr)
+		},
+		"args_get": func(listPtr, bufPtr int32) (int32, *wasmtime.Trap) {
+			return w.wasiStrings(w.config.WASI.Args, listPtr, bufPtr)
+		},
+		"environ_sizes_get": func(countPtr, sizePtr int32) (int32, *wasmtime.Trap) {
+			return w.wasiSizes(w.config.WASI.Env, countPtr, sizePtr)
+		},
+		"environ_get": func(listPtr, bufPtr int32) (int32, *wasmtime.Trap) {
+			return w.wasiStrings(w.config.WASI.Env, listPtr, bufPtr)
+		},
+		"clock_res_get": func(clock, resPtr int32) (int32, *wasmtime.Trap) {
+			if trap := w.wasiCharge(0); trap != nil {
+				return 0, trap
+			}
+			if clock < clockRealtime || clock > clockThread {
+				return errnoInval, nil
+			}
+			if !w.ctx.wasiPutUint64(resPtr, 1) {
+				return errnoFault, nil
+			}
+			return errnoSuccess, nil
+		},
+		"clock_time_get": func(clock int32, _ int64, timePtr int32) (int32, *wasmtime.Trap) {
+			if trap := w.wasiCharge(0); trap != nil {
+				return 0, trap
+			}
+			if clock < clockRealtime || clock > clockThread {
+				return errnoInval, nil
+			}
+			if !w.ctx.wasiPutUint64(timePtr, uint64(w.ctx.wasi.now(clock))) {
+				return errnoFault, nil
+			}
+			return errnoSuccess, nil
+		},
+		"random_get": func(bufPtr, size int32) (int32, *wasmtime.Trap) {
+			if trap := w.wasiCharge(int64(uint32(size))); trap != nil {
+				return 0, trap
+			}
+			buf, ok := w.ctx.wasiSlice(bufPtr, size)
+			if !ok {
+				return errnoFault, nil
+			}
+			w.ctx.wasi.read(buf)
+			return errnoSuccess, nil
+		},
+		"fd_write": func(fd, iovsPtr, iovsLen, writtenPtr int32) (int32, *wasmtime.Trap) {
+			return w.wasiWrite(fd, iovsPtr, iovsLen, writtenPtr)
+		},
+		"fd_read": func(fd, _, _, readPtr int32) (int32, *wasmtime.Trap) {
+			if trap := w.wasiCharge(0); trap != nil {
+				return 0, trap
+			}
+			if fd != 0 {
+				return errnoBadf, nil
+			}
+			// stdin is always at the end
+			if !w.ctx.wasiPutUint32(readPtr, 0) {
+				return errnoFault, nil
+			}
+			return errnoSuccess, nil
+		},
+		"fd_fdstat_get": func(fd, statPtr int32) (int32, *wasmtime.Trap) {
+			if trap := w.wasiCharge(0); trap != nil {
+				return 0, trap
+			}
+			if fd < 0 || fd > 2 {
+				return errnoBadf, nil
+			}
+			stat, ok := w.ctx.wasiSlice(statPtr, 24)
+			if !ok {
+				return errnoFault, nil
+			}
+			// a character device, readable for stdin and writable for the others
+			rights := uint64(1 << 6)
+			if fd == 0 {
+				rights = 1 << 1
+			}
+			for i := range stat {
+				stat[i] = 0
+			}
+			stat[0] = 2
+			binary.LittleEndian.PutUint64(stat[8:], rights)
+			return errnoSuccess, nil
+		},
+		"fd_close": func(fd int32) (int32, *wasmtime.Trap) {
+			return w.wasiStdio(fd, errnoSuccess)
+		},
+		"fd_seek": func(fd int32, _ int64, _, _ int32) (int32, *wasmtime.Trap) {
+			return w.wasiStdio(fd, errnoSpipe)
+		},
+		// there are no preopened directories, so the filesystem is never reached
+		"fd_prestat_get": func(_, _ int32) (int32, *wasmtime.Trap) {
+			return w.wasiDenied(errnoBadf)
+		},
+		"fd_prestat_dir_name": func(_, _, _ int32) (int32, *wasmtime.Trap) {
+			return w.wasiDenied(errnoBadf)
+		},
+		"path_open": func(_, _, _, _, _ int32, _, _ int64, _, _ int32) (int32, *wasmtime.Trap) {
+			return w.wasiDenied(errnoNotcapable)
+		},
+		"poll_oneoff": func(_, _, _, _ int32) (int32, *wasmtime.Trap) {
+			return w.wasiDenied(errnoNotsup)
+		},
+		"sched_yield": func() (int32, *wasmtime.Trap) {
+			return w.wasiDenied(errnoSuccess)
+		},
+		"proc_exit": func(code int32) *wasmtime.Trap {
+			err := &types.ExitError{Code: code}
+			w.logger.Info("aspect exited", "code", code)
+			w.ctx.trapErr = err
+			return wasmtime.NewTrap(err.Error())
+		},
+	}
+
+	for name, fn := range functions {
+		if err := linker.FuncWrap(wasiModule, name, fn); err != nil {
+			return errors.Wrapf(err, "unable to link wasi function %s", name)
+		}
+	}
+	return nil
+}
+
+// wasiCharge charges a WASI call moving the given bytes
+func (w *wasmTimeRuntime) wasiCharge(bytes int64) *wasmtime.Trap {
+	return w.wasiConsume(w.config.WASI.CallCost + bytes*w.config.WASI.ByteCost)
+}
+
+// wasiConsume consumes the WASM gas of a WASI call, the call traps once the gas runs out
+func (w *wasmTimeRuntime) wasiConsume(cost int64) *wasmtime.Trap {
+	if err := w.ctx.gasMeter.ConsumeGas(cost); err != nil {
+		w.ctx.trapErr = err
+		return wasmtime.NewTrap(err.Error())
+	}
+	return nil
+}
+
+// wasiDenied charges a call which always fails with errno
+func (w *wasmTimeRuntime) wasiDenied(errno int32) (int32, *wasmtime.Trap) {
+	if trap := w.wasiCharge(0); trap != nil {
+		return 0, trap
+	}
+	return errno, nil
+}
+
+// wasiStdio charges a call on a file descriptor, which only succeeds with errno on stdio
+func (w *wasmTimeRuntime) wasiStdio(fd, errno int32) (int32, *wasmtime.Trap) {
+	if fd < 0 || fd > 2 {
+		return w.wasiDenied(errnoBadf)
+	}
+	return w.wasiDenied(errno)
+}
+
+// wasiSizes writes the number and the total size of the null terminated strings
+func (w *wasmTimeRuntime) wasiSizes(list []string, countPtr, sizePtr int32) (int32, *wasmtime.Trap) {
+	if trap := w.wasiCharge(0); trap != nil {
+		return 0, trap
+	}
+
+	size := 0
+	for _, item := range list {
+		size += len(item) + 1
+	}
+	if !w.ctx.wasiPutUint32(countPtr, uint32(len(list))) || !w.ctx.wasiPutUint32(sizePtr, uint32(size)) {
+		return errnoFault, nil
+	}
+	return errnoSuccess, nil
+}
+
+// wasiStrings writes the null terminated strings to bufPtr and their pointers to listPtr
+func (w *wasmTimeRuntime) wasiStrings(list []string, listPtr, bufPtr int32) (int32, *wasmtime.Trap) {
+	size := 0
+	for _, item := range list {
+		size += len(item) + 1
+	}
+	if trap := w.wasiCharge(int64(size)); trap != nil {
+		return 0, trap
+	}
+
+	buf, ok := w.ctx.wasiSlice(bufPtr, int32(size))
+	if !ok {
+		return errnoFault, nil
+	}
+	offset := 0
+	for i, item := range list {
+		if !w.ctx.wasiPutUint32(listPtr+int32(4*i), uint32(bufPtr)+uint32(offset)) {
+			return errnoFault, nil
+		}
+		offset += copy(buf[offset:], item)
+		buf[offset] = 0
+		offset++
+	}
+	return errnoSuccess, nil
+}
+
+// wasiWrite writes the io vectors to stdout or stderr, which go to the logger.
+// At most maxWASIOutput bytes are written, the number of bytes written tells
+// the aspect to write the rest again like a short write of writev.
+func (w *wasmTimeRuntime) wasiWrite(fd, iovsPtr, iovsLen, writtenPtr int32) (int32, *wasmtime.Trap) {
+	if fd != 1 && fd != 2 {
+		return w.wasiDenied(errnoBadf)
+	}
+
+	if iovsLen < 0 || iovsLen > maxWASIIovs {
+		return w.wasiDenied(errnoInval)
+	}
+	iovs, ok := w.ctx.wasiSlice(iovsPtr, 8*iovsLen)
+	if !ok {
+		return w.wasiDenied(errnoFault)
+	}
+
+	// the call is charged first, and each io vector before it is copied
+	if trap := w.wasiCharge(0); trap != nil {
+		return 0, trap
+	}
+	var out strings.Builder
+	for i := int32(0); i < iovsLen && out.Len() < maxWASIOutput; i++ {
+		ptr := int32(binary.LittleEndian.Uint32(iovs[8*i:]))
+		size := binary.LittleEndian.Uint32(iovs[8*i+4:])
+		if left := uint32(maxWASIOutput - out.Len()); size > left {
+			size = left
+		}
+		data, ok := w.ctx.wasiSlice(ptr, int32(size))
+		if !ok {
+			return errnoFault, nil
+		}
+		if trap := w.wasiConsume(int64(size) * w.config.WASI.ByteCost); trap != nil {
+			return 0, trap
+		}
+		out.Write(data)
+	}
+
+	stream := "stdout"
+	if fd == 2 {
+		stream = "stderr"
+	}
+	w.logger.Info("aspect output", "stream", stream, "data", strings.TrimSuffix(out.String(), "\n"))
+
+	if !w.ctx.wasiPutUint32(writtenPtr, uint32(out.Len())) {
+		return errnoFault, nil
+	}
+	return errnoSuccess, nil
+}
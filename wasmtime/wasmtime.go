@@ -6,7 +6,7 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	wasmtime "github.com/bytecodealliance/wasmtime-go/v20"
 	"github.com/pkg/errors"
@@ -14,9 +14,11 @@ import (
 	"github.com/artela-network/aspect-runtime/types"
 )
 
-const (
-	MaxMemorySize = 32 * 1024 * 1024
-)
+// MaxMemorySize is the default max size of the linear memory.
+//
+// Deprecated: the limit is set per runtime with types.RuntimeOptions, the
+// default is types.DefaultRuntimeOptions.MaxMemorySize.
+const MaxMemorySize = types.DefaultMaxMemorySize
 
 type wasmTimeValidator struct {
 	logger types.Logger
@@ -43,6 +45,10 @@ func (w *wasmTimeValidator) Validate(code []byte) error {
 		return errors.New(splits[0])
 	}
 
+	if err := types.ValidateAspect(code); err != nil {
+		w.logger.Error("aspect validation failed", "err", err)
+		return err
+	}
 	return nil
 }
 
@@ -50,68 +56,123 @@ func (w *wasmTimeValidator) Validate(code []byte) error {
 type wasmTimeRuntime struct {
 	sync.Mutex
 
-	engine *wasmtime.Engine
-	module *wasmtime.Module
-	linker *wasmtime.Linker
+	// engine and module are shared with the other runtimes, see cache.go
+	engine   *wasmtime.Engine
+	module   *wasmtime.Module
+	compiled *compiledModule
+	linker   *wasmtime.Linker
 
 	ctx *Context
 
 	apis *types.HostAPIRegistry
 
+	config *types.RuntimeConfig
+
+	// profiler is only set when profiling is enabled
+	profiler *profiler
+	profile  *types.GasProfile
+
+	// snapshot is the state restored by ResetStore in snapshot reset mode,
+	// it is taken by the first call of the instance
+	snapshot *snapshot
+
+	// interrupted is set by Interrupt, and cleared once the call is stopped
+	interrupted atomic.Bool
+
+	// hooks are the lifecycle hooks exported by the module
+	hooks types.Lifecycle
+
 	logger types.Logger
 }
 
-func NewWASMTimeRuntime(ctx context.Context, logger types.Logger, code []byte, apis *types.HostAPIRegistry) (out types.AspectRuntime, err error) {
+func NewWASMTimeRuntime(ctx context.Context, logger types.Logger, code []byte, apis *types.HostAPIRegistry, config *types.RuntimeConfig) (out types.AspectRuntime, err error) {
+	if config.Profiling && config.Metering != types.InstrumentedMetering {
+		return nil, errors.New("profiling requires instrumented gas metering")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Reset == types.SnapshotReset && config.Metering != types.InstrumentedMetering {
+		// the mutable globals saved by the snapshot are only exported by the
+		// instrumentation
+		return nil, errors.New("snapshot reset requires instrumented gas metering")
+	}
+	if err := types.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
 	watvm := &wasmTimeRuntime{
-		engine: wasmtime.NewEngineWithConfig(defaultWASMTimeConfig()),
+		engine: sharedEngine(config),
+		config: config,
 		logger: logger.With("runtime", "wasmtime"),
 	}
 
-	// init wasm module
-	watvm.module, err = wasmtime.NewModule(watvm.engine, code)
+	// get the compiled module, which is shared with the other runtimes of the same code
+	watvm.compiled, err = acquireModule(logger, watvm.engine, code, config)
 	if err != nil {
-		logger.Error("failed to create wasm module", "err", err, "size", len(code))
-		return nil, errors.Wrap(err, "unable create wasm module")
+		return nil, err
 	}
+	watvm.module = watvm.compiled.module
+	watvm.hooks = exportedHooks(watvm.logger, watvm.module, config.Hooks())
+	if config.Profiling {
+		watvm.profiler = newProfiler(watvm.compiled.functions)
+	}
+	defer func() {
+		if err != nil {
+			watvm.releaseModule()
+		}
+	}()
 
 	// init runtime context
-	watvm.ctx = NewContext(ctx, logger)
-	watvm.ctx.Store = wasmtime.NewStore(watvm.engine)
-	// limit memory size to 32MB for now
-	watvm.ctx.Store.Limiter(MaxMemorySize, -1, -1, -1, 100)
+	watvm.ctx = watvm.newContext(ctx)
 
-	// create host api linker
-	watvm.linker = wasmtime.NewLinker(watvm.engine)
-
-	// link all host apis
+	// link all host apis, the linker is kept for the whole life of the runtime
 	watvm.apis = apis
-	if err := watvm.linkToHostFns(); err != nil {
-		logger.Error("failed to link host functions", "err", err)
-		return nil, err
-	}
-
-	// add abort function
-	if err := watvm.linkAbort(); err != nil {
-		logger.Error("failed to link abort function", "err", err)
+	watvm.linker, err = watvm.newLinker()
+	if err != nil {
+		logger.Error("failed to create linker", "err", err)
 		return nil, err
 	}
 
 	// instantiate module and store
 	defer func() {
 		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintln(r))
+			err = &types.InstantiationError{Err: errors.New(fmt.Sprintln(r))}
 			logger.Error("failed to create wasm instance", "err", r, "stack", debug.Stack())
 		}
 	}()
 
 	watvm.ctx.Instance, err = watvm.linker.Instantiate(watvm.ctx.Store, watvm.module)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to instantiate wasm module")
+		return nil, &types.InstantiationError{Err: err}
 	}
 
 	return watvm, err
 }
 
+// newContext creates a runtime context with a new store
+func (w *wasmTimeRuntime) newContext(ctx context.Context) *Context {
+	c := NewContext(ctx, w.logger)
+	c.abi = w.config.GuestABI()
+	c.profiler = w.profiler
+	c.Store = wasmtime.NewStore(w.engine)
+	// multi-memory is disabled, so each instance has at most one memory
+	limits := w.config.Limits()
+	c.Store.Limiter(limits.MaxMemorySize, limits.MaxTableElements, limits.MaxInstances, limits.MaxTables, limits.MaxInstances)
+
+	if w.config.Metering == types.FuelMetering {
+		c.gasMeter = &fuelGasMeter{ctx: c}
+	}
+
+	if w.config.WASI != nil {
+		c.wasi = newWASIState(types.WASISeedFromContext(ctx))
+	}
+
+	c.interruption = &interruption{ctx: ctx, requested: &w.interrupted}
+	watchEpochs(c.Store, c.interruption)
+	return c
+}
+
 func (w *wasmTimeRuntime) Context() context.Context {
 	return w.ctx
 }
@@ -120,127 +181,225 @@ func (w *wasmTimeRuntime) Logger() types.Logger {
 	return w.logger
 }
 
+func (w *wasmTimeRuntime) GasProfile() *types.GasProfile {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.profile
+}
+
+// Interrupt stops the running call at the next epoch tick, or before the next
+// call without the epoch deadline callback, see types.AspectRuntime and
+// EpochCallbackSupported
+func (w *wasmTimeRuntime) Interrupt() {
+	w.interrupted.Store(true)
+}
+
 // Call wasm
-func (w *wasmTimeRuntime) Call(method string, gas int64, args ...interface{}) (res interface{}, leftover int64, err error) {
-	startTime := time.Now()
+func (w *wasmTimeRuntime) Call(method string, gas int64, args ...interface{}) (interface{}, int64, error) {
+	result, err := w.CallWithResult(method, gas, args...)
+	return result.Value, result.GasLeft, err
+}
 
-	defer func() {
-		w.logger.Info("aspect execution done",
-			"duration", time.Since(startTime).String(),
-			"remainingGas", leftover,
-			"gasUsed", gas-leftover,
-			"err", err)
-	}()
+// CallWithResult calls wasm and collects the statistics of the execution
+func (w *wasmTimeRuntime) CallWithResult(method string, gas int64, args ...interface{}) (*types.CallResult, error) {
+	return types.CallWithResult(w, method, gas, args...)
+}
 
-	w.Lock()
-	defer w.Unlock()
+// CallBatch calls the methods of the batch in order, the instance is initialized
+// once for the whole batch
+func (w *wasmTimeRuntime) CallBatch(batch *types.Batch) ([]*types.CallResult, error) {
+	return types.CallBatch(w, batch)
+}
 
-	w.logger.Info("calling aspect", "method", method, "gas", gas)
-	w.logger.Debug("initializing aspect")
-	if err := w.init(gas); err != nil {
-		return nil, 0, errors.Errorf("aspect init failed, %v", err)
-	}
+// VMContext returns the context of the instance, see types.CallEngine
+func (w *wasmTimeRuntime) VMContext() types.VMContext {
+	return w.ctx
+}
 
-	w.logger.Debug("executing aspect")
-	val, callErr := w.call(method, args...)
+// Hooks returns the lifecycle hooks exported by the module, see types.CallEngine
+func (w *wasmTimeRuntime) Hooks() types.Lifecycle {
+	return w.hooks
+}
 
-	leftover, gasErr := w.ctx.RemainingEVMGas()
-	if gasErr != nil {
-		w.logger.Error("failed to get remaining gas", "err", gasErr)
-		return nil, 0, gasErr
+// GuestABI returns the guest ABI of the module, see types.CallEngine
+func (w *wasmTimeRuntime) GuestABI() *types.GuestABI {
+	return w.config.GuestABI()
+}
+
+// BeginCall prepares the runtime for a call, see types.CallEngine. The gas
+// profile of the last call is dropped, it is not collected for the batches.
+func (w *wasmTimeRuntime) BeginCall() func() {
+	w.ctx.interruption.err = nil
+	armEpochs(w.ctx.Store, w.ctx.interruption)
+	w.profile = nil
+	return func() {
+		w.interrupted.Store(false)
 	}
+}
 
-	w.logger.Info("aspect executed", "method", method, "gas", gas, "leftover", leftover, "result", val, "err", callErr)
+// Interruption returns the error of an interrupted call, nil if the call can go on
+func (w *wasmTimeRuntime) Interruption() error {
+	return w.ctx.interruption.check()
+}
 
-	if callErr != nil {
-		return nil, leftover, callErr
-	}
+// Init initializes the instance for a call, see types.CallEngine
+func (w *wasmTimeRuntime) Init(gas int64) (bool, error) {
+	initialized := w.snapshot == nil
+	return initialized, w.init(gas)
+}
 
-	ptr, ok := val.(int32)
-	if !ok {
-		return nil, leftover, errors.Errorf("read output failed, value: %v", val)
+// ReleaseArgs unpins and frees the arguments of the last call, see types.CallEngine
+func (w *wasmTimeRuntime) ReleaseArgs() {
+	w.ctx.releaseArgs()
+}
+
+// ResetStackHeight resets the stack height counter, see types.CallEngine
+func (w *wasmTimeRuntime) ResetStackHeight() error {
+	return w.ctx.resetStackHeight()
+}
+
+// CountHostCalls starts or stops counting the host calls, see types.CallEngine
+func (w *wasmTimeRuntime) CountHostCalls(count bool) {
+	w.ctx.hostCalls = nil
+	if count {
+		w.ctx.hostCalls = make(map[hostAPI]int64)
 	}
+}
 
-	if ptr == 0 {
-		// void functions this will be 0
-		return nil, leftover, nil
+// HostCalls returns the host calls counted, see types.CallEngine
+func (w *wasmTimeRuntime) HostCalls() map[string]int64 {
+	calls := make(map[string]int64, len(w.ctx.hostCalls))
+	for api, n := range w.ctx.hostCalls {
+		calls[api.String()] = n
 	}
+	return calls
+}
 
-	header, err := w.ctx.ReadMemory(ptr, types.HeaderLen)
+// MemorySize returns the size of the linear memory, see types.CallEngine
+func (w *wasmTimeRuntime) MemorySize() (int64, error) {
+	mem, err := w.ctx.memory()
 	if err != nil {
-		w.logger.Error("failed to read return value header", "err", err)
-		return nil, leftover, err
+		return 0, err
 	}
+	return int64(len(mem)), nil
+}
 
-	h := &types.TypeHeader{}
-	dataType, dataLen, err := h.Unmarshal(header)
-	if err != nil {
-		w.logger.Error("failed to unmarshal return value header", "err", err)
-		return nil, leftover, errors.Errorf("read output failed, %v", err)
+// CollectProfile builds the gas profile of the call from the profiling
+// counters, see types.CallProfiler
+func (w *wasmTimeRuntime) CollectProfile(method string, gas int64) {
+	if w.profiler == nil {
+		return
 	}
 
-	resType, err := types.TypeObjectMapping(dataType)
+	// remaining gas fails only when gas runs out
+	remaining, _ := w.ctx.RemainingWASMGas()
+
+	profile, err := w.profiler.report(w.ctx, method, types.EVMGasToWASMGas(gas)-remaining)
 	if err != nil {
-		w.logger.Error("unsupported return value data type", "err", err, "dataType", dataType)
-		return nil, leftover, errors.Errorf("unsupported result type, %v", err)
+		w.logger.Error("failed to collect gas profile", "err", err)
+		return
 	}
+	w.profile = profile
+}
 
-	retData, err := w.ctx.ReadMemory(ptr, types.HeaderLen+dataLen)
+// Invoke calls an export, see types.CallEngine
+func (w *wasmTimeRuntime) Invoke(method string, args ...interface{}) (interface{}, error) {
+	run := w.ctx.Instance.GetFunc(w.ctx.Store, method)
+	if run == nil {
+		return nil, errors.WithMessage(types.MethodNotFoundError, method)
+	}
+
+	// the apis are released when the runtime is reset, the teardown hook of a
+	// pooled runtime runs without them
+	if w.apis != nil {
+		w.apis.SetContext(w.ctx)
+	}
+	params := run.Type(w.ctx.Store).Params()
+	if len(params) != len(args) {
+		return nil, errors.Errorf("method %s expects %d arguments, got %d", method, len(params), len(args))
+	}
+
+	kinds := make([]byte, len(params))
+	for i, param := range params {
+		kinds[i] = valueType(param.Kind())
+	}
+	vals, err := types.NativeArgs(w.ctx, kinds, args, w.ctx.allocArg)
 	if err != nil {
-		w.logger.Error("failed to read return value", "err", err)
-		return nil, leftover, errors.Errorf("read output failed, %v", err)
+		return nil, err
 	}
 
-	res, err = resType.Unmarshal(retData)
+	w.ctx.trapErr = nil
+	val, err := run.Call(w.ctx.Store, vals...)
 	if err != nil {
-		w.logger.Error("failed to unmarshal return value", "err", err)
-		return nil, leftover, errors.Errorf("read output failed, %v", err)
+		return nil, w.callError(method, err)
 	}
 
-	return res, leftover, nil
+	results, ok := val.([]wasmtime.Val)
+	if !ok {
+		return val, nil
+	}
+	multi := make([]interface{}, len(results))
+	for i, v := range results {
+		multi[i] = v.Get()
+	}
+	return multi, nil
 }
 
-func (w *wasmTimeRuntime) call(method string, args ...interface{}) (interface{}, error) {
-	run := w.ctx.Instance.GetFunc(w.ctx.Store, method)
-	if run == nil {
-		return nil, errors.Errorf("method %s does not exist", method)
+// callError maps the error of a failed call to the errors of the types package
+func (w *wasmTimeRuntime) callError(method string, err error) error {
+	if err := w.ctx.interruption.err; err != nil {
+		return err
 	}
 
-	w.apis.SetContext(w.ctx)
-
-	ptrs := make([]interface{}, len(args))
-	for i, arg := range args {
-		typeIndex := types.AssertType(arg)
-		rtType, err := types.TypeObjectMapping(typeIndex)
-		if err != nil {
-			return nil, err
+	trapErr := &types.TrapError{Code: types.TrapUnknown, Message: err.Error()}
+	if trap, ok := err.(*wasmtime.Trap); ok {
+		if trap.Code() != nil {
+			trapErr.Code = types.TrapCode(*trap.Code())
 		}
+		trapErr.Message = trapMessage(trap)
+		trapErr.Backtrace = w.backtrace(trap)
+	}
+	code := trapErr.Code
 
-		data := rtType.Marshal(arg)
-		ptr, err := w.ctx.AllocMemory(int32(len(data)))
-
-		w.logger.Debug("input data length", "index", i, "len", len(data), "type", typeIndex.String())
-		if err != nil {
-			return nil, err
+	// the epoch deadline armed for the deadline of the context is reached
+	if code == types.TrapInterrupt {
+		if err := w.ctx.interruption.check(); err != nil {
+			return err
 		}
+		return types.DeadlineExceededError
+	}
 
-		if err := w.ctx.WriteMemory(ptr, data); err != nil {
-			return nil, err
+	// the error raised by the host, e.g. a failed host api
+	if err := w.ctx.trapErr; err != nil {
+		if abortErr, ok := err.(*types.AbortError); ok {
+			abortErr.Backtrace = trapErr.Backtrace
+			if source := trapErr.Backtrace.Source(); source != nil && abortErr.File == "" {
+				abortErr.File, abortErr.Line, abortErr.Column = source.File, int32(source.Line), int32(source.Column)
+			}
 		}
-
-		ptrs[i] = ptr
+		return err
 	}
 
-	val, err := run.Call(w.ctx.Store, ptrs...)
-	if err != nil {
-		if err.Error() == types.OutOfGasError.Error() {
-			return nil, types.OutOfGasError
+	if code == types.TrapOutOfFuel {
+		if err := w.ctx.gasMeter.drain(); err != nil {
+			w.logger.Error("failed to drain gas meter", "err", err)
 		}
+		return types.OutOfGasError
+	}
 
-		return nil, errors.Wrapf(err, "method %s execution fail, err: %s", method, err.Error())
+	// the instrumented gas counter is set to -1 before trapping
+	if _, gasErr := w.ctx.RemainingWASMGas(); gasErr == types.OutOfGasError {
+		return types.OutOfGasError
 	}
 
-	return val, nil
+	if err := w.stackOverflow(code); err != nil {
+		return err
+	}
+
+	w.logger.Error("aspect trapped", "aspect", w.aspectKey(), "method", method,
+		"code", code, "message", trapErr.Message, "backtrace", trapErr.Backtrace.String())
+	return errors.WithMessagef(trapErr, "method %s execution fail", method)
 }
 
 func (w *wasmTimeRuntime) init(gas int64) error {
@@ -250,16 +409,89 @@ func (w *wasmTimeRuntime) init(gas int64) error {
 		return err
 	}
 
-	w.logger.Debug("initializing aspect")
-	if _, err := w.call("__aspect_start__"); err != nil {
-		w.logger.Error("failed to initialize aspect", "err", err)
+	if err := w.ctx.resetStackHeight(); err != nil {
+		w.logger.Error("failed to reset stack height", "err", err)
 		return err
 	}
 
+	if w.config.WASI != nil {
+		// each call reads the same clocks and random bytes from the seed
+		w.ctx.wasi = newWASIState(types.WASISeedFromContext(w.ctx.Context))
+	}
+
+	if w.profiler != nil {
+		if err := w.profiler.reset(w.ctx); err != nil {
+			w.logger.Error("failed to reset profiler", "err", err)
+			return err
+		}
+	}
+
+	if w.snapshot != nil {
+		// the state after the start function has been restored, only charge its gas
+		w.logger.Debug("aspect restored from snapshot")
+		return w.ctx.gasMeter.ConsumeGas(w.snapshot.startGas)
+	}
+
+	gasBefore, _ := w.ctx.RemainingWASMGas()
+
+	w.logger.Debug("initializing aspect")
+	if start := w.config.GuestABI().Start; start != "" {
+		if _, err := w.Invoke(start); err != nil {
+			w.logger.Error("failed to initialize aspect", "err", err)
+			return err
+		}
+	}
+
+	if !w.ctx.initialized {
+		if err := types.RunHook(w, "init", w.hooks.Init, true); err != nil {
+			w.logger.Error("failed to initialize aspect instance", "err", err)
+			return err
+		}
+		w.ctx.initialized = true
+	}
+
+	if w.config.Reset == types.SnapshotReset {
+		gasAfter, _ := w.ctx.RemainingWASMGas()
+		snapshot, err := takeSnapshot(w.ctx, w.module, gasBefore-gasAfter)
+		if err != nil {
+			// not fatal, the instance is recreated on the next reset
+			w.logger.Error("failed to take snapshot", "err", err)
+		}
+		w.snapshot = snapshot
+	}
+
 	w.logger.Debug("aspect initialized")
 	return nil
 }
 
+// stackOverflow returns the error of a call failed by exceeding the stack
+// height limit, or nil if the limit is not exceeded. The native stack overflow
+// of the engine depends on the architecture and the code generation, it must
+// never be reached before the limit. It still fails the call with a stack
+// overflow, but it is logged and reported apart from the limit.
+func (w *wasmTimeRuntime) stackOverflow(code types.TrapCode) error {
+	if w.config.MaxStackHeight == 0 {
+		// only the native stack limits the recursion
+		if code == types.TrapStackOverflow {
+			return types.StackOverflowError
+		}
+		return nil
+	}
+
+	height, heightErr := w.ctx.stackHeight()
+	if heightErr != nil {
+		w.logger.Error("failed to read stack height", "err", heightErr)
+	} else if height > w.config.MaxStackHeight {
+		return types.StackOverflowError
+	}
+
+	if code != types.TrapStackOverflow {
+		return nil
+	}
+	w.logger.Error("native stack overflowed before the stack height limit", "height", height, "limit", w.config.MaxStackHeight)
+	return errors.WithMessage(types.StackOverflowError, "native stack overflowed before the stack height limit")
+}
+
 // ResetStore reset the whole memory of wasm
 func (w *wasmTimeRuntime) ResetStore(ctx context.Context, apis *types.HostAPIRegistry) (err error) {
 	w.Lock()
@@ -274,29 +506,37 @@ func (w *wasmTimeRuntime) ResetStore(ctx context.Context, apis *types.HostAPIReg
 
 	w.logger.Debug("resetting wasm store")
 
-	w.ctx = NewContext(ctx, w.logger)
-	w.ctx.Store = wasmtime.NewStore(w.engine)
-	w.ctx.Store.Limiter(MaxMemorySize, -1, -1, -1, 100)
-
-	w.linker = wasmtime.NewLinker(w.engine)
-	w.apis = apis
+	if w.snapshot != nil && w.ctx != nil {
+		restored, err := w.snapshot.restore(w.ctx)
+		if err == nil && restored {
+			w.ctx.Context = ctx
+			w.ctx.interruption.ctx = ctx
+			w.interrupted.Store(false)
+			w.apis = apis
+			w.logger.Debug("wasm instance restored from snapshot")
+			return nil
+		}
 
-	// reset link all host apis with new store
-	if err := w.linkToHostFns(); err != nil {
-		w.logger.Error("failed to link host functions", "err", err)
-		return err
+		// the memory has grown since the snapshot, fall back to a new instance
+		w.logger.Debug("unable to restore snapshot, recreating wasm store", "err", err)
+		w.snapshot = nil
 	}
 
-	// add abort function
-	if err := w.linkAbort(); err != nil {
-		w.logger.Error("failed to link abort function", "err", err)
-		return err
+	if w.ctx != nil {
+		w.teardown()
+		w.ctx.Reset()
 	}
+	w.interrupted.Store(false)
+	w.ctx = w.newContext(ctx)
+
+	// the host apis are looked up in the registry on each call, so only the
+	// store needs to be recreated
+	w.apis = apis
 
 	w.ctx.Instance, err = w.linker.Instantiate(w.ctx.Store, w.module)
 	if err != nil {
 		w.logger.Error("failed to instantiate wasm module", "err", err)
-		return errors.Wrap(err, "unable to instantiate wasm module")
+		return &types.InstantiationError{Err: err}
 	}
 
 	w.logger.Debug("wasm store reset")
@@ -310,14 +550,22 @@ func (w *wasmTimeRuntime) Destroy() {
 
 	w.logger.Debug("destroying wasm runtime")
 
+	w.snapshot = nil
 	w.clear()
-
-	if w.module != nil {
-		w.module.Close()
+	if w.linker != nil {
+		w.linker.Close()
 	}
-	if w.engine != nil {
-		w.engine.Close()
+	w.linker = nil
+	w.releaseModule()
+}
+
+// releaseModule drops the reference to the shared module, the engine is never closed
+func (w *wasmTimeRuntime) releaseModule() {
+	if w.compiled != nil {
+		releaseModule(w.compiled)
 	}
+	w.compiled = nil
+	w.module = nil
 }
 
 func (w *wasmTimeRuntime) Reset() {
@@ -326,63 +574,30 @@ func (w *wasmTimeRuntime) Reset() {
 
 	w.logger.Debug("resetting wasm runtime")
 
+	if w.snapshot != nil {
+		// keep the instance to be restored in place by ResetStore
+		w.apis = nil
+		return
+	}
+
 	w.clear()
 }
 
 func (w *wasmTimeRuntime) clear() {
-	w.apis = nil
-
-	// Deallocate resources associated with the instance, linker, and store.
-	// These components will be reconstructed before the next invocation.
-	if w.linker != nil {
-		w.linker.Close()
-	}
-	w.linker = nil
-
+	// Deallocate resources associated with the instance and store.
+	// These components will be reconstructed before the next invocation,
+	// the linker does not depend on the store and is kept.
 	if w.ctx != nil {
+		w.teardown()
 		w.ctx.Reset()
 	}
 	w.ctx = nil
-}
-
-func (w *wasmTimeRuntime) linkToHostFns() error {
-	for module, namespaces := range w.apis.WrapperFuncs() {
-		for ns, methods := range namespaces {
-			for method, function := range methods {
-				// create a function wrapper for our "hostapi" on the go side
-				item := wasmtime.WrapFunc(w.ctx.Store, function)
-
-				// create linker with host function injected
-				if err := w.linker.Define(
-					w.ctx.Store,
-					buildModuleName(module),
-					buildModuleMethod(ns, method),
-					item,
-				); err != nil {
-					w.logger.Error("failed to link host api", "module", module, "namespace", ns, "method", method, "err", err)
-					return errors.Wrapf(
-						err, "unable to link host api %s:%s.%s", module, ns, method,
-					)
-				}
-			}
-		}
-	}
-	return nil
-}
-
-func (w *wasmTimeRuntime) linkAbort() error {
-	abort := wasmtime.WrapFunc(w.ctx.Store, func(a, b, c, d int32) {
-		w.logger.Debug("abort called", "a", a, "b", b, "c", c, "d", d)
-	})
-	if err := w.linker.Define(w.ctx.Store, "env", "abort", abort); err != nil {
-		return errors.Wrapf(err, "unable to link to abort")
-	}
-	return nil
+	w.apis = nil
 }
 
 // defaultWASMTimeConfig provides a default wasmtime config for the runner.
 // TODO: currently this is just a very early version, should investigate deeper for each config option.
-func defaultWASMTimeConfig() *wasmtime.Config {
+func defaultWASMTimeConfig(runtimeConfig *types.RuntimeConfig) *wasmtime.Config {
 	config := wasmtime.NewConfig()
 	// we don't quite need this, discuss later
 	config.SetWasmSIMD(false)
@@ -392,6 +607,13 @@ func defaultWASMTimeConfig() *wasmtime.Config {
 	config.SetWasmThreads(false)
 	// multi-value return is useful, should be enabled
 	config.SetWasmMultiValue(true)
+	// the running calls are stopped at the epoch ticks once interrupted,
+	// see epoch.go
+	config.SetEpochInterruption(true)
+	limits := runtimeConfig.Limits()
+	// if the stack height is limited by the instrumentation, the native limit
+	// is validated so that the instrumented limit is always reached first
+	config.SetMaxWasmStack(int(limits.MaxWasmStack))
 	// need to run benchmarks on this and adjust later
 	config.SetCraneliftOptLevel(wasmtime.OptLevelSpeedAndSize)
 	// disable multi-memory by default
@@ -401,12 +623,21 @@ func defaultWASMTimeConfig() *wasmtime.Config {
 	// reference type must be disabled, this relies on bulk memory
 	config.SetWasmReferenceTypes(false)
 
+	if runtimeConfig.Metering == types.FuelMetering {
+		// bulk memory stays disabled with fuel metering as well, memory.copy
+		// and memory.fill are charged a flat fuel cost regardless of the size
+		// they operate on, which would undercharge the whole memory for a
+		// single instruction.
+		config.SetConsumeFuel(true)
+	}
+
 	// enables selecting the "static" option for all linear memories
 	config.SetStaticMemoryForced(true)
 	// configures the size of linear memory to reserve for each memory in the
 	// pooling allocator.
-	// lock to 10MB here.
-	config.SetStaticMemoryMaximumSize(10 * (1 << 20))
+	// lock to the max memory size of the runtime here, memories cannot grow
+	// out of the reservation.
+	config.SetStaticMemoryMaximumSize(uint64(limits.MaxMemorySize))
 	// configures the size, in bytes, of the guard region used at the end of a
 	// static memory's address space reservation.
 	// default to 2GB on 64-bit platforms, 64K on 32-bit platforms.
@@ -12,11 +12,11 @@ import (
 
 func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, method types.MethodName,
 	hostFunc *types.HostFuncWithGasRule) (interface{}, error) {
-	errNotSupport := errors.New("host function not supported")
+	errNotSupport := errors.WithMessage(types.UnsupportedTypeError, "host function not supported")
 
 	fn := hostFunc.Func
 	gasRule := hostFunc.GasRule
-	hostCtx := hostFunc.HostContext
+	id := hostAPI{module, ns, method}
 
 	t := reflect.TypeOf(fn)
 	if t.NumOut() > 2 || t.NumOut() == 0 {
@@ -37,7 +37,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				_, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn)
+				_, trap := executeWrapper(api.Context(), id, gasRule, fn)
 				return trap
 			}, nil
 
@@ -53,7 +53,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				_, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn, arg)
+				_, trap := executeWrapper(api.Context(), id, gasRule, fn, arg)
 				return trap
 			}, nil
 
@@ -69,7 +69,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				_, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn, arg1, arg2)
+				_, trap := executeWrapper(api.Context(), id, gasRule, fn, arg1, arg2)
 				return trap
 			}, nil
 
@@ -85,7 +85,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				_, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn, arg1, arg2, arg3)
+				_, trap := executeWrapper(api.Context(), id, gasRule, fn, arg1, arg2, arg3)
 				return trap
 			}, nil
 		}
@@ -103,7 +103,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				out, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn)
+				out, trap := executeWrapper(api.Context(), id, gasRule, fn)
 				if trap != nil {
 					return 0, trap
 				}
@@ -122,7 +122,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				out, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn, arg)
+				out, trap := executeWrapper(api.Context(), id, gasRule, fn, arg)
 				if trap != nil {
 					return 0, trap
 				}
@@ -141,7 +141,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				out, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn, arg1, arg2)
+				out, trap := executeWrapper(api.Context(), id, gasRule, fn, arg1, arg2)
 				if trap != nil {
 					return 0, trap
 				}
@@ -160,7 +160,7 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 						"method", method)
 				}()
 
-				out, trap := executeWrapper(api.Context(), hostCtx, gasRule, fn, arg1, arg2, arg3)
+				out, trap := executeWrapper(api.Context(), id, gasRule, fn, arg1, arg2, arg3)
 				if trap != nil {
 					return 0, trap
 				}
@@ -172,140 +172,48 @@ func Wrap(api *types.HostAPIRegistry, module types.Module, ns types.NameSpace, m
 	return nil, errNotSupport
 }
 
-func executeWrapper(vmCtx types.VMContext, hostCtx types.HostContext, gasRule types.HostFuncGasRule, fn interface{}, ptrs ...int32) ([]int32, *wasmtime.Trap) {
+func executeWrapper(vmCtx types.VMContext, id hostAPI, gasRule types.HostFuncGasRule, fn interface{}, ptrs ...int32) ([]int32, *wasmtime.Trap) {
+	if ctx, ok := vmCtx.(*Context); ok {
+		if ctx.hostCalls != nil {
+			ctx.hostCalls[id]++
+		}
+		if ctx.profiler != nil {
+			gasBefore, childBefore := ctx.profiler.enterHost(ctx)
+			defer ctx.profiler.exitHost(ctx, id, gasBefore, childBefore)
+		}
+	}
+
 	gasRule.SetContext(vmCtx)
 
-	args, paramSize, err := paramsRead(vmCtx, ptrs...)
+	args, paramSize, err := types.ReadHostParams(vmCtx, ptrs...)
 	if paramSize > 0 {
 		if err := gasRule.ConsumeGas(paramSize); err != nil {
-			return nil, wasmtime.NewTrap(err.Error())
+			return nil, hostAPIFailure(vmCtx, id, err)
 		}
 	}
 	if err != nil {
 		vmCtx.Logger().Error("read params failed", "err", err)
-		return nil, wasmtime.NewTrap("read params failed")
+		return nil, hostAPIFailure(vmCtx, id, errors.WithMessage(err, "read params failed"))
 	}
-	v := reflect.ValueOf(fn)
+	// host apis charge their gas with the gas meter of vmCtx directly
+	res := reflect.ValueOf(fn).Call(args)
 
-	// need to sync the gas in vm to host
-	remaining, err := vmCtx.RemainingWASMGas()
+	outPtrs, err := types.WriteHostResults(vmCtx, res)
 	if err != nil {
-		vmCtx.Logger().Error("failed to load gas counter", "err", err)
-		return nil, wasmtime.NewTrap("failed to load gas counter")
-	}
-
-	// NOTE: during the host call, the gas consumed is in EVM metric, so it will be 1000x than WASM metric,
-	//       e.g. if the gas in WASM remaining is 11111, when put to EVM is will be 10,
-	//       after the host call, the gas put back to WASM should be (10 - EVM Gas Cost) * 1000 + 1111
-	remainderGas := remaining % types.EVMGasToWASMGasMultiplier
-	hostCtx.SetGas(uint64(remaining) / types.EVMGasToWASMGasMultiplier)
-
-	res := v.Call(args)
-
-	// after the host call we need to sync the gas in host back to vm
-	remaining = int64(hostCtx.RemainingGas())
-	if err := vmCtx.SetWASMGas(remaining*types.EVMGasToWASMGasMultiplier + remainderGas); err != nil {
-		vmCtx.Logger().Error("failed to sync gas counter back", "err", err)
-		return nil, wasmtime.NewTrap("failed to update vm gas")
-	}
-
-	outPtrs, err := paramListWrite(vmCtx, res)
-	if err != nil && err.Error() == types.OutOfGasError.Error() {
 		vmCtx.Logger().Error("host api execution fail", "err", err)
-		return nil, wasmtime.NewTrap(types.OutOfGasError.Error())
-	}
-
-	if err != nil {
-		vmCtx.Logger().Error("write params failed", "err", err)
-		return nil, wasmtime.NewTrap("write params failed")
+		return nil, hostAPIFailure(vmCtx, id, err)
 	}
 	return outPtrs, nil
 }
 
-func paramsRead(ctx types.VMContext, ptrs ...int32) ([]reflect.Value, int64, error) {
-	args := make([]reflect.Value, len(ptrs))
-	paramSize := int64(0)
-
-	if len(args) == 0 {
-		return args, paramSize, nil
-	}
-
-	for i, ptr := range ptrs {
-		h := &types.TypeHeader{}
-		header, err := ctx.ReadMemory(ptr, types.HeaderLen)
-		if err != nil {
-			return nil, paramSize, err
-		}
-
-		dataType, dataLen, err := h.Unmarshal(header)
-		if err != nil {
-			return nil, paramSize, err
-		}
-
-		paramSize += int64(dataLen)
-
-		reqType, err := types.TypeObjectMapping(dataType)
-		if err != nil {
-			return nil, paramSize, err
-		}
-
-		reqData, err := ctx.ReadMemory(ptr, types.HeaderLen+dataLen)
-		if err != nil {
-			return nil, paramSize, err
-		}
-
-		value, err := reqType.Unmarshal(reqData)
-		if err != nil {
-			return nil, paramSize, err
-		}
-		args[i] = reflect.ValueOf(value)
-	}
-
-	return args, paramSize, nil
-}
-
-func storeValue(ctx types.VMContext, value reflect.Value) (int32, error) {
-	retIndex := types.AssertType(value.Interface())
-
-	resType, err := types.TypeObjectMapping(retIndex)
-	if err != nil {
-		return 0, err
+// hostAPIFailure builds the trap stopping the wasm code after a failed host api.
+// The error is kept in the context, and returned by the call instead of the trap.
+func hostAPIFailure(vmCtx types.VMContext, id hostAPI, err error) *wasmtime.Trap {
+	if !errors.Is(err, types.OutOfGasError) {
+		err = &types.HostAPIError{Module: id.module, Namespace: id.ns, Method: id.method, Err: err}
 	}
-
-	data := resType.Marshal(value.Interface())
-	ptr, err := ctx.AllocMemory(int32(len(data)))
-	if err != nil {
-		return 0, err
+	if ctx, ok := vmCtx.(*Context); ok {
+		ctx.trapErr = err
 	}
-
-	if err := ctx.WriteMemory(ptr, data); err != nil {
-		return 0, err
-	}
-
-	return ptr, nil
-}
-
-func paramListWrite(ctx types.VMContext, values []reflect.Value) ([]int32, error) {
-	if len(values) == 0 {
-		return nil, nil
-	}
-
-	lastRetVal := values[len(values)-1].Interface()
-	if _, ok := lastRetVal.(error); !ok && lastRetVal != nil {
-		return nil, errors.New("invalid host func, last return value must be error")
-	} else if ok && lastRetVal != nil {
-		return nil, lastRetVal.(error)
-	}
-
-	valuesLen := len(values) - 1
-	int32Ary := make([]int32, valuesLen)
-	for i, value := range values[:valuesLen] {
-		i2, err := storeValue(ctx, value)
-		if err != nil {
-			return nil, err
-		}
-		int32Ary[i] = i2
-	}
-
-	return int32Ary, nil
+	return wasmtime.NewTrap(err.Error())
 }
@@ -0,0 +1,277 @@
+package wazero
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+type Context struct {
+	context.Context
+
+	logger types.Logger
+
+	Module api.Module
+
+	// callCtx is the context of the running call, it is canceled by Interrupt.
+	// The exports called by the host during the call run with it as well.
+	callCtx context.Context
+
+	gasMeter *globalGasMeter
+
+	// abi names the memory management exports, the functions are looked up
+	// on first use
+	abi       *types.GuestABI
+	allocator api.Function
+	abiFuncs  map[string]api.Function
+
+	// args are the arguments allocated for the current call, released after it
+	args []allocation
+
+	// trapErr is the error which made the host trap the wasm code, it is
+	// returned by the call instead of the trap
+	trapErr error
+
+	// hostCalls counts the calls of each host api during the current call
+	hostCalls map[hostAPI]int64
+
+	// initialized is set once the init hook has run on the instance
+	initialized bool
+}
+
+func NewContext(ctx context.Context, logger types.Logger) *Context {
+	c := &Context{
+		Context: ctx,
+		callCtx: ctx,
+		logger:  logger,
+		abi:     &types.DefaultABI,
+	}
+	c.gasMeter = &globalGasMeter{ctx: c}
+	return c
+}
+
+func (c *Context) Logger() types.Logger {
+	return c.logger
+}
+
+func (c *Context) WriteMemory(ptr int32, data []byte) error {
+	mem, err := c.memory()
+	if err != nil {
+		return err
+	}
+
+	if (ptr + int32(len(data))) > int32(len(mem)) {
+		return errors.New("memory out of bound")
+	}
+
+	copy(mem[ptr:], data)
+	return nil
+}
+
+func (c *Context) ReadMemory(ptr int32, size int32) ([]byte, error) {
+	mem, err := c.memory()
+	if err != nil {
+		return nil, err
+	}
+
+	if (ptr + size) > int32(len(mem)) {
+		return nil, errors.New("memory out of bound")
+	}
+
+	dataCopy := make([]byte, size)
+	copy(dataCopy, mem[ptr:ptr+size])
+
+	return dataCopy, nil
+}
+
+func (c *Context) Reset() {
+	if c.Module != nil {
+		if err := c.Module.Close(context.Background()); err != nil {
+			c.logger.Error("failed to close wasm instance", "err", err)
+		}
+	}
+	c.Module = nil
+	c.allocator = nil
+	c.abiFuncs = nil
+
+	c.gasMeter.reset()
+}
+
+// readASString reads an AssemblyScript string, the UTF-16 code units are
+// preceded by their size in bytes stored in the object header.
+func (c *Context) readASString(ptr int32) (string, error) {
+	if ptr == 0 {
+		return "", nil
+	}
+
+	mem, err := c.memory()
+	if err != nil {
+		return "", err
+	}
+
+	start := int64(uint32(ptr))
+	if start < 4 || start > int64(len(mem)) {
+		return "", errors.New("memory out of bound")
+	}
+	end := start + int64(binary.LittleEndian.Uint32(mem[start-4:])&^1)
+	if end > int64(len(mem)) {
+		return "", errors.New("memory out of bound")
+	}
+
+	units := make([]uint16, (end-start)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(mem[start+2*int64(i):])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// memory returns the whole linear memory, the slice is invalidated once the
+// memory grows
+func (c *Context) memory() ([]byte, error) {
+	mem := c.Module.ExportedMemory(c.abi.Memory)
+	if mem == nil {
+		return nil, errors.New("memory export not found")
+	}
+
+	data, ok := mem.Read(0, mem.Size())
+	if !ok {
+		return nil, errors.New("memory out of bound")
+	}
+	return data, nil
+}
+
+func (c *Context) AllocMemory(size int32) (int32, error) {
+	if c.allocator == nil {
+		c.allocator = c.Module.ExportedFunction(c.abi.Alloc)
+		if c.allocator == nil {
+			return 0, errors.New("function '" + c.abi.Alloc + "' does not exist")
+		}
+	}
+
+	params := make([]uint64, 0, 1+len(c.abi.AllocArgs))
+	params = append(params, api.EncodeI32(size))
+	for _, arg := range c.abi.AllocArgs {
+		params = append(params, api.EncodeI32(arg))
+	}
+
+	res, err := c.allocator.Call(c.callCtx, params...)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(res) != 1 || c.allocator.Definition().ResultTypes()[0] != api.ValueTypeI32 {
+		return 0, errors.New("function '" + c.abi.Alloc + "' does not return a pointer")
+	}
+	return api.DecodeI32(res[0]), nil
+}
+
+// allocation is the memory allocated for an argument of a call
+type allocation struct {
+	ptr  int32
+	size int32
+}
+
+// allocArg allocates the memory of an argument of the current call, which is
+// pinned until releaseArgs if the abi has a pin function
+func (c *Context) allocArg(size int32) (int32, error) {
+	ptr, err := c.AllocMemory(size)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.abi.Pin != "" {
+		if err := c.callABI(c.abi.Pin, ptr); err != nil {
+			return 0, err
+		}
+	}
+	c.args = append(c.args, allocation{ptr: ptr, size: size})
+	return ptr, nil
+}
+
+// releaseArgs unpins and frees the arguments of the current call, the guest
+// calls are charged to the gas left by the call. The call is done, so the
+// failures are only logged.
+func (c *Context) releaseArgs() {
+	args := c.args
+	c.args = nil
+
+	for _, arg := range args {
+		if c.abi.Unpin != "" {
+			if err := c.callABI(c.abi.Unpin, arg.ptr); err != nil {
+				c.logger.Error("failed to unpin argument", "err", err)
+				return
+			}
+		}
+		if c.abi.Free != "" {
+			params := []int32{arg.ptr}
+			if c.abi.FreeWithSize {
+				params = append(params, arg.size)
+			}
+			if err := c.callABI(c.abi.Free, params...); err != nil {
+				c.logger.Error("failed to free argument", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// callABI calls a memory management export of the abi
+func (c *Context) callABI(name string, args ...int32) error {
+	fn, ok := c.abiFuncs[name]
+	if !ok {
+		fn = c.Module.ExportedFunction(name)
+		if fn == nil {
+			return errors.New("function '" + name + "' does not exist")
+		}
+		if c.abiFuncs == nil {
+			c.abiFuncs = make(map[string]api.Function)
+		}
+		c.abiFuncs[name] = fn
+	}
+
+	params := make([]uint64, len(args))
+	for i, arg := range args {
+		params[i] = api.EncodeI32(arg)
+	}
+	_, err := fn.Call(c.callCtx, params...)
+	return err
+}
+
+func (c *Context) GasMeter() types.GasMeter {
+	return c.gasMeter
+}
+
+func (c *Context) RemainingEVMGas() (int64, error) {
+	leftover, err := c.RemainingWASMGas()
+	if err != nil {
+		return leftover, err
+	}
+
+	return types.WASMGasToEVMGas(leftover), nil
+}
+
+func (c *Context) RemainingWASMGas() (int64, error) {
+	return c.gasMeter.RemainingGas()
+}
+
+func (c *Context) ConsumeWASMGas(gas int64) error {
+	return c.gasMeter.ConsumeGas(gas)
+}
+
+func (c *Context) AddEVMGas(gas int64) error {
+	// check overflow
+	if gas > types.MaxGas {
+		return errors.New("gas overflow")
+	}
+
+	return c.gasMeter.setGas(types.EVMGasToWASMGas(gas))
+}
+
+func (c *Context) SetWASMGas(gas int64) error {
+	return c.gasMeter.setGas(gas)
+}
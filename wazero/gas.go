@@ -0,0 +1,140 @@
+package wazero
+
+import (
+	"errors"
+	"math"
+
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+var _ types.GasMeter = (*globalGasMeter)(nil)
+
+// globalGasMeter is the gas meter backed by the gas counter of the instance,
+// "__gas_counter__" global variable is an i64 injected by wasm instrument lib.
+// The wasm code charges the counter directly, so the counter is the only
+// place where the remaining gas is kept.
+type globalGasMeter struct {
+	ctx *Context
+
+	counter api.MutableGlobal
+}
+
+func (m *globalGasMeter) gasCounter() (api.MutableGlobal, error) {
+	if m.counter != nil {
+		return m.counter, nil
+	}
+
+	counter, ok := mutableGlobal(m.ctx.Module, "__gas_counter__")
+	if !ok {
+		return nil, errors.New("gas counter not exported")
+	}
+
+	m.counter = counter
+	return m.counter, nil
+}
+
+func (m *globalGasMeter) ConsumeGas(gas int64) error {
+	if gas < 0 {
+		return errors.New("negative gas")
+	}
+
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return err
+	}
+
+	leftover := int64(gasCounter.Get())
+	if leftover < gas {
+		gasCounter.Set(api.EncodeI64(-1))
+		return types.OutOfGasError
+	}
+
+	gasCounter.Set(api.EncodeI64(leftover - gas))
+	return nil
+}
+
+func (m *globalGasMeter) RefundGas(gas int64) error {
+	if gas < 0 {
+		return errors.New("negative gas")
+	}
+
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return err
+	}
+
+	leftover := int64(gasCounter.Get())
+	if leftover < 0 {
+		// out of gas is final
+		return types.OutOfGasError
+	}
+	if gas > math.MaxInt64-leftover {
+		return errors.New("gas overflow")
+	}
+
+	gasCounter.Set(api.EncodeI64(leftover + gas))
+	return nil
+}
+
+func (m *globalGasMeter) RemainingGas() (int64, error) {
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return 0, err
+	}
+
+	leftover := int64(gasCounter.Get())
+	if leftover < 0 {
+		return 0, types.OutOfGasError
+	}
+
+	return leftover, nil
+}
+
+func (m *globalGasMeter) Child(limit int64) (types.GasMeter, error) {
+	return types.NewChildGasMeter(m, limit)
+}
+
+// setGas replaces the remaining gas
+func (m *globalGasMeter) setGas(gas int64) error {
+	gasCounter, err := m.gasCounter()
+	if err != nil {
+		return err
+	}
+
+	gasCounter.Set(api.EncodeI64(gas))
+	return nil
+}
+
+// reset drops the references to the instance
+func (m *globalGasMeter) reset() {
+	m.counter = nil
+}
+
+// stackHeight returns the stack height counter injected by instrument.LimitStack
+func (c *Context) stackHeight() (uint32, error) {
+	global, ok := mutableGlobal(c.Module, instrument.StackHeightExport)
+	if !ok {
+		return 0, errors.New("stack height counter not exported")
+	}
+	return uint32(global.Get()), nil
+}
+
+// resetStackHeight clears the counter, which is left over the limit by a stack
+// overflow. The counter is only exported if the stack height is limited.
+func (c *Context) resetStackHeight() error {
+	global, ok := mutableGlobal(c.Module, instrument.StackHeightExport)
+	if !ok {
+		return nil
+	}
+	global.Set(0)
+	return nil
+}
+
+// mutableGlobal looks up an exported mutable global of the instance
+func mutableGlobal(module api.Module, name string) (api.MutableGlobal, bool) {
+	global, ok := module.ExportedGlobal(name).(api.MutableGlobal)
+	return global, ok
+}
@@ -0,0 +1,38 @@
+package wazero
+
+import (
+	"github.com/tetratelabs/wazero"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// exportedHooks returns the hooks exported by the module, the hooks which are
+// not exported as functions without parameters are disabled
+func exportedHooks(logger types.Logger, module wazero.CompiledModule, hooks *types.Lifecycle) types.Lifecycle {
+	exported := make(map[string]bool)
+	for name, fn := range module.ExportedFunctions() {
+		if len(fn.ParamTypes()) == 0 {
+			exported[name] = true
+		}
+	}
+
+	found := *hooks
+	for _, hook := range []*types.LifecycleHook{&found.Init, &found.PreCall, &found.PostCall, &found.Teardown} {
+		if !exported[hook.Export] {
+			hook.Export = ""
+			continue
+		}
+		logger.Debug("lifecycle hook found", "export", hook.Export, "gas", hook.Gas)
+	}
+	return found
+}
+
+// teardown runs the teardown hook of the instance before it is dropped, the
+// hook only runs on the instances initialized by the init hook
+func (w *wazeroRuntime) teardown() {
+	if w.ctx == nil || w.ctx.Module == nil || w.ctx.Module.IsClosed() || !w.ctx.initialized || w.hooks.Teardown.Export == "" {
+		return
+	}
+	w.ctx.initialized = false
+	types.Teardown(w)
+}
@@ -0,0 +1,92 @@
+package wazero
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// instantiateHostModules instantiates the host modules imported by the aspect.
+// The host modules are instantiated once in the wazero runtime and reused by
+// ResetStore. The functions defined call the host api registered in the
+// current registry of the runtime, since each reset may come with a new registry.
+func (w *wazeroRuntime) instantiateHostModules(ctx context.Context) error {
+	builders := make(map[string]wazero.HostModuleBuilder)
+	builder := func(module string) wazero.HostModuleBuilder {
+		if b, ok := builders[module]; ok {
+			return b
+		}
+		builders[module] = w.runtime.NewHostModuleBuilder(module)
+		return builders[module]
+	}
+
+	for module, namespaces := range w.apis.HostFuncs() {
+		for ns, methods := range namespaces {
+			for method, hostFunc := range methods {
+				sig, err := signatureOf(hostFunc.Func)
+				if err != nil {
+					w.logger.Error("failed to link host api", "module", module, "namespace", ns, "method", method, "err", err)
+					return errors.Wrapf(
+						err, "unable to link host api %s:%s.%s", module, ns, method,
+					)
+				}
+
+				var results []api.ValueType
+				if sig.result {
+					results = []api.ValueType{api.ValueTypeI32}
+				}
+				id := hostAPI{module, ns, method}
+				builder(buildModuleName(module)).NewFunctionBuilder().
+					WithGoModuleFunction(w.hostFunction(id, sig), sig.params, results).
+					Export(buildModuleMethod(ns, method))
+			}
+		}
+	}
+
+	w.linkAbort(builder("env"))
+
+	// instantiate in a stable order, so that the failures are reproducible
+	names := make([]string, 0, len(builders))
+	for name := range builders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := builders[name].Instantiate(ctx); err != nil {
+			return errors.Wrapf(err, "unable to link host module %s", name)
+		}
+	}
+	return nil
+}
+
+// linkAbort links the abort function of AssemblyScript, which is called with
+// the message and the file name as strings, and the line and the column.
+func (w *wazeroRuntime) linkAbort(builder wazero.HostModuleBuilder) {
+	abort := func(_ context.Context, _ api.Module, stack []uint64) {
+		message, file := api.DecodeI32(stack[0]), api.DecodeI32(stack[1])
+		line, column := api.DecodeI32(stack[2]), api.DecodeI32(stack[3])
+		err := &types.AbortError{Line: line, Column: column}
+
+		var readErr error
+		if err.Message, readErr = w.ctx.readASString(message); readErr != nil {
+			w.logger.Error("failed to read abort message", "err", readErr)
+		}
+		if err.File, readErr = w.ctx.readASString(file); readErr != nil {
+			w.logger.Error("failed to read abort file name", "err", readErr)
+		}
+
+		w.logger.Info("aspect aborted", "message", err.Message, "file", err.File, "line", line, "column", column)
+		w.ctx.trapErr = err
+		panic(err)
+	}
+
+	i32 := api.ValueTypeI32
+	builder.NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(abort), []api.ValueType{i32, i32, i32, i32}, nil).
+		Export("abort")
+}
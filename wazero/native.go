@@ -0,0 +1,36 @@
+package wazero
+
+import (
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// encodeValue encodes a value converted by types.NativeArg
+func encodeValue(v interface{}) uint64 {
+	switch v := v.(type) {
+	case int32:
+		return api.EncodeI32(v)
+	case int64:
+		return api.EncodeI64(v)
+	case float32:
+		return api.EncodeF32(v)
+	case float64:
+		return api.EncodeF64(v)
+	}
+	return 0
+}
+
+// nativeResult decodes a result of an export to the Go value of its type
+func nativeResult(kind api.ValueType, value uint64) (interface{}, error) {
+	switch kind {
+	case api.ValueTypeI32:
+		return api.DecodeI32(value), nil
+	case api.ValueTypeI64:
+		return int64(value), nil
+	case api.ValueTypeF32:
+		return api.DecodeF32(value), nil
+	case api.ValueTypeF64:
+		return api.DecodeF64(value), nil
+	}
+	return nil, errors.Errorf("read output failed, unsupported %s result", api.ValueTypeName(kind))
+}
@@ -0,0 +1,631 @@
+package wazero
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+
+	"github.com/artela-network/aspect-runtime/instrument"
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// coreFeatures are the wasm features enabled for the aspects, the same as the
+// wasmtime engine: SIMD, threads, bulk memory and reference types are disabled
+// since the instrumentation does not support them.
+const coreFeatures = api.CoreFeaturesV1 |
+	api.CoreFeatureMutableGlobal |
+	api.CoreFeatureMultiValue |
+	api.CoreFeatureSignExtensionOps |
+	api.CoreFeatureNonTrappingFloatToIntConversion
+
+// trapCodes maps the runtime errors of wazero to the trap codes
+var trapCodes = map[string]types.TrapCode{
+	"stack overflow":                types.TrapStackOverflow,
+	"out of bounds memory access":   types.TrapMemoryOutOfBounds,
+	"invalid table access":          types.TrapTableOutOfBounds,
+	"indirect call type mismatch":   types.TrapBadSignature,
+	"integer overflow":              types.TrapIntegerOverflow,
+	"integer divide by zero":        types.TrapIntegerDivisionByZero,
+	"invalid conversion to integer": types.TrapBadConversionToInteger,
+	"unreachable":                   types.TrapUnreachableCodeReached,
+}
+
+type wazeroValidator struct {
+	logger  types.Logger
+	runtime wazero.Runtime
+}
+
+func NewWazeroValidator(ctx context.Context, logger types.Logger) (types.Validator, error) {
+	// the code is only compiled to be validated, the interpreter compiles fastest
+	config := wazero.NewRuntimeConfigInterpreter().WithCoreFeatures(coreFeatures)
+	return &wazeroValidator{
+		logger:  logger,
+		runtime: wazero.NewRuntimeWithConfig(ctx, config),
+	}, nil
+}
+
+func (w *wazeroValidator) Validate(code []byte) error {
+	compiled, err := w.runtime.CompileModule(context.Background(), code)
+	if err != nil {
+		w.logger.Error("wasm validation failed", "err", err)
+		return err
+	}
+	if err := compiled.Close(context.Background()); err != nil {
+		return err
+	}
+
+	// the aspect rules are the same for both engines
+	if err := types.ValidateAspect(code); err != nil {
+		w.logger.Error("aspect validation failed", "err", err)
+		return err
+	}
+	return nil
+}
+
+// caches are the compilation caches shared by all runtimes of the process,
+// one for each memory limit.
+var caches = struct {
+	sync.Mutex
+	m map[uint32]wazero.CompilationCache
+}{m: make(map[uint32]wazero.CompilationCache)}
+
+func sharedCache(memoryLimitPages uint32) wazero.CompilationCache {
+	caches.Lock()
+	defer caches.Unlock()
+
+	cache, ok := caches.m[memoryLimitPages]
+	if !ok {
+		cache = wazero.NewCompilationCache()
+		caches.m[memoryLimitPages] = cache
+	}
+	return cache
+}
+
+// wazeroRuntime is a wrapper for the wazero runtime, which runs the aspects
+// without cgo
+type wazeroRuntime struct {
+	sync.Mutex
+
+	// runtime holds the host modules and the instance of the aspect, the
+	// compiled code is shared with the other runtimes by the compilation cache
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+
+	ctx *Context
+
+	apis *types.HostAPIRegistry
+
+	config *types.RuntimeConfig
+
+	// interrupted is set by Interrupt, and cleared once the call is stopped
+	interrupted atomic.Bool
+
+	// cancel cancels the context of the running call, it is guarded by
+	// cancelLock as it is used by Interrupt from other goroutines
+	cancelLock sync.Mutex
+	cancel     context.CancelFunc
+
+	// hooks are the lifecycle hooks exported by the module
+	hooks types.Lifecycle
+
+	logger types.Logger
+}
+
+func NewWazeroRuntime(ctx context.Context, logger types.Logger, code []byte, apis *types.HostAPIRegistry, config *types.RuntimeConfig) (out types.AspectRuntime, err error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	if err := types.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	w := &wazeroRuntime{
+		config: config,
+		logger: logger.With("runtime", "wazero"),
+	}
+	w.runtime = wazero.NewRuntimeWithConfig(context.Background(), newWazeroConfig(config))
+	defer func() {
+		if err != nil {
+			if closeErr := w.runtime.Close(context.Background()); closeErr != nil {
+				logger.Error("failed to close wazero runtime", "err", closeErr)
+			}
+		}
+	}()
+
+	startTime := time.Now()
+	release := types.AcquireCompileSlot()
+	w.module, err = w.runtime.CompileModule(context.Background(), code)
+	release()
+	if err != nil {
+		logger.Error("failed to compile wasm module", "err", err)
+		return nil, err
+	}
+	logger.Debug("wasm module compiled", "duration", time.Since(startTime).String())
+	w.hooks = exportedHooks(w.logger, w.module, config.Hooks())
+	if err := validateTables(code, config.Limits()); err != nil {
+		logger.Error("failed to instantiate wasm module", "err", err)
+		return nil, &types.InstantiationError{Err: err}
+	}
+
+	// init runtime context
+	w.ctx = w.newContext(ctx)
+
+	// link all host apis, the host modules are kept for the whole life of the runtime
+	w.apis = apis
+	if err := w.instantiateHostModules(context.Background()); err != nil {
+		logger.Error("failed to link host apis", "err", err)
+		return nil, err
+	}
+
+	// instantiate module
+	defer func() {
+		if r := recover(); r != nil {
+			err = &types.InstantiationError{Err: errors.New(fmt.Sprintln(r))}
+			logger.Error("failed to create wasm instance", "err", r, "stack", debug.Stack())
+		}
+	}()
+
+	if err := w.instantiate(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// newWazeroConfig provides the wazero config of the runtime
+func newWazeroConfig(config *types.RuntimeConfig) wazero.RuntimeConfig {
+	memoryLimitPages := uint32(config.Limits().MaxMemorySize / types.WASMPageSize)
+	return wazero.NewRuntimeConfig().
+		WithCoreFeatures(coreFeatures).
+		// the running calls are stopped once their context is done, see Interrupt
+		WithCloseOnContextDone(true).
+		// memories cannot grow over the max memory size of the runtime
+		WithMemoryLimitPages(memoryLimitPages).
+		WithCompilationCache(sharedCache(memoryLimitPages))
+}
+
+// newContext creates a runtime context without an instance
+func (w *wazeroRuntime) newContext(ctx context.Context) *Context {
+	c := NewContext(ctx, w.logger)
+	c.abi = w.config.GuestABI()
+	return c
+}
+
+// instantiate creates a new instance of the module in the context. Only the
+// start section of the module is run, the start function of the abi is
+// called before each call.
+func (w *wazeroRuntime) instantiate() error {
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions()
+	module, err := w.runtime.InstantiateModule(w.ctx.Context, w.module, config)
+	if err != nil {
+		w.logger.Error("failed to instantiate wasm module", "err", err)
+		return &types.InstantiationError{Err: err}
+	}
+
+	w.ctx.Module = module
+	w.ctx.initialized = false
+	return nil
+}
+
+func (w *wazeroRuntime) Context() context.Context {
+	return w.ctx
+}
+
+func (w *wazeroRuntime) Logger() types.Logger {
+	return w.logger
+}
+
+// GasProfile is not supported by the wazero engine
+func (w *wazeroRuntime) GasProfile() *types.GasProfile {
+	return nil
+}
+
+// Interrupt cancels the context of the running call, see types.AspectRuntime
+func (w *wazeroRuntime) Interrupt() {
+	w.interrupted.Store(true)
+
+	w.cancelLock.Lock()
+	defer w.cancelLock.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// Interruption returns the error of an interrupted call, nil if the call can
+// go on, see types.CallEngine
+func (w *wazeroRuntime) Interruption() error {
+	if w.interrupted.Load() {
+		return types.InterruptedError
+	}
+	return types.ContextError(w.ctx.Context)
+}
+
+// BeginCall derives the context of a call, which is canceled by Interrupt,
+// see types.CallEngine
+func (w *wazeroRuntime) BeginCall() func() {
+	callCtx, cancel := context.WithCancel(w.ctx.Context)
+
+	w.cancelLock.Lock()
+	w.cancel = cancel
+	w.cancelLock.Unlock()
+
+	// the interruption may have been requested before the cancel is set
+	if w.interrupted.Load() {
+		cancel()
+	}
+	w.ctx.callCtx = callCtx
+
+	return func() {
+		w.cancelLock.Lock()
+		w.cancel = nil
+		w.cancelLock.Unlock()
+
+		cancel()
+		w.ctx.callCtx = w.ctx.Context
+		w.interrupted.Store(false)
+	}
+}
+
+// Call wasm
+func (w *wazeroRuntime) Call(method string, gas int64, args ...interface{}) (interface{}, int64, error) {
+	result, err := w.CallWithResult(method, gas, args...)
+	return result.Value, result.GasLeft, err
+}
+
+// CallWithResult calls wasm and collects the statistics of the execution
+func (w *wazeroRuntime) CallWithResult(method string, gas int64, args ...interface{}) (*types.CallResult, error) {
+	return types.CallWithResult(w, method, gas, args...)
+}
+
+// CallBatch calls the methods of the batch in order, the instance is initialized
+// once for the whole batch
+func (w *wazeroRuntime) CallBatch(batch *types.Batch) ([]*types.CallResult, error) {
+	return types.CallBatch(w, batch)
+}
+
+// VMContext returns the context of the instance, see types.CallEngine
+func (w *wazeroRuntime) VMContext() types.VMContext {
+	return w.ctx
+}
+
+// Hooks returns the lifecycle hooks exported by the module, see types.CallEngine
+func (w *wazeroRuntime) Hooks() types.Lifecycle {
+	return w.hooks
+}
+
+// GuestABI returns the guest ABI of the module, see types.CallEngine
+func (w *wazeroRuntime) GuestABI() *types.GuestABI {
+	return w.config.GuestABI()
+}
+
+// Init initializes the instance for a call, see types.CallEngine
+func (w *wazeroRuntime) Init(gas int64) (bool, error) {
+	return true, w.init(gas)
+}
+
+// ReleaseArgs unpins and frees the arguments of the last call, see types.CallEngine
+func (w *wazeroRuntime) ReleaseArgs() {
+	w.ctx.releaseArgs()
+}
+
+// ResetStackHeight resets the stack height counter, see types.CallEngine
+func (w *wazeroRuntime) ResetStackHeight() error {
+	return w.ctx.resetStackHeight()
+}
+
+// CountHostCalls starts or stops counting the host calls, see types.CallEngine
+func (w *wazeroRuntime) CountHostCalls(count bool) {
+	w.ctx.hostCalls = nil
+	if count {
+		w.ctx.hostCalls = make(map[hostAPI]int64)
+	}
+}
+
+// HostCalls returns the host calls counted, see types.CallEngine
+func (w *wazeroRuntime) HostCalls() map[string]int64 {
+	calls := make(map[string]int64, len(w.ctx.hostCalls))
+	for api, n := range w.ctx.hostCalls {
+		calls[api.String()] = n
+	}
+	return calls
+}
+
+// MemorySize returns the size of the linear memory, see types.CallEngine
+func (w *wazeroRuntime) MemorySize() (int64, error) {
+	mem, err := w.ctx.memory()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(mem)), nil
+}
+
+// Invoke calls an export, see types.CallEngine
+func (w *wazeroRuntime) Invoke(method string, args ...interface{}) (interface{}, error) {
+	run := w.ctx.Module.ExportedFunction(method)
+	if run == nil {
+		return nil, errors.WithMessage(types.MethodNotFoundError, method)
+	}
+
+	// the apis are released when the runtime is reset, the teardown hook of a
+	// pooled runtime runs without them
+	if w.apis != nil {
+		w.apis.SetContext(w.ctx)
+	}
+	params := run.Definition().ParamTypes()
+	if len(params) != len(args) {
+		return nil, errors.Errorf("method %s expects %d arguments, got %d", method, len(params), len(args))
+	}
+
+	vals, err := types.NativeArgs(w.ctx, params, args, w.ctx.allocArg)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]uint64, len(vals))
+	for i, v := range vals {
+		encoded[i] = encodeValue(v)
+	}
+
+	w.ctx.trapErr = nil
+	res, err := run.Call(w.ctx.callCtx, encoded...)
+	if err != nil {
+		return nil, w.callError(method, err)
+	}
+
+	resultTypes := run.Definition().ResultTypes()
+	results := make([]interface{}, len(res))
+	for i, v := range res {
+		if results[i], err = nativeResult(resultTypes[i], v); err != nil {
+			return nil, err
+		}
+	}
+
+	switch len(results) {
+	case 0:
+		return nil, nil
+	case 1:
+		return results[0], nil
+	}
+	return results, nil
+}
+
+// callError maps the error of a failed call to the errors of the types package
+func (w *wazeroRuntime) callError(method string, err error) error {
+	// the instance is closed with the exit code once the context of the call is done
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case sys.ExitCodeContextCanceled, sys.ExitCodeDeadlineExceeded:
+			if err := w.Interruption(); err != nil {
+				return err
+			}
+			return types.InterruptedError
+		}
+	}
+
+	// only the first line, the stack trace of wazero follows
+	trapErr := &types.TrapError{Code: types.TrapUnknown, Message: strings.SplitN(err.Error(), "\n", 2)[0]}
+	if cause := errors.Unwrap(err); cause != nil {
+		if code, ok := trapCodes[cause.Error()]; ok {
+			trapErr.Code = code
+			trapErr.Message = cause.Error()
+		}
+	} else if code, ok := trapCodes[trapErr.Message]; ok {
+		// the native stack overflow is not wrapped
+		trapErr.Code = code
+	}
+	code := trapErr.Code
+
+	// the error raised by the host, e.g. a failed host api
+	if err := w.ctx.trapErr; err != nil {
+		return err
+	}
+
+	// the instrumented gas counter is set to -1 before trapping
+	if _, gasErr := w.ctx.RemainingWASMGas(); gasErr == types.OutOfGasError {
+		return types.OutOfGasError
+	}
+
+	if err := w.stackOverflow(code); err != nil {
+		return err
+	}
+
+	w.logger.Error("aspect trapped", "method", method, "code", code, "message", trapErr.Message)
+	return errors.WithMessagef(trapErr, "method %s execution fail", method)
+}
+
+func (w *wazeroRuntime) init(gas int64) error {
+	if w.ctx.Module.IsClosed() {
+		// the instance is closed once a call is interrupted
+		w.logger.Debug("recreating closed wasm instance")
+		w.ctx.Reset()
+		if err := w.instantiate(); err != nil {
+			return err
+		}
+	}
+
+	w.logger.Debug("filling up gas", "gas", gas)
+	if err := w.ctx.AddEVMGas(gas); err != nil {
+		w.logger.Error("failed to add gas", "err", err)
+		return err
+	}
+
+	if err := w.ctx.resetStackHeight(); err != nil {
+		w.logger.Error("failed to reset stack height", "err", err)
+		return err
+	}
+
+	w.logger.Debug("initializing aspect")
+	if start := w.config.GuestABI().Start; start != "" {
+		if _, err := w.Invoke(start); err != nil {
+			w.logger.Error("failed to initialize aspect", "err", err)
+			return err
+		}
+	}
+
+	if !w.ctx.initialized {
+		if err := types.RunHook(w, "init", w.hooks.Init, true); err != nil {
+			w.logger.Error("failed to initialize aspect instance", "err", err)
+			return err
+		}
+		w.ctx.initialized = true
+	}
+
+	w.logger.Debug("aspect initialized")
+	return nil
+}
+
+// stackOverflow returns the error of a call failed by exceeding the stack
+// height limit, or nil if the limit is not exceeded. The native stack overflow
+// of the engine depends on the architecture and the code generation, it must
+// never be reached before the limit. It still fails the call with a stack
+// overflow, but it is logged and reported apart from the limit.
+func (w *wazeroRuntime) stackOverflow(code types.TrapCode) error {
+	if w.config.MaxStackHeight == 0 {
+		// only the native stack limits the recursion
+		if code == types.TrapStackOverflow {
+			return types.StackOverflowError
+		}
+		return nil
+	}
+
+	height, heightErr := w.ctx.stackHeight()
+	if heightErr != nil {
+		w.logger.Error("failed to read stack height", "err", heightErr)
+	} else if height > w.config.MaxStackHeight {
+		return types.StackOverflowError
+	}
+
+	if code != types.TrapStackOverflow {
+		return nil
+	}
+	w.logger.Error("native stack overflowed before the stack height limit", "height", height, "limit", w.config.MaxStackHeight)
+	return errors.WithMessage(types.StackOverflowError, "native stack overflowed before the stack height limit")
+}
+
+// ResetStore reset the whole memory of wasm
+func (w *wazeroRuntime) ResetStore(ctx context.Context, apis *types.HostAPIRegistry) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintln(r))
+			w.logger.Error("reset wasm store panic", "err", r, "stack", debug.Stack())
+		}
+	}()
+
+	w.logger.Debug("resetting wasm store")
+
+	if w.ctx != nil {
+		w.teardown()
+		w.ctx.Reset()
+	}
+	w.interrupted.Store(false)
+	w.ctx = w.newContext(ctx)
+
+	// the host apis are looked up in the registry on each call, so only the
+	// instance needs to be recreated
+	w.apis = apis
+
+	if err := w.instantiate(); err != nil {
+		return err
+	}
+
+	w.logger.Debug("wasm store reset")
+
+	return nil
+}
+
+func (w *wazeroRuntime) Destroy() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.logger.Debug("destroying wasm runtime")
+
+	w.clear()
+	if w.runtime != nil {
+		// closes the host modules and the compiled module as well
+		if err := w.runtime.Close(context.Background()); err != nil {
+			w.logger.Error("failed to close wazero runtime", "err", err)
+		}
+	}
+	w.runtime = nil
+	w.module = nil
+}
+
+func (w *wazeroRuntime) Reset() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.logger.Debug("resetting wasm runtime")
+
+	w.clear()
+}
+
+func (w *wazeroRuntime) clear() {
+	// the instance is recreated before the next invocation, the host modules
+	// do not depend on it and are kept
+	if w.ctx != nil {
+		w.teardown()
+		w.ctx.Reset()
+	}
+	w.ctx = nil
+	w.apis = nil
+}
+
+// validateConfig checks that the runtime config is supported by the engine
+func validateConfig(config *types.RuntimeConfig) error {
+	if config.Metering != types.InstrumentedMetering {
+		return errors.New("fuel metering is not supported by the wazero engine")
+	}
+	if config.Profiling {
+		return errors.New("profiling is not supported by the wazero engine")
+	}
+	if config.Reset == types.SnapshotReset {
+		return errors.New("snapshot reset is not supported by the wazero engine")
+	}
+	if config.WASI != nil {
+		return errors.New("wasi is not supported by the wazero engine")
+	}
+	return config.Validate()
+}
+
+// validateTables checks the tables of the module against the limits, which
+// wasmtime enforces on instantiation with the limiter of the store. Reference
+// types are disabled, so the tables never grow after the instantiation, and
+// the single instance with at most one memory is always within MaxInstances.
+func validateTables(code []byte, limits types.RuntimeOptions) error {
+	m, err := instrument.DecodeModule(code)
+	if err != nil {
+		return err
+	}
+
+	tables := int64(m.ImportedTables()) + int64(len(m.Tables))
+	if limits.MaxTables != types.Unlimited && tables > limits.MaxTables {
+		return errors.Errorf("%d tables exceed the limit of %d tables", tables, limits.MaxTables)
+	}
+	for i, table := range m.Tables {
+		if limits.MaxTableElements != types.Unlimited && int64(table.Min) > limits.MaxTableElements {
+			return errors.Errorf("table %d of %d elements exceeds the limit of %d elements",
+				m.ImportedTables()+uint32(i), table.Min, limits.MaxTableElements)
+		}
+	}
+	return nil
+}
+
+func buildModuleMethod(ns types.NameSpace, method types.MethodName) string {
+	return fmt.Sprintf("%s.%s", ns, method)
+}
+
+func buildModuleName(module types.Module) string {
+	return string(module)
+}
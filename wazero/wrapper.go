@@ -0,0 +1,152 @@
+package wazero
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/artela-network/aspect-runtime/types"
+)
+
+// hostAPI identifies a host api
+type hostAPI struct {
+	module types.Module
+	ns     types.NameSpace
+	method types.MethodName
+}
+
+// String returns the name of the host api as module:namespace.method
+func (a hostAPI) String() string {
+	return fmt.Sprintf("%s:%s.%s", a.module, a.ns, a.method)
+}
+
+// hostSignature is the wasm signature of a host api, the arguments and the
+// result are pointers of the header protocol
+type hostSignature struct {
+	params []api.ValueType
+	result bool
+}
+
+func (s hostSignature) equal(other hostSignature) bool {
+	return len(s.params) == len(other.params) && s.result == other.result
+}
+
+// Wrap checks that the host api can be called from the wasm code. The runtime
+// wraps the host apis of the registry on its own, so the registries created
+// with the wrapper of another engine are accepted as well.
+func Wrap(_ *types.HostAPIRegistry, _ types.Module, _ types.NameSpace, _ types.MethodName,
+	hostFunc *types.HostFuncWithGasRule) (interface{}, error) {
+	if _, err := signatureOf(hostFunc.Func); err != nil {
+		return nil, err
+	}
+	return hostFunc, nil
+}
+
+// signatureOf returns the wasm signature of a host api, which takes up to 3
+// arguments and returns an error, optionally preceded by a result.
+func signatureOf(fn interface{}) (hostSignature, error) {
+	errNotSupport := errors.WithMessage(types.UnsupportedTypeError, "host function not supported")
+
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func || t.NumOut() > 2 || t.NumOut() == 0 || t.NumIn() > 3 {
+		return hostSignature{}, errNotSupport
+	}
+
+	params := make([]api.ValueType, t.NumIn())
+	for i := range params {
+		params[i] = api.ValueTypeI32
+	}
+	return hostSignature{params: params, result: t.NumOut() == 2}, nil
+}
+
+// hostFunction builds the wasm function of a host api, which calls the host
+// api registered in the current registry of the runtime. The host api must
+// keep the signature it is linked with.
+func (w *wazeroRuntime) hostFunction(id hostAPI, linked hostSignature) api.GoModuleFunc {
+	return func(_ context.Context, _ api.Module, stack []uint64) {
+		startTime := time.Now()
+
+		defer func() {
+			w.logger.Debug("host func done",
+				"duration", time.Since(startTime).String(),
+				"module", id.module,
+				"namespace", id.ns,
+				"method", id.method)
+		}()
+
+		hostFunc := w.hostFunc(id)
+		if hostFunc == nil {
+			panic(w.hostAPIFailure(id, errors.New("host api not found")))
+		}
+		if sig, err := signatureOf(hostFunc.Func); err != nil || !sig.equal(linked) {
+			panic(w.hostAPIFailure(id, errors.New("host api signature changed")))
+		}
+
+		ptrs := make([]int32, len(linked.params))
+		for i := range ptrs {
+			ptrs[i] = api.DecodeI32(stack[i])
+		}
+
+		out, err := w.executeWrapper(id, hostFunc, ptrs...)
+		if err != nil {
+			panic(err)
+		}
+		if len(out) > 0 {
+			stack[0] = api.EncodeI32(out[0])
+		}
+	}
+}
+
+// hostFunc returns the host api from the current registry
+func (w *wazeroRuntime) hostFunc(id hostAPI) *types.HostFuncWithGasRule {
+	if w.apis == nil {
+		return nil
+	}
+	return w.apis.HostFuncs()[id.module][id.ns][id.method]
+}
+
+func (w *wazeroRuntime) executeWrapper(id hostAPI, hostFunc *types.HostFuncWithGasRule, ptrs ...int32) ([]int32, error) {
+	vmCtx := w.ctx
+	if vmCtx.hostCalls != nil {
+		vmCtx.hostCalls[id]++
+	}
+
+	gasRule := hostFunc.GasRule
+	gasRule.SetContext(vmCtx)
+
+	args, paramSize, err := types.ReadHostParams(vmCtx, ptrs...)
+	if paramSize > 0 {
+		if err := gasRule.ConsumeGas(paramSize); err != nil {
+			return nil, w.hostAPIFailure(id, err)
+		}
+	}
+	if err != nil {
+		vmCtx.Logger().Error("read params failed", "err", err)
+		return nil, w.hostAPIFailure(id, errors.WithMessage(err, "read params failed"))
+	}
+	// host apis charge their gas with the gas meter of vmCtx directly
+	res := reflect.ValueOf(hostFunc.Func).Call(args)
+
+	outPtrs, err := types.WriteHostResults(vmCtx, res)
+	if err != nil {
+		vmCtx.Logger().Error("host api execution fail", "err", err)
+		return nil, w.hostAPIFailure(id, err)
+	}
+	return outPtrs, nil
+}
+
+// hostAPIFailure builds the error stopping the wasm code after a failed host api.
+// The error is kept in the context, and returned by the call instead of the trap.
+func (w *wazeroRuntime) hostAPIFailure(id hostAPI, err error) error {
+	if !errors.Is(err, types.OutOfGasError) {
+		err = &types.HostAPIError{Module: id.module, Namespace: id.ns, Method: id.method, Err: err}
+	}
+	if w.ctx != nil {
+		w.ctx.trapErr = err
+	}
+	return err
+}